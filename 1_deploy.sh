@@ -10,19 +10,28 @@ set -x # Print commands
 
 go build ./pkg/cmd/capideploy/capideploy.go
 
-./capideploy list_deployment_resources -p sample.jsonnet -v > deploy.log
+# Exit code 2 means there are billed resources left from a previous run
+set +e
+./capideploy list_deployment_resources -p sample.jsonnet -billed active -billed-exit -o csv > deploy.log
+LIST_EXIT_CODE=$?
+set -e
 
 set +x
 SECONDS=0
-export BILLED_RESOURCES=$(cat deploy.log | grep ",billed")
-if [ "$BILLED_RESOURCES" != "" ]; then
+if [ "$LIST_EXIT_CODE" = "2" ]; then
   echo "This deployment has resources that may be still/already active, please check the log"
+elif [ "$LIST_EXIT_CODE" != "0" ]; then
+  echo "Cannot list deployment resources"
+  exit 1
 fi
 
 set -x # Print commands
 
 ./capideploy create_floating_ips -p sample.jsonnet -v >> deploy.log
 
+# ssh config (bastion as jumphost), hosts file and Ansible inventory for this deployment
+./capideploy export_inventory -p sample.jsonnet >> deploy.log
+
 set +x
 
 # Save reserved BASTION_IP so we can run capitoolbelt on bastion
@@ -32,17 +41,6 @@ if [ "$BASTION_IP" = "" ]; then
   exit 1
 fi
 
-# Configure SSH jumphost so we can run nodetool on Cassandra hosts (requires write access to ~/.ssh/config)
-if ! grep -q "$BASTION_IP" ~/.ssh/config; then
-  echo "Adding a new jumphost to ~/.ssh/config..."
-  echo "" | tee -a ~/.ssh/config
-  echo "Host $BASTION_IP" | tee -a ~/.ssh/config
-  echo "  User $CAPIDEPLOY_SSH_USER" | tee -a ~/.ssh/config
-  echo "  StrictHostKeyChecking=no" | tee -a ~/.ssh/config
-  echo "  UserKnownHostsFile=/dev/null" | tee -a ~/.ssh/config
-  echo "  IdentityFile  $CAPIDEPLOY_AWS_SSH_ROOT_KEYPAIR_PRIVATE_KEY_OR_PATH" | tee -a ~/.ssh/config
-fi
-
 set -x
 
 ./capideploy create_networking -p sample.jsonnet -v >> deploy.log
@@ -65,11 +63,13 @@ set -x
 ./capideploy config_services "bastion,rabbitmq,prometheus,daemon*" -p sample.jsonnet -v >> deploy.log
 #./capideploy config_services "bastion" -p sample.jsonnet -v >> deploy.log
 
-ssh -o StrictHostKeyChecking=no -i $CAPIDEPLOY_AWS_SSH_ROOT_KEYPAIR_PRIVATE_KEY_OR_PATH -J $BASTION_IP $CAPIDEPLOY_SSH_USER@10.5.0.11 'nodetool describecluster;nodetool status'
+./capideploy ssh cass001 -p sample.jsonnet -- 'nodetool describecluster;nodetool status'
 
 duration=$SECONDS
 echo "$(($duration / 60))m $(($duration % 60))s elapsed."
 
 set +x
 echo To run commands against this deployment, you will probably need this:
-echo export BASTION_IP=$BASTION_IP
\ No newline at end of file
+echo export BASTION_IP=$BASTION_IP
+echo To ssh to any instance, like cass001, without capideploy:
+echo ssh -F $CAPIDEPLOY_DEPLOYMENT_NAME.ssh_config cass001
@@ -0,0 +1,368 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	KindCloud   string = "cloud"   // Mutating cloud API call
+	KindScript  string = "script"  // Embedded script run on an instance
+	KindJournal string = "journal" // The journal itself
+)
+
+// A record cut off by a crash mid-append was dropped
+const OperationDropTorn string = "drop_torn_record"
+
+const (
+	OutcomeOk     string = "ok"
+	OutcomeFailed string = "failed"
+)
+
+type deploymentNameCtxKey struct{}
+
+// Cloud calls made with the returned context are recorded under deploymentName instead of the journal's,
+// for commands that work on other deployments, like reap_expired
+func WithDeploymentName(goCtx context.Context, deploymentName string) context.Context {
+	return context.WithValue(goCtx, deploymentNameCtxKey{}, deploymentName)
+}
+
+// Empty if the context does not say
+func DeploymentName(goCtx context.Context) string {
+	deploymentName, _ := goCtx.Value(deploymentNameCtxKey{}).(string)
+	return deploymentName
+}
+
+type nicknameCtxKey struct{}
+
+// Cloud calls made with the returned context are recorded with the instance nickname they work on
+func WithNickname(goCtx context.Context, nickname string) context.Context {
+	return context.WithValue(goCtx, nicknameCtxKey{}, nickname)
+}
+
+// Empty if the context does not say
+func Nickname(goCtx context.Context) string {
+	nickname, _ := goCtx.Value(nicknameCtxKey{}).(string)
+	return nickname
+}
+
+// One line of the journal. Each record carries the hash of the previous one, so editing, inserting
+// or deleting a line anywhere but at the end breaks the chain. With a key, hashes are HMAC-SHA256,
+// so whoever can write the journal but does not have the key cannot rebuild the chain after editing it.
+type Record struct {
+	Seq            int64    `json:"seq"`
+	Ts             string   `json:"ts"`
+	CallerIdentity string   `json:"caller_identity"`
+	DeploymentName string   `json:"deployment_name"`
+	Kind           string   `json:"kind"`
+	Nickname       string   `json:"nickname,omitempty"`      // Instance the script ran on or the cloud call worked on
+	ResourceName   string   `json:"resource_name,omitempty"` // Name tag of a created resource
+	Operation      string   `json:"operation"`               // Like EC2:RunInstances or scripts/cassandra/install.sh
+	ResourceIds    []string `json:"resource_ids,omitempty"`  // Cloud resource ids or instance ip address
+	DurationMs     int64    `json:"duration_ms"`
+	Outcome        string   `json:"outcome"`
+	Error          string   `json:"error,omitempty"`
+	PrevHash       string   `json:"prev_hash"`
+	Keyed          bool     `json:"keyed,omitempty"` // Hash is HMAC-SHA256
+	Hash           string   `json:"hash"`
+}
+
+func (r *Record) computeHash(key []byte) (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	recordBytes, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(recordBytes)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(recordBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// A journal is keyed or not from its first record on, mixing would let an editor strip the key off
+func checkKeyed(r *Record, key []byte) error {
+	if r.Keyed && len(key) == 0 {
+		return fmt.Errorf("record seq %d is keyed, the audit key is needed", r.Seq)
+	}
+	if !r.Keyed && len(key) > 0 {
+		return fmt.Errorf("record seq %d is not keyed, but an audit key was given", r.Seq)
+	}
+	return nil
+}
+
+// Append-only, safe for concurrent use. The chain continues from the last record already in the file,
+// other processes may append to the same file: appends hold an OS file lock and pick up their records first.
+type Journal struct {
+	mx             sync.Mutex
+	f              *os.File
+	path           string
+	key            []byte
+	size           int64 // Where our view of the file ends, records past it were appended by others
+	tornBytes      int64 // Dropped torn records not journaled yet
+	seq            int64
+	prevHash       string
+	deploymentName string
+	callerIdentity string
+}
+
+// Last complete record between offset and the end of the file, nil if there is none. A last line without
+// a line end is a record cut off by a crash mid-append or by truncating the file: tornOffset is where it starts,
+// -1 if there is no such line.
+func readLastRecord(f *os.File, offset int64) (*Record, int64, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, -1, err
+	}
+	if info.Size() == offset {
+		return nil, offset, -1, nil
+	}
+
+	var lastLine []byte
+	lineOffset := offset
+	tornOffset := int64(-1)
+	reader := bufio.NewReaderSize(io.NewSectionReader(f, offset, info.Size()-offset), 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, -1, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[len(line)-1] != '\n' {
+			tornOffset = lineOffset
+			break
+		}
+		lineOffset += int64(len(line))
+		if len(line) > 1 {
+			lastLine = line
+		}
+	}
+	if lastLine == nil {
+		return nil, info.Size(), tornOffset, nil
+	}
+	var r Record
+	if err := json.Unmarshal(lastLine, &r); err != nil {
+		return nil, 0, -1, fmt.Errorf("cannot parse last record: %s", err.Error())
+	}
+	return &r, info.Size(), tornOffset, nil
+}
+
+// Continues the chain from records appended since we last looked, by us or by other processes. Needs the file lock.
+// A torn last record is cut off the file, it never made it into the chain; the next append records that it was dropped.
+func (j *Journal) catchUp() error {
+	lastRecord, size, tornOffset, err := readLastRecord(j.f, j.size)
+	if err != nil {
+		return fmt.Errorf("cannot read audit journal %s: %s", j.path, err.Error())
+	}
+	if lastRecord != nil {
+		if err := checkKeyed(lastRecord, j.key); err != nil {
+			return fmt.Errorf("cannot append to audit journal %s: %s", j.path, err.Error())
+		}
+		j.seq = lastRecord.Seq
+		j.prevHash = lastRecord.Hash
+	}
+	if tornOffset >= 0 {
+		if err := j.f.Truncate(tornOffset); err != nil {
+			return fmt.Errorf("cannot drop torn last record of audit journal %s: %s", j.path, err.Error())
+		}
+		j.tornBytes += size - tornOffset
+		size = tornOffset
+	}
+	j.size = size
+	return nil
+}
+
+// Key may be empty, then hashes are plain SHA-256 and only accidental damage can be detected
+func OpenJournal(path string, key []byte, deploymentName string, callerIdentity string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit journal %s: %s", path, err.Error())
+	}
+	j := &Journal{f: f, path: path, key: key, deploymentName: deploymentName, callerIdentity: callerIdentity}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock audit journal %s: %s", path, err.Error())
+	}
+	err = j.catchUp()
+	unlockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Fills in sequence, timestamp, identity and hashes, then writes the record as one line.
+// DeploymentName is the journal's unless the record has one already.
+func (j *Journal) Append(r *Record) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if j.f == nil {
+		return fmt.Errorf("cannot write audit journal %s: closed", j.path)
+	}
+	if err := lockFile(j.f); err != nil {
+		return fmt.Errorf("cannot lock audit journal %s: %s", j.path, err.Error())
+	}
+	defer unlockFile(j.f)
+	if err := j.catchUp(); err != nil {
+		return err
+	}
+	if j.tornBytes > 0 {
+		torn := &Record{
+			Kind:      KindJournal,
+			Operation: OperationDropTorn,
+			Outcome:   OutcomeFailed,
+			Error:     fmt.Sprintf("%d bytes without a line end were dropped from the end of the journal", j.tornBytes)}
+		if err := j.write(torn); err != nil {
+			return err
+		}
+		j.tornBytes = 0
+	}
+	return j.write(r)
+}
+
+// Needs the file lock, the chain is caught up
+func (j *Journal) write(r *Record) error {
+	r.Seq = j.seq + 1
+	r.Ts = time.Now().UTC().Format(time.RFC3339Nano)
+	r.CallerIdentity = j.callerIdentity
+	if r.DeploymentName == "" {
+		r.DeploymentName = j.deploymentName
+	}
+	r.PrevHash = j.prevHash
+	r.Keyed = len(j.key) > 0
+	hash, err := r.computeHash(j.key)
+	if err != nil {
+		return fmt.Errorf("cannot hash audit record: %s", err.Error())
+	}
+	r.Hash = hash
+	recordBytes, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit record: %s", err.Error())
+	}
+	n, err := j.f.Write(append(recordBytes, '\n'))
+	if err != nil {
+		// Whatever part of it got written is torn, the next catch up drops it
+		return fmt.Errorf("cannot write audit journal %s: %s", j.path, err.Error())
+	}
+	j.size += int64(n)
+	j.seq = r.Seq
+	j.prevHash = r.Hash
+	return nil
+}
+
+// Sequence and hash of the last record written or seen by this journal. Keep them where the journal
+// writer cannot change them: verify_audit -head tells if records after them were cut off.
+func (j *Journal) Head() (int64, string) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.seq, j.prevHash
+}
+
+// Appends fail after this
+func (j *Journal) Close() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	if err != nil {
+		return fmt.Errorf("cannot close audit journal %s: %s", j.path, err.Error())
+	}
+	return nil
+}
+
+// Convenience for hooks that measure duration themselves. Empty deploymentName means the journal's.
+func (j *Journal) Record(deploymentName string, kind string, nickname string, resourceName string, operation string, resourceIds []string, duration time.Duration, opErr error) error {
+	r := &Record{
+		DeploymentName: deploymentName,
+		Kind:           kind,
+		Nickname:       nickname,
+		ResourceName:   resourceName,
+		Operation:      operation,
+		ResourceIds:    resourceIds,
+		DurationMs:     duration.Milliseconds(),
+		Outcome:        OutcomeOk}
+	if opErr != nil {
+		r.Outcome = OutcomeFailed
+		r.Error = opErr.Error()
+	}
+	return j.Append(r)
+}
+
+// Checks every hash and link of the chain, returns the number of records and the last hash. Cutting records
+// off the end cannot be detected from the journal alone: pass a head hash kept elsewhere, it must be in the chain.
+func VerifyJournal(path string, key []byte, head string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot open audit journal %s: %s", path, err.Error())
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, 64*1024)
+	lineIdx := 0
+	var count int64
+	prevHash := ""
+	var prevSeq int64
+	isHeadFound := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, prevHash, fmt.Errorf("cannot read audit journal %s: %s", path, err.Error())
+		}
+		if len(line) == 0 {
+			break
+		}
+		lineIdx++
+		if line[len(line)-1] != '\n' {
+			return count, prevHash, fmt.Errorf("line %d: last record is cut off, the journal was truncated or its writer crashed mid-append; the next append drops it and records that", lineIdx)
+		}
+		if len(line) == 1 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return count, prevHash, fmt.Errorf("line %d: cannot parse record: %s", lineIdx, err.Error())
+		}
+		if err := checkKeyed(&r, key); err != nil {
+			return count, prevHash, fmt.Errorf("line %d: %s", lineIdx, err.Error())
+		}
+		hash, err := r.computeHash(key)
+		if err != nil {
+			return count, prevHash, fmt.Errorf("line %d: cannot hash record: %s", lineIdx, err.Error())
+		}
+		if !hmac.Equal([]byte(hash), []byte(r.Hash)) {
+			return count, prevHash, fmt.Errorf("line %d: record seq %d was modified, hash %s does not match its content", lineIdx, r.Seq, r.Hash)
+		}
+		if r.PrevHash != prevHash || (count > 0 && r.Seq != prevSeq+1) {
+			return count, prevHash, fmt.Errorf("line %d: chain broken before record seq %d, records were removed or inserted", lineIdx, r.Seq)
+		}
+		if r.Hash == head {
+			isHeadFound = true
+		}
+		prevHash = r.Hash
+		prevSeq = r.Seq
+		count++
+	}
+	if head != "" && !isHeadFound {
+		return count, prevHash, fmt.Errorf("head %s is not in the chain, records were removed from the end", head)
+	}
+	return count, prevHash, nil
+}
@@ -0,0 +1,125 @@
+package cldaws
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/capillariesio/capillaries-deploy/pkg/audit"
+)
+
+// Called once per mutating API call (after all retries) with the Name tag and ids found in its input and output.
+// deploymentName and nickname come from audit.WithDeploymentName and audit.WithNickname, empty if the call context has none.
+type CallAuditFunc func(deploymentName string, nickname string, operation string, resourceName string, resourceIds []string, duration time.Duration, err error)
+
+// Fields that hold ids of resources capideploy creates or touches; everything else (owner ids, request ids etc) is noise
+var auditedIdFields map[string]struct{} = map[string]struct{}{
+	"AllocationId":      {},
+	"AssociationId":     {},
+	"GroupId":           {},
+	"ImageId":           {},
+	"InstanceId":        {},
+	"InstanceIds":       {},
+	"InternetGatewayId": {},
+	"NatGatewayId":      {},
+	"Resources":         {},
+	"RouteTableId":      {},
+	"SecurityGroupIds":  {},
+	"SnapshotId":        {},
+	"SubnetId":          {},
+	"VolumeId":          {},
+	"VpcId":             {}}
+
+// Deep enough for RunInstancesOutput.Instances[].InstanceId and CreateVpcInput.TagSpecifications[].Tags[].Key
+const auditMaxDepth int = 4
+
+func collectAuditFields(v reflect.Value, depth int, name *string, ids *[]string, seen map[string]struct{}) {
+	if depth > auditMaxDepth || !v.IsValid() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			collectAuditFields(v.Elem(), depth, name, ids, seen)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			collectAuditFields(v.Index(i), depth+1, name, ids, seen)
+		}
+	case reflect.Struct:
+		// A Name tag
+		keyField, valueField := v.FieldByName("Key"), v.FieldByName("Value")
+		if keyField.IsValid() && valueField.IsValid() && keyField.Kind() == reflect.Pointer && !keyField.IsNil() &&
+			keyField.Elem().Kind() == reflect.String && keyField.Elem().String() == "Name" &&
+			valueField.Kind() == reflect.Pointer && !valueField.IsNil() && valueField.Elem().Kind() == reflect.String {
+			*name = valueField.Elem().String()
+			return
+		}
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			f := v.Field(i)
+			if _, ok := auditedIdFields[t.Field(i).Name]; ok {
+				addAuditIds(f, ids, seen)
+				continue
+			}
+			collectAuditFields(f, depth+1, name, ids, seen)
+		}
+	}
+}
+
+func addAuditIds(v reflect.Value, ids *[]string, seen map[string]struct{}) {
+	add := func(id string) {
+		if _, ok := seen[id]; id != "" && !ok {
+			seen[id] = struct{}{}
+			*ids = append(*ids, id)
+		}
+	}
+	switch {
+	case v.Kind() == reflect.Pointer && !v.IsNil() && v.Elem().Kind() == reflect.String:
+		add(v.Elem().String())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < v.Len(); i++ {
+			add(v.Index(i).String())
+		}
+	}
+}
+
+func isMutatingOperation(operation string) bool {
+	return !strings.HasPrefix(operation, "Describe") && !strings.HasPrefix(operation, "Get") && !strings.HasPrefix(operation, "List")
+}
+
+// Sees each call once, before retries, so the duration includes throttling and backoff
+func newCallAuditMiddleware(auditFunc CallAuditFunc) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("CapideployCallAudit",
+		func(goCtx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			operation := awsmiddleware.GetOperationName(goCtx)
+			if !isMutatingOperation(operation) {
+				return next.HandleInitialize(goCtx, in)
+			}
+			startTime := time.Now()
+			out, metadata, err := next.HandleInitialize(goCtx, in)
+			duration := time.Since(startTime)
+
+			resourceName := ""
+			resourceIds := make([]string, 0)
+			seen := map[string]struct{}{}
+			collectAuditFields(reflect.ValueOf(in.Parameters), 0, &resourceName, &resourceIds, seen)
+			collectAuditFields(reflect.ValueOf(out.Result), 0, &resourceName, &resourceIds, seen)
+			auditFunc(audit.DeploymentName(goCtx), audit.Nickname(goCtx), awsmiddleware.GetServiceID(goCtx)+":"+operation, resourceName, resourceIds, duration, err)
+			return out, metadata, err
+		})
+}
+
+// All clients created from cfg after this call report their mutating calls to auditFunc
+func ConfigureCallAudit(cfg *aws.Config, auditFunc CallAuditFunc) {
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(newCallAuditMiddleware(auditFunc), middleware.After)
+	})
+}
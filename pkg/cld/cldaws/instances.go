@@ -107,6 +107,57 @@ func GetInstanceIdAndStateByHostName(ec2Client *ec2.Client, goCtx context.Contex
 	return instanceId, types.InstanceStateName(instanceStateName), nil
 }
 
+type InstanceAttributes struct {
+	Id                 string
+	State              types.InstanceStateName
+	InstanceType       string
+	PrivateIpAddress   string
+	SubnetId           string
+	SecurityGroupIds   []string
+	InstanceProfileArn string
+}
+
+// Returns nil if there is no non-terminated instance with this name
+func GetInstanceAttributesByHostName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instName string) (*InstanceAttributes, error) {
+	if instName == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: instName (%s)", instName)
+	}
+	out, err := ec2Client.DescribeInstances(goCtx, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+		{Name: aws.String("tag:Name"), Values: []string{instName}},
+		{Name: aws.String("instance-state-name"), Values: []string{
+			string(types.InstanceStateNamePending),
+			string(types.InstanceStateNameRunning),
+			string(types.InstanceStateNameStopping),
+			string(types.InstanceStateNameStopped)}}}})
+	lb.AddObject(fmt.Sprintf("DescribeInstances(tag:Name=%s)", instName), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe instance %s: %s", instName, err.Error())
+	}
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+		return nil, nil
+	}
+
+	inst := out.Reservations[0].Instances[0]
+	attrs := InstanceAttributes{
+		Id:               *inst.InstanceId,
+		State:            inst.State.Name,
+		InstanceType:     string(inst.InstanceType),
+		SecurityGroupIds: make([]string, 0, len(inst.SecurityGroups))}
+	if inst.PrivateIpAddress != nil {
+		attrs.PrivateIpAddress = *inst.PrivateIpAddress
+	}
+	if inst.SubnetId != nil {
+		attrs.SubnetId = *inst.SubnetId
+	}
+	for _, sg := range inst.SecurityGroups {
+		attrs.SecurityGroupIds = append(attrs.SecurityGroupIds, *sg.GroupId)
+	}
+	if inst.IamInstanceProfile != nil && inst.IamInstanceProfile.Arn != nil {
+		attrs.InstanceProfileArn = *inst.IamInstanceProfile.Arn
+	}
+	return &attrs, nil
+}
+
 func getInstanceStateName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string) (types.InstanceStateName, error) {
 	out, err := ec2Client.DescribeInstances(goCtx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}})
 	lb.AddObject(fmt.Sprintf("DescribeInstances(instanceId=%s)", instanceId), out)
@@ -201,7 +252,9 @@ func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[strin
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for %s(%s) to be created", instName, newId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return "", fmt.Errorf("cancelled while waiting for %s(%s) to be created: %s", instName, newId, err.Error())
+		}
 	}
 	return newId, nil
 }
@@ -250,7 +303,9 @@ func DeleteInstance(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuild
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for %s to be deleted", instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return fmt.Errorf("cancelled while waiting for %s to be deleted: %s", instanceId, err.Error())
+		}
 	}
 	return nil
 }
@@ -278,7 +333,9 @@ func StopInstance(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for instance %s to be stop", instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return fmt.Errorf("cancelled while waiting for instance %s to be stop: %s", instanceId, err.Error())
+		}
 	}
 	return nil
 }
@@ -313,7 +370,9 @@ func CreateImageFromInstance(ec2Client *ec2.Client, goCtx context.Context, tags
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for image %s(%s) to be created for %ds", imageName, imageId, timeoutSeconds)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return "", fmt.Errorf("cancelled while waiting for image %s(%s) to be created: %s", imageName, imageId, err.Error())
+		}
 	}
 	return imageId, nil
 }
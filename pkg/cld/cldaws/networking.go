@@ -24,6 +24,35 @@ func GetSubnetIdByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBu
 	return *out.Subnets[0].SubnetId, nil
 }
 
+type SubnetAttributes struct {
+	Id               string
+	VpcId            string
+	Cidr             string
+	AvailabilityZone string
+}
+
+// Returns nil if the subnet is not there
+func GetSubnetAttributesByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, subnetName string) (*SubnetAttributes, error) {
+	if subnetName == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: subnetName (%s)", subnetName)
+	}
+	out, err := ec2Client.DescribeSubnets(goCtx, &ec2.DescribeSubnetsInput{Filters: []types.Filter{{
+		Name: aws.String("tag:Name"), Values: []string{subnetName}}}})
+	lb.AddObject(fmt.Sprintf("DescribeSubnets(tag:Name=%s)", subnetName), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe subnet %s: %s", subnetName, err.Error())
+	}
+	if len(out.Subnets) == 0 {
+		return nil, nil
+	}
+	subnet := out.Subnets[0]
+	return &SubnetAttributes{
+		Id:               aws.ToString(subnet.SubnetId),
+		VpcId:            aws.ToString(subnet.VpcId),
+		Cidr:             aws.ToString(subnet.CidrBlock),
+		AvailabilityZone: aws.ToString(subnet.AvailabilityZone)}, nil
+}
+
 func CreateSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, vpcId string, subnetName string, cidr string, availabilityZone string) (string, error) {
 	if vpcId == "" || subnetName == "" || cidr == "" || availabilityZone == "" {
 		return "", fmt.Errorf("empty parameter not allowed: vpcId (%s), subnetName (%s), cidr (%s), availabilityZone (%s)", vpcId, subnetName, cidr, availabilityZone)
@@ -72,6 +101,23 @@ func GetVpcIdByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuild
 	return "", nil
 }
 
+// Returns empty id if the vpc is not there
+func GetVpcIdAndCidrByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, vpcName string) (string, string, error) {
+	if vpcName == "" {
+		return "", "", fmt.Errorf("empty parameter not allowed: vpcName (%s)", vpcName)
+	}
+	out, err := ec2Client.DescribeVpcs(goCtx, &ec2.DescribeVpcsInput{Filters: []types.Filter{{
+		Name: aws.String("tag:Name"), Values: []string{vpcName}}}})
+	lb.AddObject(fmt.Sprintf("DescribeVpcs(tag:Name=%s)", vpcName), out)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot describe vpc (network) %s: %s", vpcName, err.Error())
+	}
+	if len(out.Vpcs) == 0 {
+		return "", "", nil
+	}
+	return aws.ToString(out.Vpcs[0].VpcId), aws.ToString(out.Vpcs[0].CidrBlock), nil
+}
+
 func CreateVpc(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, vpcName string, cidrBlock string, timeoutSeconds int) (string, error) {
 	if vpcName == "" || cidrBlock == "" {
 		return "", fmt.Errorf("empty parameter not allowed: vpcName (%s), cidrBlock (%s)", vpcName, cidrBlock)
@@ -115,7 +161,9 @@ func CreateVpc(ec2Client *ec2.Client, goCtx context.Context, tags map[string]str
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for vpc (network) %s to be created after %ds", newVpcId, timeoutSeconds)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return "", fmt.Errorf("cancelled while waiting for vpc (network) %s to be created: %s", newVpcId, err.Error())
+		}
 	}
 
 	return newVpcId, nil
@@ -244,7 +292,9 @@ func CreateNatGateway(ec2Client *ec2.Client, goCtx context.Context, tags map[str
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for nat gateway %s to be created after %ds", natGatewayId, timeoutSeconds)
 		}
-		time.Sleep(3 * time.Second)
+		if err := sleepOrCancel(goCtx, 3*time.Second); err != nil {
+			return "", fmt.Errorf("cancelled while waiting for nat gateway %s to be created: %s", natGatewayId, err.Error())
+		}
 	}
 	return natGatewayId, nil
 }
@@ -283,7 +333,9 @@ func DeleteNatGateway(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBui
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for nat gateway %s to be deleted after %ds", natGatewayId, timeoutSeconds)
 		}
-		time.Sleep(3 * time.Second)
+		if err := sleepOrCancel(goCtx, 3*time.Second); err != nil {
+			return fmt.Errorf("cancelled while waiting for nat gateway %s to be deleted: %s", natGatewayId, err.Error())
+		}
 	}
 	return nil
 }
@@ -0,0 +1,61 @@
+package cldaws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// Placement groups are free and their names are unique per region, so creating one is an atomic test-and-set.
+// Returns false if a group with this name exists already.
+func CreatePlacementGroup(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, groupName string) (string, bool, error) {
+	out, err := ec2Client.CreatePlacementGroup(goCtx, &ec2.CreatePlacementGroupInput{
+		GroupName: aws.String(groupName),
+		Strategy:  types.PlacementStrategySpread,
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypePlacementGroup,
+			Tags:         mapToTags(groupName, tags)}}})
+	lb.AddObject(fmt.Sprintf("CreatePlacementGroup(groupName=%s)", groupName), out)
+	if err != nil {
+		if strings.Contains(err.Error(), "InvalidPlacementGroup.Duplicate") {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("cannot create placement group %s: %s", groupName, err.Error())
+	}
+	return *out.PlacementGroup.GroupId, true, nil
+}
+
+// Empty id if not found or being deleted
+func GetPlacementGroupByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, groupName string) (string, types.PlacementGroupState, map[string]string, error) {
+	out, err := ec2Client.DescribePlacementGroups(goCtx, &ec2.DescribePlacementGroupsInput{
+		Filters: []types.Filter{{Name: aws.String("group-name"), Values: []string{groupName}}}})
+	lb.AddObject(fmt.Sprintf("DescribePlacementGroups(group-name=%s)", groupName), out)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("cannot describe placement group %s: %s", groupName, err.Error())
+	}
+	for _, pg := range out.PlacementGroups {
+		if pg.State == types.PlacementGroupStateDeleted {
+			continue
+		}
+		tags := map[string]string{}
+		for _, tag := range pg.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+		return *pg.GroupId, pg.State, tags, nil
+	}
+	return "", "", nil, nil
+}
+
+func DeletePlacementGroup(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, groupName string) error {
+	out, err := ec2Client.DeletePlacementGroup(goCtx, &ec2.DeletePlacementGroupInput{GroupName: aws.String(groupName)})
+	lb.AddObject(fmt.Sprintf("DeletePlacementGroup(groupName=%s)", groupName), out)
+	if err != nil {
+		return fmt.Errorf("cannot delete placement group %s: %s", groupName, err.Error())
+	}
+	return nil
+}
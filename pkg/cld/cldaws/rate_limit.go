@@ -0,0 +1,118 @@
+package cldaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Never slow down below this, even if AWS keeps throttling us
+const minAwsCallsPerSecond float64 = 0.2
+
+// Shared by all AWS clients of a deployment, every API call attempt takes a token.
+// The rate is halved each time AWS throttles us, and slowly recovers to the configured maximum after successful calls.
+type AdaptiveTokenBucket struct {
+	mx         sync.Mutex
+	maxRate    float64
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func NewAdaptiveTokenBucket(ratePerSecond float64, burst int) *AdaptiveTokenBucket {
+	return &AdaptiveTokenBucket{
+		maxRate:    ratePerSecond,
+		rate:       ratePerSecond,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now()}
+}
+
+func (b *AdaptiveTokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.lastRefill).Seconds()*b.rate)
+	b.lastRefill = now
+}
+
+// Blocks until a token is available, returns error only if goCtx was cancelled while waiting
+func (b *AdaptiveTokenBucket) Wait(goCtx context.Context) error {
+	for {
+		b.mx.Lock()
+		b.refill(time.Now())
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mx.Unlock()
+			return nil
+		}
+		waitDuration := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mx.Unlock()
+		if err := sleepOrCancel(goCtx, waitDuration); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *AdaptiveTokenBucket) OnThrottle() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.refill(time.Now())
+	b.rate = max(minAwsCallsPerSecond, b.rate/2)
+	// Whatever burst we had saved up is what got us throttled
+	b.tokens = min(b.tokens, 1)
+}
+
+func (b *AdaptiveTokenBucket) OnSuccess() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.rate < b.maxRate {
+		b.refill(time.Now())
+		b.rate = min(b.maxRate, b.rate+b.maxRate/20)
+	}
+}
+
+func (b *AdaptiveTokenBucket) Rate() float64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.rate
+}
+
+var throttleErrorChecker = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+// Runs after the retry middleware, so each attempt, not just each call, goes through the bucket
+func newRateLimitMiddleware(bucket *AdaptiveTokenBucket) middleware.FinalizeMiddleware {
+	return middleware.FinalizeMiddlewareFunc("CapideployRateLimit",
+		func(goCtx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if err := bucket.Wait(goCtx); err != nil {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+			}
+			out, metadata, err := next.HandleFinalize(goCtx, in)
+			if err == nil {
+				bucket.OnSuccess()
+			} else if throttleErrorChecker.IsErrorThrottle(err) == aws.TrueTernary {
+				bucket.OnThrottle()
+			}
+			return out, metadata, err
+		})
+}
+
+// All clients created from cfg after this call share the bucket, and retry throttling (RequestLimitExceeded etc)
+// and transient errors with exponential backoff and jitter
+func ConfigureRateLimitAndRetry(cfg *aws.Config, bucket *AdaptiveTokenBucket, maxAttempts int, maxBackoff time.Duration) {
+	cfg.Retryer = func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = maxAttempts
+			o.MaxBackoff = maxBackoff
+			o.Backoff = retry.NewExponentialJitterBackoff(maxBackoff)
+			// Client-side limiting is done by our bucket, do not fail calls because SDK retry quota is exhausted
+			o.RateLimiter = ratelimit.None
+		})
+	}
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Insert(newRateLimitMiddleware(bucket), "Retry", middleware.After)
+	})
+}
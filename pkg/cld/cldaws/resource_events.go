@@ -0,0 +1,102 @@
+package cldaws
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Called after a successful call that created or deleted a resource of a type capideploy manages
+type ResourceChangeFunc func(isCreated bool, resourceType string, resourceName string, resourceId string)
+
+type resourceOperationDef struct {
+	isCreated    bool
+	resourceType string // Same as the types returned by GetResourcesByTag
+	idField      string // Output field for created resources, input field for deleted ones
+}
+
+var resourceOperations map[string]resourceOperationDef = map[string]resourceOperationDef{
+	"AllocateAddress":       {true, "elastic-ip", "AllocationId"},
+	"ReleaseAddress":        {false, "elastic-ip", "AllocationId"},
+	"CreateVpc":             {true, "vpc", "VpcId"},
+	"DeleteVpc":             {false, "vpc", "VpcId"},
+	"CreateSubnet":          {true, "subnet", "SubnetId"},
+	"DeleteSubnet":          {false, "subnet", "SubnetId"},
+	"CreateInternetGateway": {true, "internet-gateway", "InternetGatewayId"},
+	"DeleteInternetGateway": {false, "internet-gateway", "InternetGatewayId"},
+	"CreateNatGateway":      {true, "natgateway", "NatGatewayId"},
+	"DeleteNatGateway":      {false, "natgateway", "NatGatewayId"},
+	"CreateRouteTable":      {true, "route-table", "RouteTableId"},
+	"DeleteRouteTable":      {false, "route-table", "RouteTableId"},
+	"CreateSecurityGroup":   {true, "security-group", "GroupId"},
+	"DeleteSecurityGroup":   {false, "security-group", "GroupId"},
+	"CreateVolume":          {true, "volume", "VolumeId"},
+	"DeleteVolume":          {false, "volume", "VolumeId"},
+	"RunInstances":          {true, "instance", "InstanceId"},
+	"TerminateInstances":    {false, "instance", "InstanceIds"},
+	"CreateImage":           {true, "image", "ImageId"},
+	"DeregisterImage":       {false, "image", "ImageId"},
+	"DeleteSnapshot":        {false, "snapshot", "SnapshotId"}}
+
+func collectFieldValues(v reflect.Value, fieldName string, depth int, ids *[]string, seen map[string]struct{}) {
+	if depth > auditMaxDepth || !v.IsValid() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			collectFieldValues(v.Elem(), fieldName, depth, ids, seen)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			collectFieldValues(v.Index(i), fieldName, depth+1, ids, seen)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if t.Field(i).Name == fieldName {
+				addAuditIds(v.Field(i), ids, seen)
+				continue
+			}
+			collectFieldValues(v.Field(i), fieldName, depth+1, ids, seen)
+		}
+	}
+}
+
+func newResourceEventsMiddleware(changeFunc ResourceChangeFunc) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("CapideployResourceEvents",
+		func(goCtx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleInitialize(goCtx, in)
+			opDef, ok := resourceOperations[awsmiddleware.GetOperationName(goCtx)]
+			if err != nil || !ok || !strings.EqualFold(awsmiddleware.GetServiceID(goCtx), "EC2") {
+				return out, metadata, err
+			}
+
+			resourceName := ""
+			collectAuditFields(reflect.ValueOf(in.Parameters), 0, &resourceName, &[]string{}, map[string]struct{}{})
+			resourceIds := make([]string, 0)
+			if opDef.isCreated {
+				collectFieldValues(reflect.ValueOf(out.Result), opDef.idField, 0, &resourceIds, map[string]struct{}{})
+			} else {
+				collectFieldValues(reflect.ValueOf(in.Parameters), opDef.idField, 0, &resourceIds, map[string]struct{}{})
+			}
+			for _, resourceId := range resourceIds {
+				changeFunc(opDef.isCreated, opDef.resourceType, resourceName, resourceId)
+			}
+			return out, metadata, err
+		})
+}
+
+// All clients created from cfg after this call report resources they create and delete to changeFunc
+func ConfigureResourceEvents(cfg *aws.Config, changeFunc ResourceChangeFunc) {
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(newResourceEventsMiddleware(changeFunc), middleware.After)
+	})
+}
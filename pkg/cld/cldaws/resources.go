@@ -125,6 +125,7 @@ func getResourceState(ec2Client *ec2.Client, goCtx context.Context, r *cld.Resou
 			if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
 				return "notfound", cld.ResourceBilledStateTerminated, nil
 			}
+			r.Flavor = string(out.Reservations[0].Instances[0].InstanceType)
 			return string(out.Reservations[0].Instances[0].State.Name), getInstanceBilledState(out.Reservations[0].Instances[0].State.Name), nil
 		case "volume":
 			out, err := ec2Client.DescribeVolumes(goCtx, &ec2.DescribeVolumesInput{VolumeIds: []string{r.Id}})
@@ -134,6 +135,8 @@ func getResourceState(ec2Client *ec2.Client, goCtx context.Context, r *cld.Resou
 				}
 				return "", "", err
 			}
+			r.Flavor = string(out.Volumes[0].VolumeType)
+			r.SizeGb = int(aws.ToInt32(out.Volumes[0].Size))
 			return string(out.Volumes[0].State), getVolumeBilledState(out.Volumes[0].State), nil
 		case "natgateway":
 			out, err := ec2Client.DescribeNatGateways(goCtx, &ec2.DescribeNatGatewaysInput{NatGatewayIds: []string{r.Id}})
@@ -171,6 +174,7 @@ func getResourceState(ec2Client *ec2.Client, goCtx context.Context, r *cld.Resou
 				}
 				return "", "", err
 			}
+			r.SizeGb = int(aws.ToInt32(out.Snapshots[0].VolumeSize))
 			return string(out.Snapshots[0].State), getSnapshotBilledState(out.Snapshots[0].State), nil
 		default:
 			return "", "", fmt.Errorf("unsupported ec2 type %s", r.Type)
@@ -180,22 +184,26 @@ func getResourceState(ec2Client *ec2.Client, goCtx context.Context, r *cld.Resou
 	}
 }
 
-func getResourceDeploymentNameAndNameTags(ec2Client *ec2.Client, goCtx context.Context, resourceId string) (string, string, error) {
+// Deployment name, resource name and expiry tags
+func getResourceDeploymentTags(ec2Client *ec2.Client, goCtx context.Context, resourceId string) (string, string, string, error) {
 	out, err := ec2Client.DescribeTags(goCtx, &ec2.DescribeTagsInput{Filters: []types.Filter{{
 		Name: aws.String("resource-id"), Values: []string{resourceId}}}})
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	deploymentNameTagValue := ""
 	resourceNameTagValue := ""
+	expiresTagValue := ""
 	for _, tagDesc := range out.Tags {
 		if *tagDesc.Key == "Name" {
 			resourceNameTagValue = *tagDesc.Value
 		} else if *tagDesc.Key == cld.DeploymentNameTagName {
 			deploymentNameTagValue = *tagDesc.Value
+		} else if *tagDesc.Key == cld.DeploymentExpiresTagName {
+			expiresTagValue = *tagDesc.Value
 		}
 	}
-	return deploymentNameTagValue, resourceNameTagValue, nil
+	return deploymentNameTagValue, resourceNameTagValue, expiresTagValue, nil
 }
 
 func GetResourcesByTag(tClient *tagging.Client, ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, region string, tagFilters []taggingTypes.TagFilter, readState bool) ([]*cld.Resource, error) {
@@ -221,12 +229,13 @@ func GetResourcesByTag(tClient *tagging.Client, ec2Client *ec2.Client, goCtx con
 					res.BilledState = billedState
 				}
 			}
-			deploymentName, resourceName, err := getResourceDeploymentNameAndNameTags(ec2Client, goCtx, res.Id)
+			deploymentName, resourceName, expiresAt, err := getResourceDeploymentTags(ec2Client, goCtx, res.Id)
 			if err != nil {
 				lb.Add(err.Error())
 			} else {
 				res.DeploymentName = deploymentName
 				res.Name = resourceName
+				res.ExpiresAt = expiresAt
 			}
 			resources = append(resources, &res)
 		}
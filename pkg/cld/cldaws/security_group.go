@@ -23,6 +23,49 @@ func GetSecurityGroupIdByName(ec2Client *ec2.Client, goCtx context.Context, lb *
 	return "", nil
 }
 
+type SecurityGroupIngressRule struct {
+	Protocol string
+	Port     int32
+	Cidr     string
+}
+
+func (r *SecurityGroupIngressRule) String() string {
+	return fmt.Sprintf("%s:%d:%s", r.Protocol, r.Port, r.Cidr)
+}
+
+// Flattens ingress permissions into one rule per protocol/port/cidr
+func GetSecurityGroupIngressRulesById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, securityGroupId string) ([]SecurityGroupIngressRule, error) {
+	if securityGroupId == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: securityGroupId (%s)", securityGroupId)
+	}
+	out, err := ec2Client.DescribeSecurityGroups(goCtx, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{securityGroupId}})
+	lb.AddObject(fmt.Sprintf("DescribeSecurityGroups(GroupIds=%s)", securityGroupId), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe security group %s: %s", securityGroupId, err.Error())
+	}
+	if len(out.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("cannot describe security group %s: zero security groups returned", securityGroupId)
+	}
+
+	rules := make([]SecurityGroupIngressRule, 0)
+	for _, perm := range out.SecurityGroups[0].IpPermissions {
+		var protocol string
+		if perm.IpProtocol != nil {
+			protocol = *perm.IpProtocol
+		}
+		var port int32
+		if perm.FromPort != nil {
+			port = *perm.FromPort
+		}
+		for _, ipRange := range perm.IpRanges {
+			if ipRange.CidrIp != nil {
+				rules = append(rules, SecurityGroupIngressRule{Protocol: protocol, Port: port, Cidr: *ipRange.CidrIp})
+			}
+		}
+	}
+	return rules, nil
+}
+
 func CreateSecurityGroup(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, securityGroupName string, vpcId string) (string, error) {
 	if securityGroupName == "" || vpcId == "" {
 		return "", fmt.Errorf("empty parameter not allowed: securityGroupName (%s), vpcId (%s)", securityGroupName, vpcId)
@@ -3,6 +3,7 @@ package cldaws
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -35,3 +36,13 @@ func mapToTags(tagName string, tagMap map[string]string) []types.Tag {
 	}
 	return result
 }
+
+// Pause between polls in wait loops, returns early if the operation was cancelled (Ctrl-C)
+func sleepOrCancel(goCtx context.Context, d time.Duration) error {
+	select {
+	case <-goCtx.Done():
+		return goCtx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
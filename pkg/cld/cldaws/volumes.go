@@ -90,6 +90,38 @@ func GetVolumeIdByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBu
 	return *out.Volumes[0].VolumeId, nil
 }
 
+type VolumeAttributes struct {
+	Id               string
+	Size             int32
+	Type             string
+	AvailabilityZone string
+}
+
+// Returns nil if the volume is not there
+func GetVolumeAttributesByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volName string) (*VolumeAttributes, error) {
+	if volName == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: volName (%s)", volName)
+	}
+	out, err := ec2Client.DescribeVolumes(goCtx, &ec2.DescribeVolumesInput{
+		Filters: []types.Filter{{Name: aws.String("tag:Name"), Values: []string{volName}}}})
+	lb.AddObject(fmt.Sprintf("DescribeVolumes(tag:Name=%s)", volName), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe volume %s: %s", volName, err.Error())
+	}
+	if len(out.Volumes) == 0 {
+		return nil, nil
+	}
+	vol := out.Volumes[0]
+	attrs := VolumeAttributes{Id: *vol.VolumeId, Type: string(vol.VolumeType)}
+	if vol.Size != nil {
+		attrs.Size = *vol.Size
+	}
+	if vol.AvailabilityZone != nil {
+		attrs.AvailabilityZone = *vol.AvailabilityZone
+	}
+	return &attrs, nil
+}
+
 func GetVolumeAttachedDeviceById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volId string) (string, types.VolumeAttachmentState, error) {
 	if volId == "" {
 		return "", types.VolumeAttachmentStateDetached, fmt.Errorf("empty parameter not allowed: volId (%s)", volId)
@@ -172,7 +204,9 @@ func AttachVolume(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for volume %s to attach to instance %s as device %s", volId, instanceId, suggestedDevice)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return "", fmt.Errorf("cancelled while waiting for volume %s to attach to instance %s as device %s: %s", volId, instanceId, suggestedDevice, err.Error())
+		}
 	}
 
 	return newDevice, nil
@@ -206,7 +240,9 @@ func DetachVolume(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for volume %s to detach from instance %s", volId, instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := sleepOrCancel(goCtx, 1*time.Second); err != nil {
+			return fmt.Errorf("cancelled while waiting for volume %s to detach from instance %s: %s", volId, instanceId, err.Error())
+		}
 	}
 	return nil
 }
@@ -0,0 +1,240 @@
+package cld
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	OutputFormatText  string = "text" // Legacy comma-separated lines followed by a totals line
+	OutputFormatJson  string = "json"
+	OutputFormatCsv   string = "csv"
+	OutputFormatTable string = "table"
+)
+
+func IsMachineReadableOutputFormat(format string) bool {
+	return format == OutputFormatJson || format == OutputFormatCsv
+}
+
+func ValidateOutputFormat(format string) error {
+	switch format {
+	case OutputFormatText, OutputFormatJson, OutputFormatCsv, OutputFormatTable:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %s, expected %s, %s, %s or %s", format, OutputFormatText, OutputFormatJson, OutputFormatCsv, OutputFormatTable)
+	}
+}
+
+// Empty fields match everything
+type ResourceFilter struct {
+	DeploymentName string
+	Svc            string
+	Type           string
+	BilledState    ResourceBilledState
+}
+
+func (f *ResourceFilter) Validate() error {
+	switch f.BilledState {
+	case "", ResourceBilledStateUnknown, ResourceBilledStateActive, ResourceBilledStateTerminated:
+		return nil
+	default:
+		return fmt.Errorf("unknown billed state %s, expected %s, %s or %s", f.BilledState, ResourceBilledStateActive, ResourceBilledStateTerminated, ResourceBilledStateUnknown)
+	}
+}
+
+func (f *ResourceFilter) Match(r *Resource) bool {
+	return (f.DeploymentName == "" || f.DeploymentName == r.DeploymentName) &&
+		(f.Svc == "" || f.Svc == r.Svc) &&
+		(f.Type == "" || f.Type == r.Type) &&
+		(f.BilledState == "" || f.BilledState == r.BilledState)
+}
+
+func FilterResources(resources []*Resource, filter *ResourceFilter) []*Resource {
+	filtered := make([]*Resource, 0, len(resources))
+	for _, res := range resources {
+		if filter.Match(res) {
+			filtered = append(filtered, res)
+		}
+	}
+	return filtered
+}
+
+func CountBilledResources(resources []*Resource) int {
+	billedResources := 0
+	for _, res := range resources {
+		if res.BilledState == ResourceBilledStateActive {
+			billedResources++
+		}
+	}
+	return billedResources
+}
+
+type DeploymentSummary struct {
+	DeploymentName  string `json:"deployment_name"`
+	Resources       int    `json:"resources"`
+	BilledResources int    `json:"billed_resources"`
+	ExpiresAt       string `json:"expires_at"` // Latest DeploymentExpires tag of its resources, empty if it never expires
+}
+
+// Resources created later (scale, restore) carry a later expiry, so the latest one wins
+func (s *DeploymentSummary) IsExpired(now time.Time) bool {
+	if s.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, s.ExpiresAt)
+	if err != nil {
+		// Someone edited the tag by hand, do not guess
+		return false
+	}
+	return now.After(expiresAt)
+}
+
+func SummarizeDeployments(resources []*Resource) []*DeploymentSummary {
+	summaryMap := map[string]*DeploymentSummary{}
+	for _, res := range resources {
+		summary, ok := summaryMap[res.DeploymentName]
+		if !ok {
+			summary = &DeploymentSummary{DeploymentName: res.DeploymentName}
+			summaryMap[res.DeploymentName] = summary
+		}
+		summary.Resources++
+		if res.BilledState == ResourceBilledStateActive {
+			summary.BilledResources++
+		}
+		if res.ExpiresAt > summary.ExpiresAt {
+			summary.ExpiresAt = res.ExpiresAt
+		}
+	}
+	summaries := make([]*DeploymentSummary, 0, len(summaryMap))
+	for _, summary := range summaryMap {
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].DeploymentName < summaries[j].DeploymentName })
+	return summaries
+}
+
+func FormatResources(resources []*Resource, format string) (string, error) {
+	if format == OutputFormatText {
+		sb := strings.Builder{}
+		for _, res := range resources {
+			sb.WriteString(fmt.Sprintf("%s\n", res.String()))
+		}
+		sb.WriteString(fmt.Sprintf("Resources: %d, billed %d", len(resources), CountBilledResources(resources)))
+		return sb.String(), nil
+	}
+	return FormatRecords(resources, format)
+}
+
+// A DeploymentSummary without billed resources, for when resource state was not looked up
+type deploymentResourceCount struct {
+	DeploymentName string `json:"deployment_name"`
+	Resources      int    `json:"resources"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+// Billed counts are shown only if resource state was looked up, zero would be misleading otherwise
+func FormatDeploymentSummaries(summaries []*DeploymentSummary, format string, isStateKnown bool) (string, error) {
+	if !isStateKnown {
+		if format == OutputFormatText {
+			sb := strings.Builder{}
+			totalResources := 0
+			for _, summary := range summaries {
+				sb.WriteString(fmt.Sprintf("%s,%d\n", summary.DeploymentName, summary.Resources))
+				totalResources += summary.Resources
+			}
+			sb.WriteString(fmt.Sprintf("Deployments: %d, resources %d", len(summaries), totalResources))
+			return sb.String(), nil
+		}
+		counts := make([]*deploymentResourceCount, len(summaries))
+		for i, summary := range summaries {
+			counts[i] = &deploymentResourceCount{summary.DeploymentName, summary.Resources, summary.ExpiresAt}
+		}
+		return FormatRecords(counts, format)
+	}
+	if format == OutputFormatText {
+		sb := strings.Builder{}
+		totalResources := 0
+		totalBilledResources := 0
+		for _, summary := range summaries {
+			sb.WriteString(fmt.Sprintf("%s,%d,%d\n", summary.DeploymentName, summary.Resources, summary.BilledResources))
+			totalResources += summary.Resources
+			totalBilledResources += summary.BilledResources
+		}
+		sb.WriteString(fmt.Sprintf("Deployments: %d, resources %d, billed %d", len(summaries), totalResources, totalBilledResources))
+		return sb.String(), nil
+	}
+	return FormatRecords(summaries, format)
+}
+
+// Column names and values come from the json tags of the record struct,
+// so json, csv and table outputs always agree on field names
+func recordColumns(recordType reflect.Type) []string {
+	columns := make([]string, recordType.NumField())
+	for i := range columns {
+		columns[i] = strings.Split(recordType.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return columns
+}
+
+func recordValues(record reflect.Value) []string {
+	values := make([]string, record.NumField())
+	for i := range values {
+		values[i] = fmt.Sprintf("%v", record.Field(i).Interface())
+	}
+	return values
+}
+
+// Json, csv or table, text format is up to the caller
+func FormatRecords[T any](records []*T, format string) (string, error) {
+	switch format {
+	case OutputFormatJson:
+		recordsBytes, err := json.MarshalIndent(records, "", "    ")
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal %T: %s", records, err.Error())
+		}
+		return string(recordsBytes), nil
+
+	case OutputFormatCsv:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(recordColumns(reflect.TypeFor[T]())); err != nil {
+			return "", fmt.Errorf("cannot write csv header: %s", err.Error())
+		}
+		for _, record := range records {
+			if err := w.Write(recordValues(reflect.ValueOf(record).Elem())); err != nil {
+				return "", fmt.Errorf("cannot write csv record: %s", err.Error())
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", fmt.Errorf("cannot write csv: %s", err.Error())
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+
+	case OutputFormatTable:
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		columns := recordColumns(reflect.TypeFor[T]())
+		for i := range columns {
+			columns[i] = strings.ToUpper(columns[i])
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+		for _, record := range records {
+			fmt.Fprintln(w, strings.Join(recordValues(reflect.ValueOf(record).Elem()), "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return "", fmt.Errorf("cannot write table: %s", err.Error())
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+
+	default:
+		return "", ValidateOutputFormat(format)
+	}
+}
@@ -1,6 +1,9 @@
 package cld
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type ResourceBilledState string
 
@@ -13,6 +16,12 @@ const (
 const DeploymentNameTagName string = "DeploymentName"
 const DeploymentOperatorTagName string = "DeploymentOperator"
 const DeploymentOperatorTagValue string = "capideploy"
+const DeploymentExpiresTagName string = "DeploymentExpires" // Only on resources created with deployment_ttl set
+
+// Expiry tag value: UTC, RFC3339, so values compare as strings
+func FormatExpiry(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
 
 type Resource struct {
 	DeploymentName string              `json:"deployment_name"`
@@ -22,6 +31,10 @@ type Resource struct {
 	Name           string              `json:"name"`
 	State          string              `json:"state"`
 	BilledState    ResourceBilledState `json:"billed_state"`
+	Flavor         string              `json:"flavor"`      // Instance type or volume type, if known
+	SizeGb         int                 `json:"size_gb"`     // Volume or snapshot size, if known
+	HourlyCost     float64             `json:"hourly_cost"` // Populated only when resources are priced
+	ExpiresAt      string              `json:"expires_at"`  // DeploymentExpires tag, empty if none
 }
 
 func (r *Resource) String() string {
@@ -2,15 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/capillariesio/capillaries-deploy/pkg/audit"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/cost"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 	"github.com/capillariesio/capillaries-deploy/pkg/provider"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+	"github.com/capillariesio/capillaries-deploy/pkg/server"
 )
 
 func usage(flagset *flag.FlagSet) {
@@ -18,15 +29,26 @@ func usage(flagset *flag.FlagSet) {
 Capillaries deploy
 Usage: capideploy <command> [command parameters] [optional parameters]
 
+Add -plan to any create/delete/service command to see what it would do without running it.
+Add -resume to a failed combined command or workflow to continue from its <deployment>.<command>.<nicknames>.checkpoint.json file next to the project file.
+
 Commands:
   %s -p <jsonnet project file>
   %s -p <jsonnet project file>
   %s -p <jsonnet project file>
   %s -p <jsonnet project file>
   %s -p <jsonnet project file>
+  %s <workflow name, from the project 'workflows' section or one of the above> -p <jsonnet project file>
 
-  %s -p <jsonnet project file>
-  %s -p <jsonnet project file>
+  %s -p <jsonnet project file> [-o text|json|csv|table] [-deployment <name>] [-svc <svc>] [-type <type>] [-billed active|terminated|unknown] [-billed-exit]
+  %s -p <jsonnet project file> [-o text|json|csv|table] [-svc <svc>] [-type <type>] [-billed active|terminated|unknown] [-billed-exit] [-cost [-prices <price table json>]]
+  (list commands with -billed-exit exit with code 2 if listed resources include billed ones; list_deployments shows billed counts only with -billed, -billed-exit or -cost)
+  %s -p <jsonnet project file> [-o text|json|csv|table] [-prices <price table json, default is the one shipped with capideploy>] (no cloud calls)
+  %s -p <jsonnet project file> [-o text|json|csv|table] [-delete] (lists deployments past their DeploymentExpires tag, exit code 2 if any; -delete deletes them by tag)
+  %s <deployment name> -plan | -confirm <deployment name again> (deletes everything tagged with this deployment name, no project file or CAPIDEPLOY_* variables needed)
+  %s <deployment name> (removes the deployment lock left by a crashed or interrupted capideploy, no project file needed)
+  %s -p <jsonnet project file> | -audit <audit journal file> [-head <hash kept from an earlier run>] (checks the hash chain of the audit journal, no cloud calls, exit code 1 if broken)
+  %s [-listen <address, default 127.0.0.1:8080>] [-jobs <job store dir, default capideploy_jobs>] [-p <default jsonnet project file>] [-projects <dir>] [-allow-env <CAPIDEPLOY_* vars>] (HTTP/JSON API running commands as jobs, needs CAPIDEPLOY_SERVE_TOKEN unless on loopback)
 
   %s -p <jsonnet project file>
   %s -p <jsonnet project file>
@@ -46,20 +68,45 @@ Commands:
   %s <comma-separated list of instances to config services on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to start services on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to stop services on, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to upload files to, or *> -p <jsonnet project file> -src <local file or dir> -dst <remote file or dir> [-perm <permissions, like 644>] [-owner <remote owner>]
+  %s <comma-separated list of instances to download files from, or *> -p <jsonnet project file> -src <remote file or dir> -dst <local dir, each instance gets a subdir>
   %s <comma-separated list of instances to create snapshot images for, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to create from snapshot images, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to delete snapshot images for, or *> -p <jsonnet project file>
 
   %s -p <jsonnet project file>
+  %s -p <jsonnet project file> (prints json drift report, exit code 2 if drift found)
+  %s <comma-separated list of new cassandra instances> -p <jsonnet project file> (waits until they are UN in nodetool status)
+
+  %s cassandra|daemon -p <jsonnet project file> (creates project instances of this purpose missing in the cloud, brings them into service, reconfigures dependents)
+  %s <comma-separated list of instances, or *> -p <jsonnet project file> [-batch <instances at a time, default 1>] (stop, start, wait until ready, batch by batch)
+  %s <comma-separated list of instances, or *> -p <jsonnet project file> [-batch <instances at a time, default 1>] (stop, config, start, wait until ready, batch by batch)
+  %s <comma-separated list of instances, or *> -p <jsonnet project file> (waits until instances pass their readiness check)
+  %s <comma-separated list of instances, or *> -p <jsonnet project file> -url <release url> | -rollback [-batch <instances at a time, default 1>] (reinstalls daemon, webapi, toolbelt and ui, batch by batch)
+  %s <comma-separated list of instances, or *> -p <jsonnet project file> [-url <release url, default from project>] | [-rollback] (same for all selected instances at once)
+
+  %s <instance nickname> -p <jsonnet project file> [-- <remote command>] (interactive session via bastion, exits with remote exit status)
+  %s <comma-separated list of instances to run the command on, or *> -p <jsonnet project file> -c <shell command> (prints output per instance and a summary grouping identical outputs)
+  %s <comma-separated list of forwards> -p <jsonnet project file> (runs until Ctrl-C, reconnects if the bastion connection drops)
+     forwards: prometheus, rabbitmq, cassandra, webapi, <instance>:<remote port>, <local port>:<instance>:<remote port>, socks[:<local port, default 1080>]
+  %s -p <jsonnet project file> [-dst <output dir, default current dir>] (writes <deployment>.ssh_config, .hosts, .inventory.yml and .inventory.ini)
+  %s <comma-separated list of instances to check, or *> -p <jsonnet project file> [-wait <seconds to wait until healthy, default 0>] [-o text|json|csv|table]
 `,
 		provider.CmdDeploymentCreate,
 		provider.CmdDeploymentCreateImages,
 		provider.CmdDeploymentRestoreInstances,
 		provider.CmdDeploymentDeleteImages,
 		provider.CmdDeploymentDelete,
+		provider.CmdRunWorkflow,
 
 		provider.CmdListDeployments,
 		provider.CmdListDeploymentResources,
+		provider.CmdEstimateCost,
+		provider.CmdReapExpired,
+		provider.CmdDestroyByTag,
+		provider.CmdForceUnlock,
+		provider.CmdVerifyAudit,
+		provider.CmdServe,
 
 		provider.CmdCreateFloatingIps,
 		provider.CmdDeleteFloatingIps,
@@ -81,12 +128,29 @@ Commands:
 		provider.CmdConfigServices,
 		provider.CmdStartServices,
 		provider.CmdStopServices,
+		provider.CmdUploadFiles,
+		provider.CmdDownloadFiles,
 
 		provider.CmdCreateSnapshotImages,
 		provider.CmdCreateInstancesFromSnapshotImages,
 		provider.CmdDeleteSnapshotImages,
 
 		provider.CmdCheckCassStatus,
+		provider.CmdCheckDrift,
+		provider.CmdWaitCassNodesJoined,
+
+		provider.CmdScale,
+		provider.CmdRollingRestart,
+		provider.CmdRollingConfig,
+		provider.CmdWaitServicesReady,
+		provider.CmdUpgradeCapillaries,
+		provider.CmdReinstallCapillaries,
+
+		provider.CmdSsh,
+		provider.CmdExec,
+		provider.CmdTunnel,
+		provider.CmdExportInventory,
+		provider.CmdHealth,
 	)
 	if flagset != nil {
 		fmt.Printf("\nParameters:\n")
@@ -94,6 +158,75 @@ Commands:
 	}
 }
 
+func formatPlan(planItems []*provider.PlanItem) string {
+	sb := strings.Builder{}
+	actionCount := map[provider.PlanAction]int{}
+	for _, planItem := range planItems {
+		sb.WriteString(fmt.Sprintf("%s\n", planItem.String()))
+		actionCount[planItem.Action]++
+	}
+	sb.WriteString(fmt.Sprintf("Plan: %d to create, %d to delete, %d to skip, %d to run, %d to fail",
+		actionCount[provider.PlanActionCreate],
+		actionCount[provider.PlanActionDelete],
+		actionCount[provider.PlanActionSkip],
+		actionCount[provider.PlanActionRun],
+		actionCount[provider.PlanActionFail]))
+	return sb.String()
+}
+
+func isLoopbackListenAddr(listenAddr string) bool {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Runs until Ctrl-C/SIGTERM, then cancels running jobs and waits for them to release their locks
+func serve(listenAddr string, jobsDir string, opts *server.Options) error {
+	// Anyone who can reach the API can run jobs with the cloud credentials of the server
+	if opts.Token == "" && !isLoopbackListenAddr(listenAddr) {
+		return fmt.Errorf("cannot serve on %s without authentication, set CAPIDEPLOY_SERVE_TOKEN or listen on a loopback address", listenAddr)
+	}
+	store, err := server.OpenStore(jobsDir)
+	if err != nil {
+		return err
+	}
+	goCtx, stopNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopNotify()
+	srv, err := server.NewServer(goCtx, store, opts)
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{Addr: listenAddr, Handler: srv.Handler()}
+	serveErrChan := make(chan error, 1)
+	go func() {
+		serveErrChan <- httpServer.ListenAndServe()
+	}()
+	fmt.Fprintf(os.Stdout, "serving on %s, jobs in %s\n", listenAddr, jobsDir)
+
+	var serveErr error
+	select {
+	case err := <-serveErrChan:
+		serveErr = fmt.Errorf("cannot serve on %s: %s", listenAddr, err.Error())
+	case <-goCtx.Done():
+		fmt.Fprintf(os.Stderr, "interrupted, waiting for running jobs to stop\n")
+	}
+	stopNotify()
+	srv.Wait()
+
+	// Event streams end with their jobs, so this does not wait long
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	httpServer.Shutdown(shutdownCtx)
+	return serveErr
+}
+
 func main() {
 	if len(os.Args) <= 1 {
 		usage(nil)
@@ -106,11 +239,39 @@ func main() {
 	argNumberOfRepetitions := commonArgs.Int("n", 50, "Number of repetitions")
 	argShowProjectDetails := commonArgs.Bool("s", false, "Show project details (may contain sensitive info)")
 	argIgnoreAttachedVolumes := commonArgs.Bool("i", false, "Ignore attached volumes on instance delete")
+	argSrcPath := commonArgs.String("src", "", "Source file or directory for upload/download")
+	argDstPath := commonArgs.String("dst", "", "Destination file or directory for upload/download")
+	argPermissions := commonArgs.String("perm", "", "Permissions for uploaded files in octal, like 644 (default: leave as is)")
+	argOwner := commonArgs.String("owner", "", "Owner for uploaded files, like ubuntu (default: leave as is)")
+	argResume := commonArgs.Bool("resume", false, "Resume a failed combined command or workflow from its checkpoint file, retrying only failed steps and instances")
+	argPlan := commonArgs.Bool("plan", false, "Do not run the command, just show what it would create, skip, delete or fail on")
+	argOutputFormat := commonArgs.String("o", cld.OutputFormatText, "Output format for list, health, reap_expired and estimate_cost commands: text, json, csv or table")
+	argFilterDeployment := commonArgs.String("deployment", "", "List only resources of this deployment")
+	argFilterSvc := commonArgs.String("svc", "", "List only resources of this service, like ec2")
+	argFilterType := commonArgs.String("type", "", "List only resources of this type, like instance or volume")
+	argFilterBilled := commonArgs.String("billed", "", "List only resources in this billed state: active, terminated or unknown")
+	argBilledExit := commonArgs.Bool("billed-exit", false, "List commands: exit with code 2 if listed resources include billed ones")
+	argShellCmd := commonArgs.String("c", "", "Shell command to run on instances with exec")
+	argReleaseUrl := commonArgs.String("url", "", "Capillaries release URL to upgrade to, overrides CAPILLARIES_RELEASE_URL from the project")
+	argRollback := commonArgs.Bool("rollback", false, "Roll back Capillaries to the release installed before the last upgrade")
+	argCost := commonArgs.Bool("cost", false, "Show hourly cost of billed resources with list_deployment_resources")
+	argPrices := commonArgs.String("prices", "", "Price table json file for estimate_cost and -cost (default: the one shipped with capideploy)")
+	argTtl := commonArgs.String("ttl", "", "Deployment TTL like 72h, overrides deployment_ttl from the project: created resources are tagged to expire after it")
+	argDelete := commonArgs.Bool("delete", false, "Make reap_expired delete expired deployments, not just list them")
+	argConfirm := commonArgs.String("confirm", "", "destroy_by_tag: the deployment name again, to confirm deleting everything tagged with it")
+	argWait := commonArgs.Int("wait", 0, "Seconds health waits for all checks to pass, 0 to check once")
+	argBatchSize := commonArgs.Int("batch", 1, "Number of instances rolling_restart and rolling_config process at a time")
+	argAuditLog := commonArgs.String("audit", "", "Audit journal file, overrides audit_log from the project; verify_audit checks it")
+	argAuditHead := commonArgs.String("head", "", "verify_audit: journal head hash kept from an earlier run, fails if records after it were cut off")
+	argListen := commonArgs.String("listen", "127.0.0.1:8080", "Address serve listens on")
+	argJobsDir := commonArgs.String("jobs", "capideploy_jobs", "Directory where serve keeps jobs, their events and results")
+	argProjectsDir := commonArgs.String("projects", "", "Directory with project files serve jobs can name in project_path (default: none, project_path is refused)")
+	argAllowEnv := commonArgs.String("allow-env", "", "Comma-separated CAPIDEPLOY_* variables of serve that project_jsonnet of a job may use")
 
 	cmd := os.Args[1]
 	nicknames := ""
 	parseFromArgIdx := 2
-	if provider.IsCmdRequiresNicknames(cmd) {
+	if provider.IsCmdRequiresPositionalArg(cmd) {
 		if len(os.Args) <= 2 {
 			usage(commonArgs)
 			os.Exit(1)
@@ -120,92 +281,291 @@ func main() {
 	}
 	parseErr := commonArgs.Parse(os.Args[parseFromArgIdx:])
 	if parseErr != nil {
-		log.Fatalf(parseErr.Error())
+		log.Fatalf("%s", parseErr.Error())
+	}
+
+	if err := cld.ValidateOutputFormat(*argOutputFormat); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	resourceFilter := &cld.ResourceFilter{
+		DeploymentName: *argFilterDeployment,
+		Svc:            *argFilterSvc,
+		Type:           *argFilterType,
+		BilledState:    cld.ResourceBilledState(*argFilterBilled)}
+	if err := resourceFilter.Validate(); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	// Jobs bring their own projects, -p is only the default for them
+	if cmd == provider.CmdServe {
+		allowedEnv := []string{}
+		if *argAllowEnv != "" {
+			allowedEnv = strings.Split(*argAllowEnv, ",")
+		}
+		if err := serve(*argListen, *argJobsDir, &server.Options{
+			DefaultPrjFile: *argPrjFile,
+			ProjectsDir:    *argProjectsDir,
+			AllowedEnv:     allowedEnv,
+			Token:          os.Getenv("CAPIDEPLOY_SERVE_TOKEN"),
+			IsVerbose:      *argVerbosity}); err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		os.Exit(0)
 	}
 
 	var project *prj.Project
 	var prjErr error
-	project, prjErr = prj.LoadProject(*argPrjFile)
-	if prjErr != nil {
-		log.Fatalf(prjErr.Error())
-	}
-
-	// Unbuffered channels: write immediately to stdout/stderr/file/whatever
-	cOut := make(chan string)
-	cErr := make(chan string)
-	cDone := make(chan int)
-	go func(cOut <-chan string, cErr <-chan string, cDone <-chan int) {
-		for {
-			select {
-			case strOut := <-cOut:
-				fmt.Fprintf(os.Stdout, "%s\n", strOut)
-			case strErr := <-cErr:
-				fmt.Fprintf(os.Stderr, "%s\n", strErr)
-			case <-cDone:
-				return
+	if cmd == provider.CmdDestroyByTag || cmd == provider.CmdForceUnlock {
+		// These must work without the project file and its env variables
+		project = prj.NewTagOnlyProject(nicknames, prj.DeployProviderAws)
+	} else if cmd == provider.CmdVerifyAudit && *argAuditLog != "" {
+		project = prj.NewTagOnlyProject("", prj.DeployProviderAws)
+		project.AuditKey = os.Getenv("CAPIDEPLOY_AUDIT_KEY")
+	} else {
+		project, prjErr = prj.LoadProject(*argPrjFile)
+		if prjErr != nil {
+			log.Fatalf("%s", prjErr.Error())
+		}
+	}
+
+	// Keep stdout clean for json/csv consumers: progress goes to stderr then
+	logOut := os.Stdout
+	if cld.IsMachineReadableOutputFormat(*argOutputFormat) {
+		logOut = os.Stderr
+	}
+
+	var prices *cost.PriceTable
+	if cmd == provider.CmdEstimateCost || *argCost {
+		var pricesErr error
+		prices, pricesErr = cost.LoadPriceTable(*argPrices)
+		if pricesErr != nil {
+			log.Fatalf("%s", pricesErr.Error())
+		}
+		// The shipped table must not price another region silently, a table passed explicitly gets a warning only
+		if regionErr := prices.CheckRegion(cost.ProjectRegion(project)); regionErr != nil {
+			if *argPrices == "" {
+				log.Fatalf("%s, pass -prices with a price table for that region", regionErr.Error())
 			}
+			fmt.Fprintf(os.Stderr, "%s\n", regionErr.Error())
+		}
+	}
+
+	// Project and price table only, no cloud credentials needed
+	if cmd == provider.CmdEstimateCost {
+		estimate := cost.EstimateProject(project, prices)
+		formatted, err := cost.FormatEstimate(estimate, *argOutputFormat)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", formatted)
+		if len(estimate.Unpriced) > 0 && cld.IsMachineReadableOutputFormat(*argOutputFormat) {
+			fmt.Fprintf(os.Stderr, "not in the price table, counted as 0: %s\n", strings.Join(estimate.Unpriced, ", "))
 		}
-	}(cOut, cErr, cDone)
+		os.Exit(0)
+	}
+
+	if *argAuditLog != "" {
+		project.AuditLog = *argAuditLog
+	}
+
+	// Local file only, no cloud credentials needed
+	if cmd == provider.CmdVerifyAudit {
+		if project.AuditLog == "" {
+			log.Fatalf("no audit journal to verify: set audit_log in the project or pass -audit")
+		}
+		count, lastHash, err := audit.VerifyJournal(project.AuditLog, []byte(project.AuditKey), *argAuditHead)
+		if err != nil {
+			log.Fatalf("audit journal %s is not intact after %d good records: %s", project.AuditLog, count, err.Error())
+		}
+		fmt.Fprintf(os.Stdout, "%s: %d records, chain intact, last hash %s\n", project.AuditLog, count, lastHash)
+		os.Exit(0)
+	}
+
+	// Logs and messages go to logOut, errors to stderr
+	events := event.NewTextSink(logOut, os.Stderr)
+
+	// Ctrl-C/SIGTERM cancels AWS calls, wait loops and ssh sessions; workers report what they completed.
+	// A second Ctrl-C kills the process right away.
+	goCtx, stopNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-goCtx.Done()
+		stopNotify()
+		fmt.Fprintf(os.Stderr, "interrupted, waiting for running operations to stop, press Ctrl-C again to exit immediately\n")
+	}()
+
+	if *argTtl != "" {
+		project.DeploymentTtl = *argTtl
+	}
 
-	deployProvider, deployProviderErr := provider.DeployProviderFactory(project, context.TODO(),
+	permissions, err := rexec.ParsePermissions(*argPermissions)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	deployProvider, deployProviderErr := provider.DeployProviderFactory(project, goCtx,
 		&provider.AssumeRoleConfig{
 			RoleArn:    os.Getenv("CAPIDEPLOY_AWS_ROLE_TO_ASSUME_ARN"),
 			ExternalId: os.Getenv("CAPIDEPLOY_AWS_ROLE_TO_ASSUME_EXTERNAL_ID")},
-		*argVerbosity, cOut, cErr)
+		*argVerbosity, events)
 	if deployProviderErr != nil {
-		cDone <- 0
-		log.Fatalf(deployProviderErr.Error())
+		log.Fatalf("%s", deployProviderErr.Error())
 	}
 
 	if len(os.Args) >= 3 {
 		nicknames = os.Args[2]
 	}
 
-	if nicknames == "" && provider.IsCmdRequiresNicknames(cmd) {
+	if nicknames == "" && (provider.IsCmdRequiresPositionalArg(cmd)) {
 		usage(commonArgs)
 		log.Fatalf("nicknames argument expected but missing")
 	}
 
 	var finalErr error
-	if cmd == provider.CmdListDeployments {
-		mapResourceCount, err := deployProvider.ListDeployments(cOut, cErr)
+	exitCode := 0
+	isBilledRemain := false
+	if cmd == provider.CmdListDeployments || cmd == provider.CmdListDeploymentResources {
+		isListStateNeeded := resourceFilter.BilledState != "" || *argBilledExit || prices != nil
+		var resources []*cld.Resource
+		var err error
+		if cmd == provider.CmdListDeployments {
+			// State lookups take a cloud call per resource, skip them unless something needs billed state
+			resources, err = deployProvider.ListDeployments(isListStateNeeded)
+		} else {
+			resources, err = deployProvider.ListDeploymentResources()
+		}
 		if err == nil {
-			sb := strings.Builder{}
-			totalDeployments := 0
-			totalResources := 0
-			for deploymentName, resCount := range mapResourceCount {
-				sb.WriteString(fmt.Sprintf("%s,%d\n", deploymentName, resCount))
-				totalDeployments++
-				totalResources += resCount
+			resources = cld.FilterResources(resources, resourceFilter)
+			isBilledRemain = *argBilledExit && cld.CountBilledResources(resources) > 0
+			unpriced := []string{}
+			if prices != nil {
+				unpriced = cost.PriceResources(resources, prices)
+			}
+			var formatted string
+			if cmd == provider.CmdListDeployments {
+				formatted, err = cld.FormatDeploymentSummaries(cld.SummarizeDeployments(resources), *argOutputFormat, isListStateNeeded)
+			} else {
+				formatted, err = cld.FormatResources(resources, *argOutputFormat)
+			}
+			if err != nil {
+				events.Emit(event.NewError(err))
+			} else if cld.IsMachineReadableOutputFormat(*argOutputFormat) {
+				fmt.Fprintf(os.Stdout, "%s\n", formatted)
+			} else {
+				events.Emit(event.NewMessage(formatted))
+			}
+			if prices != nil {
+				hourly := cost.TotalHourlyCost(resources)
+				events.Emit(event.NewMessage(fmt.Sprintf("Running cost: %.4f/hour, %.2f/month %s", hourly, hourly*cost.HoursPerMonth, prices.Currency)))
+				if len(unpriced) > 0 {
+					events.Emit(event.NewError(fmt.Errorf("not in the price table, counted as 0: %s", strings.Join(unpriced, ", "))))
+				}
+			}
+		}
+		finalErr = err
+	} else if cmd == provider.CmdReapExpired {
+		expired, err := deployProvider.ReapExpired(*argDelete)
+		if expired != nil {
+			formatted, formatErr := cld.FormatDeploymentSummaries(expired, *argOutputFormat, true)
+			if formatErr != nil {
+				events.Emit(event.NewError(formatErr))
+				err = formatErr
+			} else if cld.IsMachineReadableOutputFormat(*argOutputFormat) {
+				fmt.Fprintf(os.Stdout, "%s\n", formatted)
+			} else {
+				events.Emit(event.NewMessage(formatted))
 			}
-			sb.WriteString(fmt.Sprintf("Deployments: %d, resources %d", totalDeployments, totalResources))
-			cOut <- sb.String()
+			isBilledRemain = len(expired) > 0 && !*argDelete
 		}
 		finalErr = err
-	} else if cmd == provider.CmdListDeploymentResources {
-		resources, err := deployProvider.ListDeploymentResources(cOut, cErr)
+	} else if cmd == provider.CmdDestroyByTag {
+		planItems, err := deployProvider.DestroyByTag(nicknames, *argConfirm, *argPlan)
+		if err == nil && *argPlan {
+			events.Emit(event.NewMessage(formatPlan(planItems)))
+		}
+		finalErr = err
+	} else if cmd == provider.CmdForceUnlock {
+		finalErr = deployProvider.ForceUnlock(nicknames)
+	} else if cmd == provider.CmdSsh {
+		// Everything after -- goes to the remote side as is
+		exitStatus, err := deployProvider.Ssh(nicknames, strings.Join(commonArgs.Args(), " "))
 		if err == nil {
-			sb := strings.Builder{}
-			billedResources := 0
-			for _, res := range resources {
-				sb.WriteString(fmt.Sprintf("%s\n", res.String()))
-				if res.BilledState == cld.ResourceBilledStateActive {
-					billedResources++
-				}
+			exitCode = exitStatus
+		}
+		finalErr = err
+	} else if cmd == provider.CmdExec {
+		results, err := deployProvider.ExecOnInstances(nicknames, *argShellCmd)
+		if len(results) > 0 {
+			events.Emit(event.NewMessage(provider.FormatExecSummary(results)))
+		}
+		finalErr = err
+	} else if cmd == provider.CmdTunnel {
+		finalErr = deployProvider.Tunnel(nicknames)
+	} else if cmd == provider.CmdExportInventory {
+		finalErr = deployProvider.ExportInventory(*argDstPath)
+	} else if cmd == provider.CmdHealth {
+		results, err := deployProvider.Health(nicknames, *argWait)
+		if len(results) > 0 {
+			formatted, formatErr := provider.FormatHealthResults(results, *argOutputFormat)
+			if formatErr != nil {
+				events.Emit(event.NewError(formatErr))
+				err = formatErr
+			} else if cld.IsMachineReadableOutputFormat(*argOutputFormat) {
+				fmt.Fprintf(os.Stdout, "%s\n", formatted)
+			} else {
+				events.Emit(event.NewMessage(formatted))
+			}
+		}
+		finalErr = err
+	} else if cmd == provider.CmdCheckDrift {
+		report, err := deployProvider.CheckDrift()
+		if err == nil {
+			reportBytes, err := json.MarshalIndent(report, "", "    ")
+			if err != nil {
+				log.Fatalf("cannot marshal drift report: %s", err.Error())
+			}
+			events.Emit(event.NewMessage(string(reportBytes)))
+			if len(report.Items) > 0 {
+				exitCode = 2
 			}
-			sb.WriteString(fmt.Sprintf("Resources: %d, billed %d", len(resources), billedResources))
-			cOut <- sb.String()
 		}
 		finalErr = err
 	} else {
-		finalErr = deployProvider.ExecCmdWithNoResult(cmd, nicknames, &provider.ExecArgs{IgnoreAttachedVolumes: *argIgnoreAttachedVolumes, Verbosity: *argVerbosity, NumberOfRepetitions: *argNumberOfRepetitions, ShowProjectDetails: *argShowProjectDetails}, cOut, cErr)
+		execArgs := &provider.ExecArgs{
+			IgnoreAttachedVolumes: *argIgnoreAttachedVolumes,
+			Verbosity:             *argVerbosity,
+			NumberOfRepetitions:   *argNumberOfRepetitions,
+			ShowProjectDetails:    *argShowProjectDetails,
+			SrcPath:               *argSrcPath,
+			DstPath:               *argDstPath,
+			Permissions:           permissions,
+			Owner:                 *argOwner,
+			Resume:                *argResume,
+			BatchSize:             *argBatchSize,
+			ReleaseUrl:            *argReleaseUrl,
+			Rollback:              *argRollback}
+		if *argPlan {
+			planItems, err := deployProvider.PlanCmd(cmd, nicknames, execArgs)
+			if err == nil {
+				events.Emit(event.NewMessage(formatPlan(planItems)))
+			}
+			finalErr = err
+		} else {
+			finalErr = deployProvider.ExecCmdWithNoResult(cmd, nicknames, execArgs)
+		}
+	}
+	// Reports the audit journal head
+	if err := deployProvider.Close(); err != nil && finalErr == nil {
+		finalErr = err
 	}
-
-	cDone <- 0
-
 	if finalErr != nil {
 		os.Exit(1)
 	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+	if isBilledRemain {
+		os.Exit(2)
+	}
 	os.Exit(0)
 }
 
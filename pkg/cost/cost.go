@@ -0,0 +1,243 @@
+package cost
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+// AWS bills per hour, monthly numbers are for an average month
+const HoursPerMonth float64 = 730
+
+//go:embed prices/*
+var embeddedPricesFs embed.FS
+
+const DefaultPriceTableName string = "prices/aws_us-east-1.json"
+
+type PriceTable struct {
+	Provider          string             `json:"provider"`
+	Region            string             `json:"region"`
+	Currency          string             `json:"currency"`
+	EffectiveDate     string             `json:"effective_date"`
+	Note              string             `json:"note"`
+	InstanceHourly    map[string]float64 `json:"instance_hourly"`   // By instance type
+	VolumeGbMonthly   map[string]float64 `json:"volume_gb_monthly"` // By volume type
+	NatGatewayHourly  float64            `json:"nat_gateway_hourly"`
+	ElasticIpHourly   float64            `json:"elastic_ip_hourly"`
+	SnapshotGbMonthly float64            `json:"snapshot_gb_monthly"`
+	RootVolumeGb      int                `json:"root_volume_gb"`   // Instance root volume, created from the image
+	RootVolumeType    string             `json:"root_volume_type"` // Same
+}
+
+// Empty path means the price table shipped with capideploy
+func LoadPriceTable(path string) (*PriceTable, error) {
+	var priceBytes []byte
+	var err error
+	if path == "" {
+		path = DefaultPriceTableName
+		priceBytes, err = embeddedPricesFs.ReadFile(path)
+	} else {
+		priceBytes, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read price table %s: %s", path, err.Error())
+	}
+	var prices PriceTable
+	if err := json.Unmarshal(priceBytes, &prices); err != nil {
+		return nil, fmt.Errorf("cannot parse price table %s: %s", path, err.Error())
+	}
+	return &prices, nil
+}
+
+var awsRegionRegex = regexp.MustCompile(`^[a-z]+(-[a-z]+)+-[0-9]+`)
+
+// Region of the project subnet, like us-east-1 for availability zone us-east-1c. Empty if unknown.
+func ProjectRegion(project *prj.Project) string {
+	return awsRegionRegex.FindString(project.Network.PrivateSubnet.AvailabilityZone)
+}
+
+// Prices of one region are wrong for another
+func (prices *PriceTable) CheckRegion(region string) error {
+	if prices.Region == "" || region == "" || prices.Region == region {
+		return nil
+	}
+	return fmt.Errorf("price table is for %s, but the deployment is in %s", prices.Region, region)
+}
+
+// Sub-cent hourly prices need more digits than monthly ones
+func roundCost(v float64, digits int) float64 {
+	p := math.Pow10(digits)
+	return math.Round(v*p) / p
+}
+
+func (prices *PriceTable) volumeHourly(volumeType string, sizeGb int) (float64, bool) {
+	gbMonthly, ok := prices.VolumeGbMonthly[volumeType]
+	return gbMonthly * float64(sizeGb) / HoursPerMonth, ok
+}
+
+type CostPhase string
+
+const (
+	CostPhaseRunning CostPhase = "running" // Billed while instances exist
+	CostPhaseAlways  CostPhase = "always"  // Billed as long as the deployment exists, instances or not
+	CostPhaseStopped CostPhase = "stopped" // Billed only while instances are kept as snapshot images (deployment_create_images)
+)
+
+type CostItem struct {
+	Phase       CostPhase `json:"phase"`
+	Category    string    `json:"category"`
+	Name        string    `json:"name"`
+	Spec        string    `json:"spec"`
+	Priced      bool      `json:"priced"`
+	HourlyCost  float64   `json:"hourly_cost"`
+	MonthlyCost float64   `json:"monthly_cost"`
+}
+
+type Estimate struct {
+	Currency       string      `json:"currency"`
+	PriceTable     string      `json:"price_table"`
+	Items          []*CostItem `json:"items"`
+	RunningHourly  float64     `json:"running_hourly"`  // Deployment up: running and always items
+	RunningMonthly float64     `json:"running_monthly"` // Same
+	StoppedHourly  float64     `json:"stopped_hourly"`  // Instances replaced by snapshot images: stopped and always items
+	StoppedMonthly float64     `json:"stopped_monthly"` // Same
+	Unpriced       []string    `json:"unpriced"`        // Flavors and volume types missing in the price table
+}
+
+func (e *Estimate) add(phase CostPhase, category string, name string, spec string, hourly float64, priced bool) {
+	e.Items = append(e.Items, &CostItem{phase, category, name, spec, priced, roundCost(hourly, 6), roundCost(hourly*HoursPerMonth, 2)})
+	if !priced {
+		e.Unpriced = append(e.Unpriced, fmt.Sprintf("%s %s (%s)", category, spec, name))
+	}
+	if phase == CostPhaseRunning || phase == CostPhaseAlways {
+		e.RunningHourly += hourly
+	}
+	if phase == CostPhaseStopped || phase == CostPhaseAlways {
+		e.StoppedHourly += hourly
+	}
+	e.RunningMonthly = e.RunningHourly * HoursPerMonth
+	e.StoppedMonthly = e.StoppedHourly * HoursPerMonth
+}
+
+// Costs of what the project would create, per instance in nickname order, then networking. Items missing in the price table cost nothing and are listed in Unpriced.
+func EstimateProject(project *prj.Project, prices *PriceTable) *Estimate {
+	e := &Estimate{Currency: prices.Currency, PriceTable: fmt.Sprintf("%s %s %s", prices.Provider, prices.Region, prices.EffectiveDate), Items: make([]*CostItem, 0), Unpriced: make([]string, 0)}
+
+	iNicknames := make([]string, 0, len(project.Instances))
+	for iNickname := range project.Instances {
+		iNicknames = append(iNicknames, iNickname)
+	}
+	sort.Strings(iNicknames)
+
+	for _, iNickname := range iNicknames {
+		iDef := project.Instances[iNickname]
+		instanceHourly, ok := prices.InstanceHourly[iDef.FlavorName]
+		e.add(CostPhaseRunning, "instance", iNickname, iDef.FlavorName, instanceHourly, ok)
+
+		rootHourly, ok := prices.volumeHourly(prices.RootVolumeType, prices.RootVolumeGb)
+		e.add(CostPhaseRunning, "root_volume", iNickname, fmt.Sprintf("%s %dGiB", prices.RootVolumeType, prices.RootVolumeGb), rootHourly, ok)
+
+		// deployment_create_images keeps root volume snapshots instead of instances
+		e.add(CostPhaseStopped, "image_snapshot", iNickname, fmt.Sprintf("%dGiB", prices.RootVolumeGb), prices.SnapshotGbMonthly*float64(prices.RootVolumeGb)/HoursPerMonth, true)
+
+		volNicknames := make([]string, 0, len(iDef.Volumes))
+		for volNickname := range iDef.Volumes {
+			volNicknames = append(volNicknames, volNickname)
+		}
+		sort.Strings(volNicknames)
+		for _, volNickname := range volNicknames {
+			volDef := iDef.Volumes[volNickname]
+			volHourly, ok := prices.volumeHourly(volDef.Type, volDef.Size)
+			e.add(CostPhaseAlways, "volume", volDef.Name, fmt.Sprintf("%s %dGiB", volDef.Type, volDef.Size), volHourly, ok)
+		}
+
+		if iDef.ExternalIpAddressName != "" {
+			e.add(CostPhaseAlways, "elastic_ip", iDef.ExternalIpAddressName, "", prices.ElasticIpHourly, true)
+		}
+	}
+
+	publicSubnet := project.Network.PublicSubnet
+	if publicSubnet.NatGatewayName != "" {
+		e.add(CostPhaseAlways, "nat_gateway", publicSubnet.NatGatewayName, "", prices.NatGatewayHourly, true)
+	}
+	if publicSubnet.NatGatewayExternalIpName != "" {
+		e.add(CostPhaseAlways, "elastic_ip", publicSubnet.NatGatewayExternalIpName, "", prices.ElasticIpHourly, true)
+	}
+
+	return e
+}
+
+func FormatEstimate(e *Estimate, format string) (string, error) {
+	if format == cld.OutputFormatJson {
+		estimateBytes, err := json.MarshalIndent(e, "", "    ")
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal cost estimate: %s", err.Error())
+		}
+		return string(estimateBytes), nil
+	}
+	if format == cld.OutputFormatCsv {
+		return cld.FormatRecords(e.Items, format)
+	}
+	items, err := cld.FormatRecords(e.Items, cld.OutputFormatTable)
+	if err != nil {
+		return "", err
+	}
+	sb := strings.Builder{}
+	sb.WriteString(items + "\n")
+	sb.WriteString(fmt.Sprintf("Prices: %s, %s\n", e.PriceTable, e.Currency))
+	sb.WriteString(fmt.Sprintf("Deployment up: %.4f/hour, %.2f/month\n", e.RunningHourly, e.RunningMonthly))
+	sb.WriteString(fmt.Sprintf("Instances kept as images (deployment_create_images): %.4f/hour, %.2f/month", e.StoppedHourly, e.StoppedMonthly))
+	if len(e.Unpriced) > 0 {
+		sb.WriteString(fmt.Sprintf("\nNot in the price table, counted as 0: %s", strings.Join(e.Unpriced, ", ")))
+	}
+	return sb.String(), nil
+}
+
+// Sets HourlyCost of billed resources. Returns descriptions of billed resources that could not be priced.
+func PriceResources(resources []*cld.Resource, prices *PriceTable) []string {
+	unpriced := make([]string, 0)
+	for _, r := range resources {
+		r.HourlyCost = 0
+		if r.BilledState != cld.ResourceBilledStateActive || r.Svc != "ec2" {
+			continue
+		}
+		switch r.Type {
+		case "instance":
+			if hourly, ok := prices.InstanceHourly[r.Flavor]; ok {
+				r.HourlyCost = hourly
+			} else {
+				unpriced = append(unpriced, fmt.Sprintf("instance %s (%s)", r.Flavor, r.Name))
+			}
+		case "volume":
+			if hourly, ok := prices.volumeHourly(r.Flavor, r.SizeGb); ok {
+				r.HourlyCost = hourly
+			} else {
+				unpriced = append(unpriced, fmt.Sprintf("volume %s (%s)", r.Flavor, r.Name))
+			}
+		case "natgateway":
+			r.HourlyCost = prices.NatGatewayHourly
+		case "elastic-ip":
+			r.HourlyCost = prices.ElasticIpHourly
+		case "snapshot":
+			// Full volume size, actual snapshot storage is usually less
+			r.HourlyCost = roundCost(prices.SnapshotGbMonthly*float64(r.SizeGb)/HoursPerMonth, 6)
+		}
+	}
+	return unpriced
+}
+
+func TotalHourlyCost(resources []*cld.Resource) float64 {
+	total := 0.0
+	for _, r := range resources {
+		total += r.HourlyCost
+	}
+	return total
+}
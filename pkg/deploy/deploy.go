@@ -0,0 +1,325 @@
+// Package deploy lets Go programs run capideploy operations without shelling out to the binary.
+// Every operation takes a context: cancelling it stops AWS calls, wait loops and ssh sessions,
+// the same way Ctrl-C stops capideploy.
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/provider"
+)
+
+// Outcome of one command on one instance. Commands that are not bound to instances,
+// like create_networking, return one result with an empty Nickname.
+type Result = provider.InstanceCmdResult
+
+type Options struct {
+	Events        event.Sink                 // Progress, logs, resource changes and script output, dropped if nil
+	IsVerbose     bool                       // Include script output in logs
+	AssumeRole    *provider.AssumeRoleConfig // Nil to run under the caller's own identity
+	DeploymentTtl string                     // Overrides deployment_ttl from the project if not empty
+	AuditLog      string                     // Overrides audit_log from the project if not empty
+}
+
+// Instance nicknames, * wildcards allowed, like Nicknames("cass*", "bastion")
+type Selector []string
+
+func All() Selector {
+	return Selector{"*"}
+}
+
+func Nicknames(nicknames ...string) Selector {
+	return Selector(nicknames)
+}
+
+func (s Selector) String() string {
+	return strings.Join(s, ",")
+}
+
+func (s Selector) nicknames() (string, error) {
+	if len(s) == 0 {
+		return "", fmt.Errorf("empty instance selector, use All() to select all instances")
+	}
+	return s.String(), nil
+}
+
+// Not safe for concurrent use, operations share the project. Mutating operations hold the deployment lock,
+// so one started while another process runs on the same deployment fails with a "locked" error.
+type Deployment struct {
+	project   *prj.Project
+	p         provider.DeployProvider
+	isVerbose bool
+}
+
+func LoadProject(prjFile string) (*prj.Project, error) {
+	return prj.LoadProject(prjFile)
+}
+
+// Checks cloud credentials, assumes the role if requested and opens the audit journal.
+// ctx is used for this setup only, each operation takes its own.
+func New(ctx context.Context, project *prj.Project, opts *Options) (*Deployment, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	events := opts.Events
+	if events == nil {
+		events = event.Discard
+	}
+	assumeRole := opts.AssumeRole
+	if assumeRole == nil {
+		assumeRole = &provider.AssumeRoleConfig{}
+	}
+	if opts.DeploymentTtl != "" {
+		project.DeploymentTtl = opts.DeploymentTtl
+	}
+	if opts.AuditLog != "" {
+		project.AuditLog = opts.AuditLog
+	}
+	p, err := provider.DeployProviderFactory(project, ctx, assumeRole, opts.IsVerbose, events)
+	if err != nil {
+		return nil, err
+	}
+	return &Deployment{project: project, p: p, isVerbose: opts.IsVerbose}, nil
+}
+
+// For DestroyByTag and ForceUnlock when the project file is not available
+func NewByName(ctx context.Context, deploymentName string, opts *Options) (*Deployment, error) {
+	return New(ctx, prj.NewTagOnlyProject(deploymentName, prj.DeployProviderAws), opts)
+}
+
+func (d *Deployment) Project() *prj.Project {
+	return d.project
+}
+
+// Closes the audit journal, if any, call it when done with the deployment: later operations are not journaled
+func (d *Deployment) Close() error {
+	return d.p.Close()
+}
+
+// Commands not covered by typed operations below
+func (d *Deployment) Provider() provider.DeployProvider {
+	return d.p
+}
+
+func (d *Deployment) exec(ctx context.Context, cmd string, nicknames string, execArgs *provider.ExecArgs) ([]*Result, error) {
+	execArgs.Verbosity = d.isVerbose
+	return d.p.WithContext(ctx).ExecCmd(cmd, nicknames, execArgs)
+}
+
+func (d *Deployment) execOnSelected(ctx context.Context, cmd string, sel Selector, execArgs *provider.ExecArgs) ([]*Result, error) {
+	nicknames, err := sel.nicknames()
+	if err != nil {
+		return nil, err
+	}
+	return d.exec(ctx, cmd, nicknames, execArgs)
+}
+
+// Networking
+
+func (d *Deployment) CreateFloatingIps(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdCreateFloatingIps, "", &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteFloatingIps(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeleteFloatingIps, "", &provider.ExecArgs{})
+}
+
+func (d *Deployment) CreateSecurityGroups(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdCreateSecurityGroups, "", &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteSecurityGroups(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeleteSecurityGroups, "", &provider.ExecArgs{})
+}
+
+func (d *Deployment) CreateNetworking(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdCreateNetworking, "", &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteNetworking(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeleteNetworking, "", &provider.ExecArgs{})
+}
+
+// Volumes
+
+func (d *Deployment) CreateVolumes(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdCreateVolumes, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) AttachVolumes(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdAttachVolumes, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) DetachVolumes(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdDetachVolumes, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteVolumes(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdDeleteVolumes, sel, &provider.ExecArgs{})
+}
+
+// Instances
+
+func (d *Deployment) CreateInstances(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdCreateInstances, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteInstances(ctx context.Context, sel Selector, ignoreAttachedVolumes bool) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdDeleteInstances, sel, &provider.ExecArgs{IgnoreAttachedVolumes: ignoreAttachedVolumes})
+}
+
+func (d *Deployment) PingInstances(ctx context.Context, sel Selector, repetitions int) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdPingInstances, sel, &provider.ExecArgs{NumberOfRepetitions: repetitions})
+}
+
+func (d *Deployment) CreateSnapshotImages(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdCreateSnapshotImages, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) CreateInstancesFromSnapshotImages(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdCreateInstancesFromSnapshotImages, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) DeleteSnapshotImages(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdDeleteSnapshotImages, sel, &provider.ExecArgs{})
+}
+
+// Services and files
+
+func (d *Deployment) InstallServices(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdInstallServices, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) ConfigServices(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdConfigServices, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) StartServices(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdStartServices, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) StopServices(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdStopServices, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) WaitServicesReady(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdWaitServicesReady, sel, &provider.ExecArgs{})
+}
+
+func (d *Deployment) CheckCassandraStatus(ctx context.Context) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdCheckCassStatus, "", &provider.ExecArgs{})
+}
+
+// sel picks the cassandra instances to wait for
+func (d *Deployment) WaitCassandraNodesJoined(ctx context.Context, sel Selector) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdWaitCassNodesJoined, sel, &provider.ExecArgs{})
+}
+
+// permissions like 0644 and owner like ubuntu are applied to uploaded files, 0 and "" leave them as is
+func (d *Deployment) UploadFiles(ctx context.Context, sel Selector, srcPath string, dstPath string, permissions int, owner string) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdUploadFiles, sel, &provider.ExecArgs{SrcPath: srcPath, DstPath: dstPath, Permissions: permissions, Owner: owner})
+}
+
+func (d *Deployment) DownloadFiles(ctx context.Context, sel Selector, srcPath string, dstPath string) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdDownloadFiles, sel, &provider.ExecArgs{SrcPath: srcPath, DstPath: dstPath})
+}
+
+// Combined commands. With resume, they continue from their checkpoint file, retrying only failed steps and instances.
+
+func (d *Deployment) DeploymentCreate(ctx context.Context, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeploymentCreate, "", &provider.ExecArgs{Resume: resume})
+}
+
+func (d *Deployment) DeploymentCreateImages(ctx context.Context, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeploymentCreateImages, "", &provider.ExecArgs{Resume: resume})
+}
+
+func (d *Deployment) DeploymentRestoreInstances(ctx context.Context, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeploymentRestoreInstances, "", &provider.ExecArgs{Resume: resume})
+}
+
+func (d *Deployment) DeploymentDeleteImages(ctx context.Context, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeploymentDeleteImages, "", &provider.ExecArgs{Resume: resume})
+}
+
+func (d *Deployment) DeploymentDelete(ctx context.Context, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdDeploymentDelete, "", &provider.ExecArgs{Resume: resume})
+}
+
+// Workflow from the project's workflows section
+func (d *Deployment) RunWorkflow(ctx context.Context, workflowName string, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdRunWorkflow, workflowName, &provider.ExecArgs{Resume: resume})
+}
+
+// Creates and starts the instances of the purpose (cassandra or daemon) added to the project since the last run
+func (d *Deployment) Scale(ctx context.Context, purpose string, resume bool) ([]*Result, error) {
+	return d.exec(ctx, provider.CmdScale, purpose, &provider.ExecArgs{Resume: resume})
+}
+
+func (d *Deployment) RollingRestart(ctx context.Context, sel Selector, batchSize int, resume bool) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdRollingRestart, sel, &provider.ExecArgs{BatchSize: batchSize, Resume: resume})
+}
+
+func (d *Deployment) RollingConfig(ctx context.Context, sel Selector, batchSize int, resume bool) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdRollingConfig, sel, &provider.ExecArgs{BatchSize: batchSize, Resume: resume})
+}
+
+// Empty releaseUrl upgrades to CAPILLARIES_RELEASE_URL from the project
+func (d *Deployment) UpgradeCapillaries(ctx context.Context, sel Selector, releaseUrl string, resume bool) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdUpgradeCapillaries, sel, &provider.ExecArgs{ReleaseUrl: releaseUrl, Resume: resume})
+}
+
+func (d *Deployment) RollbackCapillaries(ctx context.Context, sel Selector, resume bool) ([]*Result, error) {
+	return d.execOnSelected(ctx, provider.CmdUpgradeCapillaries, sel, &provider.ExecArgs{Rollback: true, Resume: resume})
+}
+
+// Queries
+
+// What the command would do, without changing anything
+func (d *Deployment) Plan(ctx context.Context, cmd string, nicknames string, execArgs *provider.ExecArgs) ([]*provider.PlanItem, error) {
+	return d.p.WithContext(ctx).PlanCmd(cmd, nicknames, execArgs)
+}
+
+func (d *Deployment) ListDeploymentResources(ctx context.Context) ([]*cld.Resource, error) {
+	return d.p.WithContext(ctx).ListDeploymentResources()
+}
+
+func (d *Deployment) CheckDrift(ctx context.Context) (*provider.DriftReport, error) {
+	return d.p.WithContext(ctx).CheckDrift()
+}
+
+// waitSeconds 0 checks once
+func (d *Deployment) Health(ctx context.Context, sel Selector, waitSeconds int) ([]*provider.HealthCheckResult, error) {
+	nicknames, err := sel.nicknames()
+	if err != nil {
+		return nil, err
+	}
+	return d.p.WithContext(ctx).Health(nicknames, waitSeconds)
+}
+
+func (d *Deployment) Exec(ctx context.Context, sel Selector, shellCmd string) ([]*provider.InstanceExecResult, error) {
+	nicknames, err := sel.nicknames()
+	if err != nil {
+		return nil, err
+	}
+	return d.p.WithContext(ctx).ExecOnInstances(nicknames, shellCmd)
+}
+
+func (d *Deployment) ExportInventory(ctx context.Context, dstDir string) error {
+	return d.p.WithContext(ctx).ExportInventory(dstDir)
+}
+
+// Deletes everything tagged with the deployment name, the project file is not needed.
+// Unless planOnly, confirmedName must repeat the deployment name.
+func (d *Deployment) DestroyByTag(ctx context.Context, confirmedName string, planOnly bool) ([]*provider.PlanItem, error) {
+	return d.p.WithContext(ctx).DestroyByTag(d.project.DeploymentName, confirmedName, planOnly)
+}
+
+func (d *Deployment) ForceUnlock(ctx context.Context) error {
+	return d.p.WithContext(ctx).ForceUnlock(d.project.DeploymentName)
+}
@@ -0,0 +1,133 @@
+package event
+
+import (
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+type Type string
+
+const (
+	TypeStepStarted     Type = "step_started"     // A command, or a command on one instance, started
+	TypeStepFinished    Type = "step_finished"    // ... and finished, with its log and outcome
+	TypeLog             Type = "log"              // Log of an auxiliary provider call, like populating bastion ip
+	TypeResourceCreated Type = "resource_created" // Cloud resource created
+	TypeResourceSkipped Type = "resource_skipped" // Cloud resource not created because it is there already
+	TypeResourceDeleted Type = "resource_deleted" // Cloud resource deleted
+	TypeScriptOutput    Type = "script_output"    // Output of an embedded script run on an instance
+	TypeMessage         Type = "message"          // Progress message
+	TypeError           Type = "error"
+)
+
+// Only the fields relevant to the event type are set. Text fields never contain terminal colors.
+type Event struct {
+	Ts           time.Time `json:"ts"`
+	Type         Type      `json:"type"`
+	Cmd          string    `json:"cmd,omitempty"`
+	Nickname     string    `json:"nickname,omitempty"`
+	ResourceType string    `json:"resource_type,omitempty"` // Same types as list_deployment_resources: instance, volume, vpc...
+	ResourceName string    `json:"resource_name,omitempty"`
+	ResourceId   string    `json:"resource_id,omitempty"`
+	Script       string    `json:"script,omitempty"`
+	IpAddress    string    `json:"ip_address,omitempty"`
+	Elapsed      float64   `json:"elapsed,omitempty"` // Seconds
+	Message      string    `json:"message,omitempty"`
+	Log          string    `json:"log,omitempty"` // What LogBuilder collected, verbose mode adds cloud call details
+	Stdout       string    `json:"stdout,omitempty"`
+	Stderr       string    `json:"stderr,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	coloredLog   string    // Log as LogBuilder produced it, for terminals
+}
+
+// Receives events from all goroutines of a running command, implementations must be safe for concurrent use
+// and should not block for long: workers wait for Emit to return.
+type Sink interface {
+	Emit(e *Event)
+}
+
+// Lets an ordinary function be a Sink
+type SinkFunc func(e *Event)
+
+func (f SinkFunc) Emit(e *Event) {
+	f(e)
+}
+
+// Drops all events
+var Discard Sink = SinkFunc(func(e *Event) {})
+
+func newEvent(t Type) *Event {
+	return &Event{Ts: time.Now(), Type: t}
+}
+
+func NewStepStarted(cmd string, nickname string) *Event {
+	e := newEvent(TypeStepStarted)
+	e.Cmd = cmd
+	e.Nickname = nickname
+	return e
+}
+
+// Empty nickname and logMsg for the whole command
+func NewStepFinished(cmd string, nickname string, logMsg l.LogMsg, elapsed time.Duration, err error) *Event {
+	e := newEvent(TypeStepFinished)
+	e.Cmd = cmd
+	e.Nickname = nickname
+	e.Elapsed = elapsed.Seconds()
+	e.setLog(logMsg)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func NewLog(logMsg l.LogMsg) *Event {
+	e := newEvent(TypeLog)
+	e.setLog(logMsg)
+	return e
+}
+
+func NewResource(t Type, resourceType string, resourceName string, resourceId string) *Event {
+	e := newEvent(t)
+	e.ResourceType = resourceType
+	e.ResourceName = resourceName
+	e.ResourceId = resourceId
+	return e
+}
+
+func NewScriptOutput(nickname string, ipAddress string, script string, stdout string, stderr string, elapsed time.Duration, err error) *Event {
+	e := newEvent(TypeScriptOutput)
+	e.Nickname = nickname
+	e.IpAddress = ipAddress
+	e.Script = script
+	e.Stdout = stdout
+	e.Stderr = stderr
+	e.Elapsed = elapsed.Seconds()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func NewMessage(msg string) *Event {
+	e := newEvent(TypeMessage)
+	e.Message = msg
+	return e
+}
+
+func NewError(err error) *Event {
+	e := newEvent(TypeError)
+	e.Error = err.Error()
+	return e
+}
+
+// Attributes an error or a log to a command and an instance
+func (e *Event) WithStep(cmd string, nickname string) *Event {
+	e.Cmd = cmd
+	e.Nickname = nickname
+	return e
+}
+
+func (e *Event) setLog(logMsg l.LogMsg) {
+	e.coloredLog = string(logMsg)
+	e.Log = logMsg.Plain()
+}
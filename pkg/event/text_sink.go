@@ -0,0 +1,44 @@
+package event
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// Renders events the way capideploy always printed them: logs and messages to out, errors to errOut.
+// Step starts, resource changes and script output are in the logs already, they are not printed separately.
+type TextSink struct {
+	mx     sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+}
+
+func NewTextSink(out io.Writer, errOut io.Writer) *TextSink {
+	return &TextSink{out: out, errOut: errOut}
+}
+
+func (s *TextSink) Emit(e *Event) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	switch e.Type {
+	case TypeStepFinished:
+		if e.coloredLog != "" {
+			fmt.Fprintf(s.out, "%s\n", e.coloredLog)
+		} else if e.Nickname != "" {
+			return
+		} else if e.Error != "" {
+			fmt.Fprintf(s.out, "%s %sERROR%s, elapsed %.3fs\n", e.Cmd, l.LogColorRed, l.LogColorReset, e.Elapsed)
+		} else {
+			fmt.Fprintf(s.out, "%s %sOK%s, elapsed %.3fs\n", e.Cmd, l.LogColorGreen, l.LogColorReset, e.Elapsed)
+		}
+	case TypeLog:
+		fmt.Fprintf(s.out, "%s\n", e.coloredLog)
+	case TypeMessage:
+		fmt.Fprintf(s.out, "%s\n", e.Message)
+	case TypeError:
+		fmt.Fprintf(s.errOut, "%s\n", e.Error)
+	}
+}
@@ -72,3 +72,8 @@ func (lb *LogBuilder) Complete(err error) (LogMsg, error) {
 	lb.Sb.WriteString("\n")
 	return LogMsg(lb.Sb.String()), err
 }
+
+// Same text without terminal colors
+func (msg LogMsg) Plain() string {
+	return strings.NewReplacer(LogColorRed, "", LogColorGreen, "", LogColorReset, "").Replace(string(msg))
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
 	"github.com/google/go-jsonnet"
@@ -32,6 +33,8 @@ type ExecTimeouts struct {
 	DetachVolume     int `json:"detach_volume"`
 	CreateImage      int `json:"create_image"`
 	StopInstance     int `json:"stop_instance"`
+	JoinCassandra    int `json:"join_cassandra"` // Seconds a new Cassandra node may take to bootstrap and become UN
+	ServiceReady     int `json:"service_ready"`  // Seconds a restarted instance may take to pass its readiness check
 }
 
 func (t *ExecTimeouts) InitDefaults() {
@@ -62,6 +65,38 @@ func (t *ExecTimeouts) InitDefaults() {
 	if t.StopInstance == 0 {
 		t.StopInstance = 300
 	}
+	if t.JoinCassandra == 0 {
+		t.JoinCassandra = 1800
+	}
+	if t.ServiceReady == 0 {
+		t.ServiceReady = 300
+	}
+}
+
+type ExecLimits struct {
+	AwsCallsPerSecond float64 `json:"aws_calls_per_second"` // Token bucket refill rate for all AWS API calls, lowered automatically while AWS throttles us
+	AwsBurst          int     `json:"aws_burst"`            // Token bucket capacity
+	AwsMaxAttempts    int     `json:"aws_max_attempts"`     // Per AWS API call, including the first one
+	AwsMaxBackoff     int     `json:"aws_max_backoff"`      // Seconds, upper limit for exponential backoff between attempts
+	SshConcurrency    int     `json:"ssh_concurrency"`      // Simultaneous ssh sessions (ping, services, file transfer) across all running steps
+}
+
+func (t *ExecLimits) InitDefaults() {
+	if t.AwsCallsPerSecond == 0 {
+		t.AwsCallsPerSecond = 5
+	}
+	if t.AwsBurst == 0 {
+		t.AwsBurst = 10
+	}
+	if t.AwsMaxAttempts == 0 {
+		t.AwsMaxAttempts = 8
+	}
+	if t.AwsMaxBackoff == 0 {
+		t.AwsMaxBackoff = 20
+	}
+	if t.SshConcurrency == 0 {
+		t.SshConcurrency = 20
+	}
 }
 
 type SecurityGroupRuleDef struct {
@@ -191,23 +226,73 @@ func (iDef *InstanceDef) BestIpAddress() string {
 // 	}
 // }
 
+const (
+	WorkflowStepOnFailStop   string = "stop"
+	WorkflowStepOnFailIgnore string = "ignore"
+)
+
+type WorkflowStepDef struct {
+	Cmd       string   `json:"cmd"`
+	Nicknames string   `json:"nicknames"`            // Comma-separated list of instance nicknames, may contain *, empty for commands that do not need it
+	OnFail    string   `json:"on_fail"`              // stop (default) or ignore
+	Id        string   `json:"id,omitempty"`         // Optional; if any step has an id, steps run as a dependency graph
+	DependsOn []string `json:"depends_on,omitempty"` // Ids of earlier steps this step waits for
+}
+
 type Project struct {
-	DeploymentName     string                       `json:"deployment_name"`
-	SshConfig          *rexec.SshConfigDef          `json:"ssh_config"`
-	Timeouts           ExecTimeouts                 `json:"timeouts"`
-	SecurityGroups     map[string]*SecurityGroupDef `json:"security_groups"`
-	Network            NetworkDef                   `json:"network"`
-	Instances          map[string]*InstanceDef      `json:"instances"`
-	DeployProviderName string                       `json:"deploy_provider_name"`
+	DeploymentName     string                        `json:"deployment_name"`
+	DeploymentTtl      string                        `json:"deployment_ttl,omitempty"` // Go duration like 72h, created resources get a DeploymentExpires tag
+	AuditLog           string                        `json:"audit_log,omitempty"`      // JSONL journal of mutating cloud calls and scripts, see verify_audit
+	AuditKey           string                        `json:"-"`                        // HMAC key of the audit journal, read from audit_key separately so it never gets marshaled, like by -s
+	SshConfig          *rexec.SshConfigDef           `json:"ssh_config"`
+	Timeouts           ExecTimeouts                  `json:"timeouts"`
+	Limits             ExecLimits                    `json:"limits"`
+	SecurityGroups     map[string]*SecurityGroupDef  `json:"security_groups"`
+	Network            NetworkDef                    `json:"network"`
+	Instances          map[string]*InstanceDef       `json:"instances"`
+	DeployProviderName string                        `json:"deploy_provider_name"`
+	Workflows          map[string][]*WorkflowStepDef `json:"workflows,omitempty"`
+	ProjectFileDirPath string                        `json:"-"` // Where the project was loaded from, checkpoints are kept there; empty means current directory
 	// EnvVariablesUsed   []string                     `json:"env_variables_used"`
 }
 
 func (p *Project) InitDefaults() {
 	p.Timeouts.InitDefaults()
+	p.Limits.InitDefaults()
+}
+
+// Zero if the deployment never expires
+func (p *Project) DeploymentTtlDuration() (time.Duration, error) {
+	if p.DeploymentTtl == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(p.DeploymentTtl)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid deployment_ttl %s, expected positive duration like 72h", p.DeploymentTtl)
+	}
+	return ttl, nil
 }
 
 const DeployProviderAws string = "aws"
 
+// Nickname of the instance with this internal or external ip address, empty if none.
+// External addresses are known only after the bastion ip was ensured.
+func (p *Project) InstanceNicknameByIpAddress(ipAddress string) string {
+	for iNickname, iDef := range p.Instances {
+		if iDef.IpAddress == ipAddress || (iDef.ExternalIpAddress != "" && iDef.ExternalIpAddress == ipAddress) {
+			return iNickname
+		}
+	}
+	return ""
+}
+
+// For commands that work on an existing deployment by tag alone: no instances, default timeouts and limits
+func NewTagOnlyProject(deploymentName string, deployProviderName string) *Project {
+	p := &Project{DeploymentName: deploymentName, DeployProviderName: deployProviderName}
+	p.InitDefaults()
+	return p
+}
+
 type ProjectPair struct {
 	// Template Project
 	Live Project
@@ -356,6 +441,44 @@ func (prj *Project) validate() error {
 		return fmt.Errorf("none of the instances is using ssh_config_external_ip, at least one must have it")
 	}
 
+	if _, err := prj.DeploymentTtlDuration(); err != nil {
+		return err
+	}
+
+	if prj.Limits.AwsCallsPerSecond < 0 || prj.Limits.AwsBurst < 0 || prj.Limits.AwsMaxAttempts < 0 || prj.Limits.AwsMaxBackoff < 0 || prj.Limits.SshConcurrency < 0 {
+		return fmt.Errorf("limits cannot be negative: %v", prj.Limits)
+	}
+
+	// Workflows: commands are checked by the provider, here we check only what we can
+	for workflowName, steps := range prj.Workflows {
+		if len(steps) == 0 {
+			return fmt.Errorf("workflow %s has no steps", workflowName)
+		}
+		stepIds := map[string]struct{}{}
+		for stepIdx, step := range steps {
+			if step.Cmd == "" {
+				return fmt.Errorf("workflow %s step %d has empty cmd", workflowName, stepIdx)
+			}
+			if step.OnFail == "" {
+				step.OnFail = WorkflowStepOnFailStop
+			}
+			if step.OnFail != WorkflowStepOnFailStop && step.OnFail != WorkflowStepOnFailIgnore {
+				return fmt.Errorf("workflow %s step %d (%s) has invalid on_fail %s, expected %s or %s", workflowName, stepIdx, step.Cmd, step.OnFail, WorkflowStepOnFailStop, WorkflowStepOnFailIgnore)
+			}
+			for _, depId := range step.DependsOn {
+				if _, ok := stepIds[depId]; !ok {
+					return fmt.Errorf("workflow %s step %d (%s) depends on %s, which is not an id of an earlier step", workflowName, stepIdx, step.Cmd, depId)
+				}
+			}
+			if step.Id != "" {
+				if _, ok := stepIds[step.Id]; ok {
+					return fmt.Errorf("workflow %s step %d (%s) has duplicate id %s", workflowName, stepIdx, step.Cmd, step.Id)
+				}
+				stepIds[step.Id] = struct{}{}
+			}
+		}
+	}
+
 	scriptsMap := map[string]bool{}
 	if err := rexec.HarvestAllEmbeddedFilesPaths("", scriptsMap); err != nil {
 		return err
@@ -400,6 +523,35 @@ func (prj *Project) validate() error {
 }
 
 func LoadProject(prjFile string) (*Project, error) {
+	return LoadProjectWithEnv(prjFile, nil)
+}
+
+// Values in envOverrides take precedence over env variables of the process
+func LoadProjectWithEnv(prjFile string, envOverrides map[string]string) (*Project, error) {
+	return loadProject(prjFile, func(envVar string) string {
+		if v, ok := envOverrides[envVar]; ok {
+			return v
+		}
+		return os.Getenv(envVar)
+	}, nil)
+}
+
+// For projects written by someone who must not see env variables or files of this process, like serve clients.
+// Values come from env, or from env variables of the process listed in allowedProcessEnv. Jsonnet imports are refused.
+func LoadUntrustedProject(prjFile string, env map[string]string, allowedProcessEnv map[string]struct{}) (*Project, error) {
+	return loadProject(prjFile, func(envVar string) string {
+		if v, ok := env[envVar]; ok {
+			return v
+		}
+		if _, ok := allowedProcessEnv[envVar]; ok {
+			return os.Getenv(envVar)
+		}
+		return ""
+	}, &jsonnet.MemoryImporter{Data: map[string]jsonnet.Contents{}})
+}
+
+// Nil importer means jsonnet imports read local files
+func loadProject(prjFile string, lookupEnv func(envVar string) string, importer jsonnet.Importer) (*Project, error) {
 	prjFullPath, err := filepath.Abs(prjFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get absolute path of %s: %s", prjFile, err.Error())
@@ -421,7 +573,7 @@ func LoadProject(prjFile string) (*Project, error) {
 	matches := r.FindAllStringSubmatch(strJsonnet, -1)
 	for _, v := range matches {
 		envVar := v[1]
-		envVars[envVar] = os.Getenv(envVar)
+		envVars[envVar] = lookupEnv(envVar)
 		if envVars[envVar] == "" {
 			missingVars = append(missingVars, envVar)
 		}
@@ -453,7 +605,14 @@ func LoadProject(prjFile string) (*Project, error) {
 	// Run jsonnet engine agains a file with replaced env vars
 
 	vm := jsonnet.MakeVM()
-	prjString, err := vm.EvaluateFile(fTemp.Name())
+	var prjString string
+	if importer == nil {
+		prjString, err = vm.EvaluateFile(fTemp.Name())
+	} else {
+		// The importer cannot read the temp file either, evaluate its text
+		vm.Importer(importer)
+		prjString, err = vm.EvaluateAnonymousSnippet(prjFullPath, strJsonnet)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -462,6 +621,13 @@ func LoadProject(prjFile string) (*Project, error) {
 	if err := json.Unmarshal([]byte(prjString), &project); err != nil {
 		return nil, fmt.Errorf("cannot parse project file with replaced vars %s: %s", prjFullPath, err.Error())
 	}
+	var auditKeyDef struct {
+		AuditKey string `json:"audit_key"` // Like {CAPIDEPLOY_AUDIT_KEY}, never the key itself
+	}
+	if err := json.Unmarshal([]byte(prjString), &auditKeyDef); err != nil {
+		return nil, fmt.Errorf("cannot parse audit_key in project file %s: %s", prjFullPath, err.Error())
+	}
+	project.AuditKey = auditKeyDef.AuditKey
 
 	if project.DeployProviderName != DeployProviderAws {
 		return nil, fmt.Errorf("cannot parse deploy provider name %s, expected [%s]",
@@ -469,6 +635,8 @@ func LoadProject(prjFile string) (*Project, error) {
 			DeployProviderAws)
 	}
 
+	project.ProjectFileDirPath = filepath.Dir(prjFullPath)
+
 	// Defaults
 
 	project.InitDefaults()
@@ -8,24 +8,18 @@ import (
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 )
 
-func (p *AwsDeployProvider) listDeployments() (map[string]int, l.LogMsg, error) {
+// Returns resources of all deployments. Looking up the state of each resource, to tell which deployments
+// are still billed, takes a cloud call per resource, so it is done only when asked.
+func (p *AwsDeployProvider) listDeployments(withState bool) ([]*cld.Resource, l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
 	resources, err := cldaws.GetResourcesByTag(p.DeployCtx.Aws.TaggingClient, p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Aws.Config.Region,
-		[]taggingTypes.TagFilter{{Key: aws.String(cld.DeploymentOperatorTagName), Values: []string{cld.DeploymentOperatorTagValue}}}, false)
+		[]taggingTypes.TagFilter{{Key: aws.String(cld.DeploymentOperatorTagName), Values: []string{cld.DeploymentOperatorTagValue}}}, withState)
 	if err != nil {
 		logMsg, err := lb.Complete(err)
 		return nil, logMsg, err
 	}
-	deploymentResCount := map[string]int{}
-	for _, res := range resources {
-		if deploymentNameCount, ok := deploymentResCount[res.DeploymentName]; ok {
-			deploymentResCount[res.DeploymentName] = deploymentNameCount + 1
-		} else {
-			deploymentResCount[res.DeploymentName] = 1
-		}
-	}
 	logMsg, _ := lb.Complete(nil)
-	return deploymentResCount, logMsg, nil
+	return resources, logMsg, nil
 }
 
 func (p *AwsDeployProvider) listDeploymentResources() ([]*cld.Resource, l.LogMsg, error) {
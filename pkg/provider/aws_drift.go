@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	taggingTypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// Resource type names match the ones returned by cldaws.GetResourcesByTag, so missing and extra items look the same
+
+func (p *AwsDeployProvider) checkNetworkingDrift(lb *l.LogBuilder, report *DriftReport, expected map[string]map[string]struct{}) (string, error) {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+	network := &p.DeployCtx.Project.Network
+
+	expected["vpc"][network.Name] = struct{}{}
+	vpcId, vpcCidr, err := cldaws.GetVpcIdAndCidrByName(ec2Client, goCtx, lb, network.Name)
+	if err != nil {
+		return "", err
+	}
+	if vpcId == "" {
+		report.addMissing("vpc", network.Name)
+	} else {
+		report.checkAttr("vpc", network.Name, vpcId, "cidr", network.Cidr, vpcCidr)
+	}
+
+	subnetIds := map[string]string{}
+	for _, subnetDef := range []struct {
+		name string
+		cidr string
+		az   string
+	}{
+		{network.PrivateSubnet.Name, network.PrivateSubnet.Cidr, network.PrivateSubnet.AvailabilityZone},
+		{network.PublicSubnet.Name, network.PublicSubnet.Cidr, network.PublicSubnet.AvailabilityZone},
+	} {
+		expected["subnet"][subnetDef.name] = struct{}{}
+		attrs, err := cldaws.GetSubnetAttributesByName(ec2Client, goCtx, lb, subnetDef.name)
+		if err != nil {
+			return "", err
+		}
+		if attrs == nil {
+			report.addMissing("subnet", subnetDef.name)
+			continue
+		}
+		subnetIds[subnetDef.name] = attrs.Id
+		report.checkAttr("subnet", subnetDef.name, attrs.Id, "cidr", subnetDef.cidr, attrs.Cidr)
+		report.checkAttr("subnet", subnetDef.name, attrs.Id, "availability_zone", subnetDef.az, attrs.AvailabilityZone)
+		report.checkAttr("subnet", subnetDef.name, attrs.Id, "vpc", vpcId, attrs.VpcId)
+	}
+
+	expected["internet-gateway"][network.Router.Name] = struct{}{}
+	routerId, err := cldaws.GetInternetGatewayIdByName(ec2Client, goCtx, lb, network.Router.Name)
+	if err != nil {
+		return "", err
+	}
+	if routerId == "" {
+		report.addMissing("internet-gateway", network.Router.Name)
+	} else {
+		attachedVpcId, _, err := cldaws.GetInternetGatewayVpcAttachmentById(ec2Client, goCtx, lb, routerId)
+		if err != nil {
+			return "", err
+		}
+		report.checkAttr("internet-gateway", network.Router.Name, routerId, "attached_vpc", vpcId, attachedVpcId)
+	}
+
+	natGatewayName := network.PublicSubnet.NatGatewayName
+	expected["natgateway"][natGatewayName] = struct{}{}
+	natGatewayId, natGatewayState, err := cldaws.GetNatGatewayIdAndStateByName(ec2Client, goCtx, lb, natGatewayName)
+	if err != nil {
+		return "", err
+	}
+	if natGatewayId == "" || natGatewayState == types.NatGatewayStateDeleted || natGatewayState == types.NatGatewayStateDeleting {
+		report.addMissing("natgateway", natGatewayName)
+	} else {
+		report.checkAttr("natgateway", natGatewayName, natGatewayId, "state", string(types.NatGatewayStateAvailable), string(natGatewayState))
+	}
+
+	routeTableName := network.PrivateSubnet.RouteTableToNatgwName
+	expected["route-table"][routeTableName] = struct{}{}
+	// Default vpc route table gets tagged by ensureInternetGatewayAndRoutePublicSubnet
+	expected["route-table"][network.PublicSubnet.Name+"_vpc_default_rt"] = struct{}{}
+	routeTableId, routeTableVpcId, routeTableSubnetId, err := cldaws.GetRouteTableByName(ec2Client, goCtx, lb, routeTableName)
+	if err != nil {
+		return "", err
+	}
+	if routeTableId == "" {
+		report.addMissing("route-table", routeTableName)
+	} else {
+		report.checkAttr("route-table", routeTableName, routeTableId, "vpc", vpcId, routeTableVpcId)
+		report.checkAttr("route-table", routeTableName, routeTableId, "associated_subnet", subnetIds[network.PrivateSubnet.Name], routeTableSubnetId)
+	}
+
+	return vpcId, nil
+}
+
+func (p *AwsDeployProvider) checkSecurityGroupsDrift(lb *l.LogBuilder, report *DriftReport, expected map[string]map[string]struct{}) (map[string]string, error) {
+	sgIds := map[string]string{}
+	for _, sgDef := range p.DeployCtx.Project.SecurityGroups {
+		expected["security-group"][sgDef.Name] = struct{}{}
+		sgId, err := cldaws.GetSecurityGroupIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, sgDef.Name)
+		if err != nil {
+			return nil, err
+		}
+		if sgId == "" {
+			report.addMissing("security-group", sgDef.Name)
+			continue
+		}
+		sgIds[sgDef.Name] = sgId
+
+		rules, err := cldaws.GetSecurityGroupIngressRulesById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, sgId)
+		if err != nil {
+			return nil, err
+		}
+		actualRules := map[string]struct{}{}
+		for _, rule := range rules {
+			actualRules[rule.String()] = struct{}{}
+		}
+		expectedRules := map[string]struct{}{}
+		for _, ruleDef := range sgDef.Rules {
+			rule := cldaws.SecurityGroupIngressRule{Protocol: ruleDef.Protocol, Port: int32(ruleDef.Port), Cidr: ruleDef.RemoteIp}
+			expectedRules[rule.String()] = struct{}{}
+		}
+		for rule := range expectedRules {
+			if _, ok := actualRules[rule]; !ok {
+				report.checkAttr("security-group", sgDef.Name, sgId, "ingress_rule", rule, "")
+			}
+		}
+		for rule := range actualRules {
+			if _, ok := expectedRules[rule]; !ok {
+				report.checkAttr("security-group", sgDef.Name, sgId, "ingress_rule", "", rule)
+			}
+		}
+	}
+	return sgIds, nil
+}
+
+func (p *AwsDeployProvider) checkFloatingIpsDrift(lb *l.LogBuilder, report *DriftReport, expected map[string]map[string]struct{}, bastionInstanceId string) error {
+	for _, ipName := range []string{p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName, p.DeployCtx.Project.Network.PublicSubnet.NatGatewayExternalIpName} {
+		expected["elastic-ip"][ipName] = struct{}{}
+		ipAddress, allocationId, associatedInstanceId, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, ipName)
+		if err != nil {
+			return err
+		}
+		if ipAddress == "" {
+			report.addMissing("elastic-ip", ipName)
+			continue
+		}
+		if ipName == p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName && bastionInstanceId != "" {
+			report.checkAttr("elastic-ip", ipName, allocationId, "associated_instance", bastionInstanceId, associatedInstanceId)
+		}
+	}
+	return nil
+}
+
+// Returns bastion instance id, if any
+func (p *AwsDeployProvider) checkInstancesDrift(lb *l.LogBuilder, report *DriftReport, expected map[string]map[string]struct{}, sgIds map[string]string) (string, error) {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+
+	subnetIds := map[string]string{}
+	bastionInstanceId := ""
+
+	for _, iDef := range p.DeployCtx.Project.Instances {
+		for _, volDef := range iDef.Volumes {
+			expected["volume"][volDef.Name] = struct{}{}
+			volAttrs, err := cldaws.GetVolumeAttributesByName(ec2Client, goCtx, lb, volDef.Name)
+			if err != nil {
+				return "", err
+			}
+			if volAttrs == nil {
+				report.addMissing("volume", volDef.Name)
+				continue
+			}
+			report.checkAttr("volume", volDef.Name, volAttrs.Id, "size", fmt.Sprintf("%d", volDef.Size), fmt.Sprintf("%d", volAttrs.Size))
+			report.checkAttr("volume", volDef.Name, volAttrs.Id, "type", volDef.Type, volAttrs.Type)
+			report.checkAttr("volume", volDef.Name, volAttrs.Id, "availability_zone", volDef.AvailabilityZone, volAttrs.AvailabilityZone)
+		}
+
+		// Snapshot images and their snapshots are named after instances; they are legit, but optional
+		expected["image"][iDef.InstName] = struct{}{}
+		expected["snapshot"][iDef.InstName] = struct{}{}
+
+		expected["instance"][iDef.InstName] = struct{}{}
+		attrs, err := cldaws.GetInstanceAttributesByHostName(ec2Client, goCtx, lb, iDef.InstName)
+		if err != nil {
+			return "", err
+		}
+		if attrs == nil {
+			report.addMissing("instance", iDef.InstName)
+			continue
+		}
+
+		if iDef.ExternalIpAddressName != "" && iDef.ExternalIpAddressName == p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName {
+			bastionInstanceId = attrs.Id
+		}
+
+		if _, ok := subnetIds[iDef.SubnetName]; !ok {
+			subnetId, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, iDef.SubnetName)
+			if err != nil {
+				return "", err
+			}
+			subnetIds[iDef.SubnetName] = subnetId
+		}
+
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "state", string(types.InstanceStateNameRunning), string(attrs.State))
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "flavor", iDef.FlavorName, attrs.InstanceType)
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "ip_address", iDef.IpAddress, attrs.PrivateIpAddress)
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "subnet", subnetIds[iDef.SubnetName], attrs.SubnetId)
+		sort.Strings(attrs.SecurityGroupIds)
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "security_groups", sgIds[iDef.SecurityGroupName], strings.Join(attrs.SecurityGroupIds, ","))
+
+		actualProfile := ""
+		if attrs.InstanceProfileArn != "" {
+			actualProfile = attrs.InstanceProfileArn[strings.LastIndex(attrs.InstanceProfileArn, "/")+1:]
+		}
+		report.checkAttr("instance", iDef.InstName, attrs.Id, "instance_profile", iDef.AssociatedInstanceProfile, actualProfile)
+	}
+	return bastionInstanceId, nil
+}
+
+func (p *AwsDeployProvider) checkDrift() (*DriftReport, l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+
+	report := &DriftReport{DeploymentName: p.DeployCtx.Project.DeploymentName, Items: make([]*DriftItem, 0)}
+	expected := map[string]map[string]struct{}{}
+	for _, resType := range []string{"vpc", "subnet", "internet-gateway", "natgateway", "route-table", "security-group", "elastic-ip", "volume", "instance", "image", "snapshot"} {
+		expected[resType] = map[string]struct{}{}
+	}
+
+	_, err := p.checkNetworkingDrift(lb, report, expected)
+	if err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+
+	sgIds, err := p.checkSecurityGroupsDrift(lb, report, expected)
+	if err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+
+	bastionInstanceId, err := p.checkInstancesDrift(lb, report, expected, sgIds)
+	if err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+
+	if err := p.checkFloatingIpsDrift(lb, report, expected, bastionInstanceId); err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+
+	// Everything tagged with this deployment name, alive, and not expected (or expected once, but found twice) is extra
+	resources, err := cldaws.GetResourcesByTag(p.DeployCtx.Aws.TaggingClient, p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Aws.Config.Region,
+		[]taggingTypes.TagFilter{
+			{Key: aws.String(cld.DeploymentOperatorTagName), Values: []string{cld.DeploymentOperatorTagValue}},
+			{Key: aws.String(cld.DeploymentNameTagName), Values: []string{p.DeployCtx.Project.DeploymentName}}}, true)
+	if err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+	seen := map[string]struct{}{}
+	for _, res := range resources {
+		if res.BilledState == cld.ResourceBilledStateTerminated {
+			continue
+		}
+		expectedNames, ok := expected[res.Type]
+		if !ok {
+			report.addExtra(res.Type, res.Name, res.Id)
+			continue
+		}
+		if _, ok := expectedNames[res.Name]; !ok {
+			report.addExtra(res.Type, res.Name, res.Id)
+			continue
+		}
+		key := res.Type + "/" + res.Name
+		if _, ok := seen[key]; ok {
+			report.addExtra(res.Type, res.Name, res.Id)
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+
+	logMsg, _ := lb.Complete(nil)
+	return report, logMsg, nil
+}
@@ -7,15 +7,17 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 )
 
-func ensureFloatingIp(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, ipName string) (string, error) {
-	existingIp, _, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(ec2Client, goCtx, lb, ipName)
+func ensureFloatingIp(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, ipName string) (string, error) {
+	existingIp, existingAllocationId, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(ec2Client, goCtx, lb, ipName)
 	if err != nil {
 		return "", err
 	}
 	if existingIp != "" {
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "elastic-ip", ipName, existingAllocationId))
 		return existingIp, nil
 	}
 	return cldaws.AllocateFloatingIpByName(ec2Client, goCtx, tags, lb, ipName)
@@ -25,7 +27,7 @@ func (p *AwsDeployProvider) CreateFloatingIps() (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
 
 	bastionIpName := p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName
-	bastionIpAddress, err := ensureFloatingIp(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, bastionIpName)
+	bastionIpAddress, err := ensureFloatingIp(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events, bastionIpName)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -52,7 +54,7 @@ export BASTION_IP=%s
 		p.DeployCtx.Project.SshConfig.BastionExternalIp))
 
 	natgwIpName := p.DeployCtx.Project.Network.PublicSubnet.NatGatewayExternalIpName
-	_, err = ensureFloatingIp(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, natgwIpName)
+	_, err = ensureFloatingIp(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events, natgwIpName)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -121,6 +123,9 @@ func (p *AwsDeployProvider) DeleteFloatingIps() (l.LogMsg, error) {
 // }
 
 func (p *AwsDeployProvider) PopulateInstanceExternalAddressByName() (l.LogMsg, error) {
+	p.externalAddress.mx.Lock()
+	defer p.externalAddress.mx.Unlock()
+
 	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
 	ipAddressName := p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName
 	ipAddress, _, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, ipAddressName)
@@ -132,6 +137,11 @@ func (p *AwsDeployProvider) PopulateInstanceExternalAddressByName() (l.LogMsg, e
 		return lb.Complete(fmt.Errorf("ip address %s was not allocated, did you call create_public_ips?", ipAddressName))
 	}
 
+	// Other workers may be reading the project right now, leave it alone
+	if ipAddress == p.externalAddress.ipAddress {
+		return lb.Complete(nil)
+	}
+
 	// Updates project: ssh config
 	p.DeployCtx.Project.SshConfig.BastionExternalIp = ipAddress
 
@@ -152,6 +162,7 @@ func (p *AwsDeployProvider) PopulateInstanceExternalAddressByName() (l.LogMsg, e
 			iDef.Service.Env[varName] = varValue
 		}
 	}
+	p.externalAddress.ipAddress = ipAddress
 
 	return lb.Complete(nil)
 }
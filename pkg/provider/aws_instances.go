@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 )
@@ -108,6 +109,7 @@ func internalCreate(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string, in
 	if instanceId != "" {
 		if foundInstanceStateByName == types.InstanceStateNameRunning || foundInstanceStateByName == types.InstanceStateNamePending {
 			// Assuming it's the right instance, return ok
+			p.DeployCtx.Events.Emit(event.NewResource(event.TypeResourceSkipped, "instance", instName, instanceId))
 			return nil
 		} else if foundInstanceStateByName != types.InstanceStateNameTerminated {
 			return fmt.Errorf("instance %s(%s) already there and has invalid state %s", instName, instanceId, foundInstanceStateByName)
@@ -387,3 +389,21 @@ func (p *AwsDeployProvider) DeleteSnapshotImage(iNickname string) (l.LogMsg, err
 
 	return lb.Complete(nil)
 }
+
+// Nicknames (sorted) of the instances that are in the project, but not in the cloud (never created or terminated)
+func (p *AwsDeployProvider) getMissingInstances(instances map[string]*prj.InstanceDef) ([]string, l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+	missing := make([]string, 0)
+	for _, iNickname := range sortedInstanceNicknames(instances) {
+		instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, instances[iNickname].InstName)
+		if err != nil {
+			logMsg, err := lb.Complete(err)
+			return nil, logMsg, err
+		}
+		if instanceId == "" || instanceState == types.InstanceStateNameTerminated || instanceState == types.InstanceStateNameShuttingDown {
+			missing = append(missing, iNickname)
+		}
+	}
+	logMsg, _ := lb.Complete(nil)
+	return missing, logMsg, nil
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/audit"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// The lock is an empty placement group named after the deployment. It is not tagged with DeploymentName,
+// so listings and destroy_by_tag do not see it.
+const (
+	lockDeploymentTagName string = "CapideployLockDeployment"
+	lockHolderTagName     string = "CapideployLockHolder"
+	lockOperationTagName  string = "CapideployLockOperation"
+	lockAcquiredTagName   string = "CapideployLockAcquired"
+	lockExpiresTagName    string = "CapideployLockExpires"
+)
+
+const lockAcquireAttempts int = 5
+const lockAcquireRetryInterval time.Duration = 5 * time.Second
+
+// Release and force_unlock must work after Ctrl-C cancelled the main context
+const lockReleaseTimeout time.Duration = 60 * time.Second
+
+func awsLockGroupName(deploymentName string) string {
+	return "capideploy_lock_" + deploymentName
+}
+
+func lockFromTags(deploymentName string, tags map[string]string) *DeploymentLock {
+	return &DeploymentLock{
+		DeploymentName: deploymentName,
+		Holder:         tags[lockHolderTagName],
+		Operation:      tags[lockOperationTagName],
+		AcquiredAt:     tags[lockAcquiredTagName],
+		ExpiresAt:      tags[lockExpiresTagName]}
+}
+
+func (p *AwsDeployProvider) acquireLock(deploymentName string, operation string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := audit.WithDeploymentName(p.DeployCtx.GoCtx, deploymentName)
+	groupName := awsLockGroupName(deploymentName)
+	holder := lockHolder(p.DeployCtx)
+
+	for attempt := 0; attempt < lockAcquireAttempts; attempt++ {
+		now := time.Now()
+		tags := map[string]string{
+			lockDeploymentTagName: deploymentName,
+			lockHolderTagName:     holder,
+			lockOperationTagName:  operation,
+			lockAcquiredTagName:   now.UTC().Format(time.RFC3339),
+			lockExpiresTagName:    now.Add(lockTtl).UTC().Format(time.RFC3339)}
+		_, created, err := cldaws.CreatePlacementGroup(ec2Client, goCtx, tags, lb, groupName)
+		if err != nil {
+			return lb.Complete(fmt.Errorf("cannot lock deployment %s: %s", deploymentName, err.Error()))
+		}
+		if created {
+			lb.Add(fmt.Sprintf("locked deployment %s for %s", deploymentName, operation))
+			return lb.Complete(nil)
+		}
+
+		groupId, state, foundTags, err := cldaws.GetPlacementGroupByName(ec2Client, goCtx, lb, groupName)
+		if err != nil {
+			return lb.Complete(fmt.Errorf("cannot lock deployment %s: %s", deploymentName, err.Error()))
+		}
+		if groupId != "" && state != types.PlacementGroupStateDeleting {
+			lock := lockFromTags(deploymentName, foundTags)
+			if !lock.isExpired(now) {
+				return lb.Complete(fmt.Errorf("%s; if nobody is working on it, run force_unlock %s", lock.String(), deploymentName))
+			}
+			// Another process may have taken the stale lock over, or its holder may have come back and renewed it,
+			// since we looked at it
+			recheckedGroupId, _, recheckedTags, err := cldaws.GetPlacementGroupByName(ec2Client, goCtx, lb, groupName)
+			if err != nil {
+				return lb.Complete(fmt.Errorf("cannot lock deployment %s: %s", deploymentName, err.Error()))
+			}
+			if recheckedGroupId != groupId ||
+				recheckedTags[lockHolderTagName] != foundTags[lockHolderTagName] ||
+				recheckedTags[lockExpiresTagName] != foundTags[lockExpiresTagName] {
+				return lb.Complete(fmt.Errorf("stale lock of deployment %s changed while taking it over, somebody else is locking it, try again later", deploymentName))
+			}
+			lb.AddAlways(fmt.Sprintf("taking over stale lock: %s", lock.String()))
+			if err := cldaws.DeletePlacementGroup(ec2Client, goCtx, lb, groupName); err != nil {
+				return lb.Complete(fmt.Errorf("cannot remove stale lock of deployment %s: %s", deploymentName, err.Error()))
+			}
+		}
+
+		// Just released by its holder, or still being deleted
+		select {
+		case <-goCtx.Done():
+			return lb.Complete(fmt.Errorf("cancelled while locking deployment %s: %s", deploymentName, goCtx.Err().Error()))
+		case <-time.After(lockAcquireRetryInterval):
+		}
+	}
+	return lb.Complete(fmt.Errorf("cannot lock deployment %s after %d attempts, the lock keeps changing hands", deploymentName, lockAcquireAttempts))
+}
+
+// Pushes the expiry further, fails if the lock was force-unlocked or taken over
+func (p *AwsDeployProvider) renewLock(deploymentName string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	groupName := awsLockGroupName(deploymentName)
+
+	goCtx, cancel := context.WithTimeout(audit.WithDeploymentName(context.Background(), deploymentName), lockReleaseTimeout)
+	defer cancel()
+
+	groupId, _, foundTags, err := cldaws.GetPlacementGroupByName(ec2Client, goCtx, lb, groupName)
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cannot renew lock of deployment %s: %s", deploymentName, err.Error()))
+	}
+	if groupId == "" || foundTags[lockHolderTagName] != lockHolder(p.DeployCtx) {
+		return lb.Complete(fmt.Errorf("lost lock of deployment %s, somebody ran force_unlock or took it over", deploymentName))
+	}
+	err = cldaws.TagResource(ec2Client, goCtx, lb, groupId, groupName, map[string]string{lockExpiresTagName: time.Now().Add(lockTtl).UTC().Format(time.RFC3339)})
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cannot renew lock of deployment %s: %s", deploymentName, err.Error()))
+	}
+	return lb.Complete(nil)
+}
+
+// Releases only our own lock, somebody else may have taken it over after force_unlock
+func (p *AwsDeployProvider) releaseLock(deploymentName string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	groupName := awsLockGroupName(deploymentName)
+
+	goCtx, cancel := context.WithTimeout(audit.WithDeploymentName(context.Background(), deploymentName), lockReleaseTimeout)
+	defer cancel()
+
+	groupId, _, foundTags, err := cldaws.GetPlacementGroupByName(ec2Client, goCtx, lb, groupName)
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cannot release lock of deployment %s: %s", deploymentName, err.Error()))
+	}
+	if groupId == "" || foundTags[lockHolderTagName] != lockHolder(p.DeployCtx) {
+		lb.AddAlways(fmt.Sprintf("lock of deployment %s is not ours anymore, leaving it alone", deploymentName))
+		return lb.Complete(nil)
+	}
+	if err := cldaws.DeletePlacementGroup(ec2Client, goCtx, lb, groupName); err != nil {
+		return lb.Complete(fmt.Errorf("cannot release lock of deployment %s, run force_unlock %s: %s", deploymentName, deploymentName, err.Error()))
+	}
+	lb.Add(fmt.Sprintf("unlocked deployment %s", deploymentName))
+	return lb.Complete(nil)
+}
+
+func (p *AwsDeployProvider) forceUnlock(deploymentName string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	groupName := awsLockGroupName(deploymentName)
+
+	goCtx, cancel := context.WithTimeout(audit.WithDeploymentName(context.Background(), deploymentName), lockReleaseTimeout)
+	defer cancel()
+
+	groupId, _, foundTags, err := cldaws.GetPlacementGroupByName(ec2Client, goCtx, lb, groupName)
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cannot unlock deployment %s: %s", deploymentName, err.Error()))
+	}
+	if groupId == "" {
+		lb.AddAlways(fmt.Sprintf("deployment %s is not locked", deploymentName))
+		return lb.Complete(nil)
+	}
+	lb.AddAlways(fmt.Sprintf("removing lock: %s", lockFromTags(deploymentName, foundTags).String()))
+	if err := cldaws.DeletePlacementGroup(ec2Client, goCtx, lb, groupName); err != nil {
+		return lb.Complete(fmt.Errorf("cannot unlock deployment %s: %s", deploymentName, err.Error()))
+	}
+	return lb.Complete(nil)
+}
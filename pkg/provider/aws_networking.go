@@ -7,45 +7,49 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 )
 
-func ensureAwsVpc(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, networkDef *prj.NetworkDef, timeout int) (string, error) {
+func ensureAwsVpc(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, networkDef *prj.NetworkDef, timeout int) (string, error) {
 	foundVpcIdByName, err := cldaws.GetVpcIdByName(ec2Client, goCtx, lb, networkDef.Name)
 	if err != nil {
 		return "", err
 	}
 	if foundVpcIdByName != "" {
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "vpc", networkDef.Name, foundVpcIdByName))
 		return foundVpcIdByName, nil
 	}
 	return cldaws.CreateVpc(ec2Client, goCtx, tags, lb, networkDef.Name, networkDef.Cidr, timeout)
 }
 
-func ensureAwsPrivateSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, networkId string, subnetDef *prj.PrivateSubnetDef) (string, error) {
+func ensureAwsPrivateSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, networkId string, subnetDef *prj.PrivateSubnetDef) (string, error) {
 	foundSubnetIdByName, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, subnetDef.Name)
 	if err != nil {
 		return "", err
 	}
 	if foundSubnetIdByName != "" {
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "subnet", subnetDef.Name, foundSubnetIdByName))
 		return foundSubnetIdByName, nil
 	}
 	return cldaws.CreateSubnet(ec2Client, goCtx, tags, lb, networkId, subnetDef.Name, subnetDef.Cidr, subnetDef.AvailabilityZone)
 }
 
-func ensureAwsPublicSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, networkId string, subnetDef *prj.PublicSubnetDef) (string, error) {
+func ensureAwsPublicSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, networkId string, subnetDef *prj.PublicSubnetDef) (string, error) {
 	foundSubnetIdByName, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, subnetDef.Name)
 	if err != nil {
 		return "", err
 	}
 	if foundSubnetIdByName != "" {
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "subnet", subnetDef.Name, foundSubnetIdByName))
 		return foundSubnetIdByName, nil
 	}
 
 	return cldaws.CreateSubnet(ec2Client, goCtx, tags, lb, networkId, subnetDef.Name, subnetDef.Cidr, subnetDef.AvailabilityZone)
 }
 
-func ensureNatGatewayAndRoutePrivateSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, networkId string, publicSubnetId string, publicSubnetDef *prj.PublicSubnetDef, privateSubnetId string, privateSubnetDef *prj.PrivateSubnetDef, createNatGatewayTimeout int) error {
+func ensureNatGatewayAndRoutePrivateSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, networkId string, publicSubnetId string, publicSubnetDef *prj.PublicSubnetDef, privateSubnetId string, privateSubnetDef *prj.PrivateSubnetDef, createNatGatewayTimeout int) error {
 	_, natGatewayPublicIpAllocationId, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(ec2Client, goCtx, lb, publicSubnetDef.NatGatewayExternalIpName)
 	if err != nil {
 		return err
@@ -63,6 +67,7 @@ func ensureNatGatewayAndRoutePrivateSubnet(ec2Client *ec2.Client, goCtx context.
 		if foundNatGatewayStateByName != types.NatGatewayStateAvailable {
 			return fmt.Errorf("cannot create nat gateway %s, it is already created and has invalid state %s", natGatewayName, foundNatGatewayStateByName)
 		}
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "natgateway", natGatewayName, natGatewayId))
 	} else {
 		natGatewayId, err = cldaws.CreateNatGateway(ec2Client, goCtx, tags, lb, natGatewayName,
 			publicSubnetId,
@@ -115,7 +120,7 @@ func ensureNatGatewayAndRoutePrivateSubnet(ec2Client *ec2.Client, goCtx context.
 	return nil
 }
 
-func ensureInternetGatewayAndRoutePublicSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder,
+func ensureInternetGatewayAndRoutePublicSubnet(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink,
 	routerName string,
 	networkId string, publicSubnetId string, publicSubnetDef *prj.PublicSubnetDef) error {
 
@@ -129,6 +134,7 @@ func ensureInternetGatewayAndRoutePublicSubnet(ec2Client *ec2.Client, goCtx cont
 
 	if foundRouterIdByName != "" {
 		routerId = foundRouterIdByName
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "internet-gateway", routerName, routerId))
 	} else {
 		routerId, err = cldaws.CreateInternetGateway(ec2Client, goCtx, tags, lb, routerName)
 		if err != nil {
@@ -286,30 +292,30 @@ func checkAndDeleteAwsVpcWithRouteTable(ec2Client *ec2.Client, goCtx context.Con
 func (p *AwsDeployProvider) CreateNetworking() (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
 
-	vpcId, err := ensureAwsVpc(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, &p.DeployCtx.Project.Network, p.DeployCtx.Project.Timeouts.CreateNetwork)
+	vpcId, err := ensureAwsVpc(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events, &p.DeployCtx.Project.Network, p.DeployCtx.Project.Timeouts.CreateNetwork)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	privateSubnetId, err := ensureAwsPrivateSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, vpcId, &p.DeployCtx.Project.Network.PrivateSubnet)
+	privateSubnetId, err := ensureAwsPrivateSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events, vpcId, &p.DeployCtx.Project.Network.PrivateSubnet)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	publicSubnetId, err := ensureAwsPublicSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
+	publicSubnetId, err := ensureAwsPublicSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events,
 		vpcId, &p.DeployCtx.Project.Network.PublicSubnet)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	err = ensureInternetGatewayAndRoutePublicSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
+	err = ensureInternetGatewayAndRoutePublicSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events,
 		p.DeployCtx.Project.Network.Router.Name,
 		vpcId, publicSubnetId, &p.DeployCtx.Project.Network.PublicSubnet)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	err = ensureNatGatewayAndRoutePrivateSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
+	err = ensureNatGatewayAndRoutePrivateSubnet(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events,
 		vpcId,
 		publicSubnetId, &p.DeployCtx.Project.Network.PublicSubnet,
 		privateSubnetId, &p.DeployCtx.Project.Network.PrivateSubnet,
@@ -0,0 +1,581 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+// Plan only uses read-only cldaws lookups, nothing is created or deleted here
+
+const (
+	planResFloatingIp       string = "floating_ip"
+	planResFloatingIpAssoc  string = "floating_ip_assoc"
+	planResVpc              string = "vpc"
+	planResSubnet           string = "subnet"
+	planResInternetGateway  string = "internet_gateway"
+	planResNatGateway       string = "nat_gateway"
+	planResRouteTable       string = "route_table"
+	planResSecurityGroup    string = "security_group"
+	planResVolume           string = "volume"
+	planResVolumeAttachment string = "volume_attachment"
+	planResInstance         string = "instance"
+	planResImage            string = "image"
+	planResInstanceServices string = "instance_services"
+)
+
+func (p *AwsDeployProvider) planCreateFloatingIp(pc *planCtx, lb *l.LogBuilder, ipName string) error {
+	existingIp, _, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, ipName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResFloatingIp, ipName, existingIp != "") {
+		pc.add(planResFloatingIp, ipName, PlanActionSkip, fmt.Sprintf("already allocated %s", existingIp))
+	} else {
+		pc.add(planResFloatingIp, ipName, PlanActionCreate, "not allocated")
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planDeleteFloatingIp(pc *planCtx, lb *l.LogBuilder, ipName string) error {
+	existingIp, _, associatedInstanceId, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, ipName)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResFloatingIp, ipName, existingIp != "") {
+		pc.add(planResFloatingIp, ipName, PlanActionFail, "not allocated, cannot release")
+	} else if pc.isThere(planResFloatingIpAssoc, ipName, associatedInstanceId != "") {
+		pc.add(planResFloatingIp, ipName, PlanActionFail, fmt.Sprintf("associated with instance %s", associatedInstanceId))
+	} else {
+		pc.add(planResFloatingIp, ipName, PlanActionDelete, fmt.Sprintf("allocated %s", existingIp))
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planCreateNetworking(pc *planCtx, lb *l.LogBuilder) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+	network := &p.DeployCtx.Project.Network
+
+	vpcId, err := cldaws.GetVpcIdByName(ec2Client, goCtx, lb, network.Name)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResVpc, network.Name, vpcId != "") {
+		pc.add(planResVpc, network.Name, PlanActionSkip, fmt.Sprintf("already there %s", vpcId))
+	} else {
+		pc.add(planResVpc, network.Name, PlanActionCreate, "not found")
+	}
+
+	for _, subnetName := range []string{network.PrivateSubnet.Name, network.PublicSubnet.Name} {
+		subnetId, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, subnetName)
+		if err != nil {
+			return err
+		}
+		if pc.isThere(planResSubnet, subnetName, subnetId != "") {
+			pc.add(planResSubnet, subnetName, PlanActionSkip, fmt.Sprintf("already there %s", subnetId))
+		} else {
+			pc.add(planResSubnet, subnetName, PlanActionCreate, "not found")
+		}
+	}
+
+	routerId, err := cldaws.GetInternetGatewayIdByName(ec2Client, goCtx, lb, network.Router.Name)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResInternetGateway, network.Router.Name, routerId != "") {
+		attachedVpcId, _, err := cldaws.GetInternetGatewayVpcAttachmentById(ec2Client, goCtx, lb, routerId)
+		if err != nil {
+			return err
+		}
+		if attachedVpcId != "" && attachedVpcId != vpcId {
+			pc.add(planResInternetGateway, network.Router.Name, PlanActionFail, fmt.Sprintf("attached to a wrong vpc %s", attachedVpcId))
+		} else {
+			pc.add(planResInternetGateway, network.Router.Name, PlanActionSkip, fmt.Sprintf("already there %s", routerId))
+		}
+	} else {
+		pc.add(planResInternetGateway, network.Router.Name, PlanActionCreate, "not found")
+	}
+
+	natGatewayName := network.PublicSubnet.NatGatewayName
+	natGatewayId, natGatewayState, err := cldaws.GetNatGatewayIdAndStateByName(ec2Client, goCtx, lb, natGatewayName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResNatGateway, natGatewayName, natGatewayId != "" && natGatewayState != types.NatGatewayStateDeleted) {
+		if natGatewayState != types.NatGatewayStateAvailable && !pc.isPlannedCreate(planResNatGateway, natGatewayName) {
+			pc.add(planResNatGateway, natGatewayName, PlanActionFail, fmt.Sprintf("already there %s and has invalid state %s", natGatewayId, natGatewayState))
+		} else {
+			pc.add(planResNatGateway, natGatewayName, PlanActionSkip, fmt.Sprintf("already there %s", natGatewayId))
+		}
+	} else {
+		natGatewayIpName := network.PublicSubnet.NatGatewayExternalIpName
+		natGatewayIp, _, _, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(ec2Client, goCtx, lb, natGatewayIpName)
+		if err != nil {
+			return err
+		}
+		if pc.isThere(planResFloatingIp, natGatewayIpName, natGatewayIp != "") {
+			pc.add(planResNatGateway, natGatewayName, PlanActionCreate, "not found")
+		} else {
+			pc.add(planResNatGateway, natGatewayName, PlanActionFail, fmt.Sprintf("external ip %s not allocated, did you run create_floating_ips?", natGatewayIpName))
+		}
+	}
+
+	routeTableName := network.PrivateSubnet.RouteTableToNatgwName
+	routeTableId, associatedVpcId, _, err := cldaws.GetRouteTableByName(ec2Client, goCtx, lb, routeTableName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResRouteTable, routeTableName, routeTableId != "") {
+		if associatedVpcId != "" && associatedVpcId != vpcId {
+			pc.add(planResRouteTable, routeTableName, PlanActionFail, fmt.Sprintf("associated with wrong network id %s", associatedVpcId))
+		} else {
+			pc.add(planResRouteTable, routeTableName, PlanActionSkip, fmt.Sprintf("already there %s", routeTableId))
+		}
+	} else {
+		pc.add(planResRouteTable, routeTableName, PlanActionCreate, "not found")
+	}
+
+	return nil
+}
+
+func (p *AwsDeployProvider) planDeleteNetworking(pc *planCtx, lb *l.LogBuilder) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+	network := &p.DeployCtx.Project.Network
+
+	natGatewayName := network.PublicSubnet.NatGatewayName
+	natGatewayId, natGatewayState, err := cldaws.GetNatGatewayIdAndStateByName(ec2Client, goCtx, lb, natGatewayName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResNatGateway, natGatewayName, natGatewayId != "" && natGatewayState != types.NatGatewayStateDeleted) {
+		pc.add(planResNatGateway, natGatewayName, PlanActionDelete, fmt.Sprintf("found %s", natGatewayId))
+	} else {
+		pc.add(planResNatGateway, natGatewayName, PlanActionSkip, "nothing to delete")
+	}
+
+	routerId, err := cldaws.GetInternetGatewayIdByName(ec2Client, goCtx, lb, network.Router.Name)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResInternetGateway, network.Router.Name, routerId != "") {
+		pc.add(planResInternetGateway, network.Router.Name, PlanActionDelete, fmt.Sprintf("found %s, will detach it first", routerId))
+	} else {
+		pc.add(planResInternetGateway, network.Router.Name, PlanActionSkip, "nothing to delete")
+	}
+
+	for _, subnetName := range []string{network.PublicSubnet.Name, network.PrivateSubnet.Name} {
+		subnetId, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, subnetName)
+		if err != nil {
+			return err
+		}
+		if pc.isThere(planResSubnet, subnetName, subnetId != "") {
+			pc.add(planResSubnet, subnetName, PlanActionDelete, fmt.Sprintf("found %s", subnetId))
+		} else {
+			pc.add(planResSubnet, subnetName, PlanActionSkip, "nothing to delete")
+		}
+	}
+
+	vpcId, err := cldaws.GetVpcIdByName(ec2Client, goCtx, lb, network.Name)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResVpc, network.Name, vpcId != "") {
+		pc.add(planResVpc, network.Name, PlanActionSkip, "nothing to delete")
+		return nil
+	}
+
+	routeTableName := network.PrivateSubnet.RouteTableToNatgwName
+	routeTableId, associatedVpcId, _, err := cldaws.GetRouteTableByName(ec2Client, goCtx, lb, routeTableName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResRouteTable, routeTableName, routeTableId != "") {
+		if associatedVpcId != "" && associatedVpcId != vpcId {
+			pc.add(planResRouteTable, routeTableName, PlanActionFail, fmt.Sprintf("attached to an unexpected vpc %s instead of %s", associatedVpcId, vpcId))
+		} else {
+			pc.add(planResRouteTable, routeTableName, PlanActionDelete, fmt.Sprintf("found %s", routeTableId))
+		}
+	}
+
+	pc.add(planResVpc, network.Name, PlanActionDelete, fmt.Sprintf("found %s", vpcId))
+	return nil
+}
+
+func (p *AwsDeployProvider) planCreateSecurityGroups(pc *planCtx, lb *l.LogBuilder) error {
+	vpcName := p.DeployCtx.Project.Network.Name
+	vpcId, err := cldaws.GetVpcIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, vpcName)
+	if err != nil {
+		return err
+	}
+	isVpcThere := pc.isThere(planResVpc, vpcName, vpcId != "")
+
+	for _, sgNickname := range sortedMapKeys(p.DeployCtx.Project.SecurityGroups) {
+		sgDef := p.DeployCtx.Project.SecurityGroups[sgNickname]
+		groupId, err := cldaws.GetSecurityGroupIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, sgDef.Name)
+		if err != nil {
+			return err
+		}
+		if pc.isThere(planResSecurityGroup, sgDef.Name, groupId != "") {
+			pc.add(planResSecurityGroup, sgDef.Name, PlanActionSkip, fmt.Sprintf("already there %s", groupId))
+		} else if !isVpcThere {
+			pc.add(planResSecurityGroup, sgDef.Name, PlanActionFail, fmt.Sprintf("vpc %s does not exist", vpcName))
+		} else {
+			pc.add(planResSecurityGroup, sgDef.Name, PlanActionCreate, fmt.Sprintf("not found, %d rules", len(sgDef.Rules)))
+		}
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planDeleteSecurityGroups(pc *planCtx, lb *l.LogBuilder) error {
+	for _, sgNickname := range sortedMapKeys(p.DeployCtx.Project.SecurityGroups) {
+		sgDef := p.DeployCtx.Project.SecurityGroups[sgNickname]
+		groupId, err := cldaws.GetSecurityGroupIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, sgDef.Name)
+		if err != nil {
+			return err
+		}
+		if pc.isThere(planResSecurityGroup, sgDef.Name, groupId != "") {
+			pc.add(planResSecurityGroup, sgDef.Name, PlanActionDelete, fmt.Sprintf("found %s", groupId))
+		} else {
+			pc.add(planResSecurityGroup, sgDef.Name, PlanActionSkip, "nothing to delete")
+		}
+	}
+	return nil
+}
+
+// Returns volume id and attached device, both empty if the volume is not there
+func (p *AwsDeployProvider) planGetVolume(lb *l.LogBuilder, volName string) (string, string, types.VolumeAttachmentState, error) {
+	volId, err := cldaws.GetVolumeIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volName)
+	if err != nil || volId == "" {
+		return "", "", types.VolumeAttachmentStateDetached, err
+	}
+	device, state, err := cldaws.GetVolumeAttachedDeviceById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volId)
+	if err != nil {
+		return "", "", types.VolumeAttachmentStateDetached, err
+	}
+	return volId, device, state, nil
+}
+
+func (p *AwsDeployProvider) planVolume(pc *planCtx, lb *l.LogBuilder, cmd string, iNickname string, volDef *prj.VolumeDef) error {
+	volId, device, attachmentState, err := p.planGetVolume(lb, volDef.Name)
+	if err != nil {
+		return err
+	}
+	isVolThere := pc.isThere(planResVolume, volDef.Name, volId != "")
+	isAttached := pc.isThere(planResVolumeAttachment, volDef.Name, device != "")
+
+	switch cmd {
+	case CmdCreateVolumes:
+		if isVolThere {
+			pc.add(planResVolume, volDef.Name, PlanActionSkip, fmt.Sprintf("already there %s", volId))
+		} else {
+			pc.add(planResVolume, volDef.Name, PlanActionCreate, fmt.Sprintf("not found, %dGB %s in %s", volDef.Size, volDef.Type, volDef.AvailabilityZone))
+		}
+	case CmdDeleteVolumes:
+		if !isVolThere {
+			pc.add(planResVolume, volDef.Name, PlanActionSkip, "nothing to delete")
+		} else if isAttached {
+			pc.add(planResVolume, volDef.Name, PlanActionFail, fmt.Sprintf("attached to %s as %s", iNickname, device))
+		} else {
+			pc.add(planResVolume, volDef.Name, PlanActionDelete, fmt.Sprintf("found %s", volId))
+		}
+	case CmdAttachVolumes:
+		instName := p.DeployCtx.Project.Instances[iNickname].InstName
+		instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, instName)
+		if err != nil {
+			return err
+		}
+		if !isVolThere {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionFail, "volume not found, did you run create_volumes?")
+		} else if isAttached && device != "" && attachmentState != types.VolumeAttachmentStateAttached {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionFail, fmt.Sprintf("already attached to device %s, but has invalid attachment state %s", device, attachmentState))
+		} else if isAttached {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionSkip, fmt.Sprintf("already attached as %s, will re-run mount", device))
+		} else if !pc.isThere(planResInstance, instName, instanceId != "" && instanceState != types.InstanceStateNameTerminated) {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionFail, fmt.Sprintf("instance %s not found", instName))
+		} else {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionCreate, fmt.Sprintf("attach to %s, mount at %s", iNickname, volDef.MountPoint))
+		}
+	case CmdDetachVolumes:
+		if !isVolThere {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionSkip, "volume not found, nothing to detach")
+		} else if !isAttached {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionSkip, "volume not mounted, nothing to detach")
+		} else {
+			pc.add(planResVolumeAttachment, volDef.Name, PlanActionDelete, fmt.Sprintf("umount %s, detach %s from %s", volDef.MountPoint, device, iNickname))
+		}
+	default:
+		return fmt.Errorf("unknown volume command %s", cmd)
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planCreateInstance(pc *planCtx, lb *l.LogBuilder, iNickname string, iDef *prj.InstanceDef, fromSnapshot bool) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+
+	subnetId, err := cldaws.GetSubnetIdByName(ec2Client, goCtx, lb, iDef.SubnetName)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResSubnet, iDef.SubnetName, subnetId != "") {
+		pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("subnet %s does not exist, did you run create_networking?", iDef.SubnetName))
+		return nil
+	}
+
+	sgId, err := cldaws.GetSecurityGroupIdByName(ec2Client, goCtx, lb, iDef.SecurityGroupName)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResSecurityGroup, iDef.SecurityGroupName, sgId != "") {
+		pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("security group %s does not exist, did you run create_security_groups?", iDef.SecurityGroupName))
+		return nil
+	}
+
+	instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(ec2Client, goCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+
+	if iDef.ExternalIpAddressName != "" {
+		_, _, associatedInstanceId, err := cldaws.GetPublicIpAddressAllocationAssociatedInstanceByName(ec2Client, goCtx, lb, iDef.ExternalIpAddressName)
+		if err != nil {
+			return err
+		}
+		if associatedInstanceId != "" && associatedInstanceId != instanceId && pc.isThere(planResFloatingIpAssoc, iDef.ExternalIpAddressName, true) {
+			pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("floating ip %s is already assigned, see instance %s", iDef.ExternalIpAddressName, associatedInstanceId))
+			return nil
+		}
+	}
+
+	if pc.isPlannedCreate(planResInstance, iDef.InstName) {
+		pc.add(planResInstance, iDef.InstName, PlanActionSkip, "created by a previous step")
+		return nil
+	}
+
+	if instanceId != "" && pc.isThere(planResInstance, iDef.InstName, true) {
+		if instanceState == types.InstanceStateNameRunning || instanceState == types.InstanceStateNamePending {
+			pc.add(planResInstance, iDef.InstName, PlanActionSkip, fmt.Sprintf("already there %s, %s", instanceId, instanceState))
+			return nil
+		} else if instanceState != types.InstanceStateNameTerminated {
+			pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("already there %s and has invalid state %s", instanceId, instanceState))
+			return nil
+		}
+	}
+
+	if fromSnapshot {
+		imageId, imageState, _, err := cldaws.GetImageInfoByName(ec2Client, goCtx, lb, iDef.InstName)
+		if err != nil {
+			return err
+		}
+		if !pc.isThere(planResImage, iDef.InstName, imageId != "" && imageState != types.ImageStateDeregistered) {
+			pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("snapshot image %s not found", iDef.InstName))
+			return nil
+		}
+		if !pc.isPlannedCreate(planResImage, iDef.InstName) && imageState != types.ImageStateAvailable {
+			pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("snapshot image %s has invalid state %s", iDef.InstName, imageState))
+			return nil
+		}
+		pc.add(planResInstance, iDef.InstName, PlanActionCreate, fmt.Sprintf("from snapshot image %s, %s, %s", imageId, iDef.FlavorName, iDef.IpAddress))
+	} else {
+		pc.add(planResInstance, iDef.InstName, PlanActionCreate, fmt.Sprintf("%s, %s, %s", iDef.FlavorName, iDef.ImageId, iDef.IpAddress))
+	}
+
+	if iDef.ExternalIpAddressName != "" {
+		pc.markCreated(planResFloatingIpAssoc, iDef.ExternalIpAddressName)
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planDeleteInstance(pc *planCtx, lb *l.LogBuilder, iNickname string, iDef *prj.InstanceDef, ignoreAttachedVolumes bool) error {
+	if !ignoreAttachedVolumes {
+		for _, volNickname := range sortedMapKeys(iDef.Volumes) {
+			volDef := iDef.Volumes[volNickname]
+			volId, device, _, err := p.planGetVolume(lb, volDef.Name)
+			if err != nil {
+				return err
+			}
+			if volId != "" && pc.isThere(planResVolumeAttachment, volDef.Name, device != "") {
+				pc.add(planResInstance, iDef.InstName, PlanActionFail, fmt.Sprintf("detach volumes first: %s(%s)", volDef.Name, device))
+				return nil
+			}
+		}
+	}
+
+	instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+
+	if !pc.isThere(planResInstance, iDef.InstName, instanceId != "") {
+		pc.add(planResInstance, iDef.InstName, PlanActionSkip, "instance not found")
+	} else if instanceState == types.InstanceStateNameTerminated && !pc.isPlannedCreate(planResInstance, iDef.InstName) {
+		pc.add(planResInstance, iDef.InstName, PlanActionSkip, "already terminated")
+	} else {
+		pc.add(planResInstance, iDef.InstName, PlanActionDelete, fmt.Sprintf("found %s, %s", instanceId, instanceState))
+		if iDef.ExternalIpAddressName != "" {
+			pc.markDeleted(planResFloatingIpAssoc, iDef.ExternalIpAddressName)
+		}
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planCreateSnapshotImage(pc *planCtx, lb *l.LogBuilder, iDef *prj.InstanceDef) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+
+	imageId, imageState, _, err := cldaws.GetImageInfoByName(ec2Client, goCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+	if pc.isThere(planResImage, iDef.InstName, imageId != "" && imageState != types.ImageStateDeregistered) {
+		pc.add(planResImage, iDef.InstName, PlanActionFail, fmt.Sprintf("delete/deregister existing image %s first", imageId))
+		return nil
+	}
+
+	for _, volNickname := range sortedMapKeys(iDef.Volumes) {
+		volDef := iDef.Volumes[volNickname]
+		volId, device, _, err := p.planGetVolume(lb, volDef.Name)
+		if err != nil {
+			return err
+		}
+		if volId != "" && pc.isThere(planResVolumeAttachment, volDef.Name, device != "") {
+			pc.add(planResImage, iDef.InstName, PlanActionFail, fmt.Sprintf("detach volumes first: %s(%s)", volDef.Name, device))
+			return nil
+		}
+	}
+
+	instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(ec2Client, goCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResInstance, iDef.InstName, instanceId != "" && instanceState != types.InstanceStateNameTerminated) {
+		pc.add(planResImage, iDef.InstName, PlanActionFail, "instance not found")
+	} else if !pc.isPlannedCreate(planResInstance, iDef.InstName) && instanceState != types.InstanceStateNameRunning && instanceState != types.InstanceStateNameStopped {
+		pc.add(planResImage, iDef.InstName, PlanActionFail, fmt.Sprintf("instance state is %s, expected running", instanceState))
+	} else {
+		pc.add(planResImage, iDef.InstName, PlanActionCreate, fmt.Sprintf("from instance %s, will stop it first", instanceId))
+	}
+	return nil
+}
+
+func (p *AwsDeployProvider) planDeleteSnapshotImage(pc *planCtx, lb *l.LogBuilder, iDef *prj.InstanceDef) error {
+	imageId, imageState, _, err := cldaws.GetImageInfoByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+	if !pc.isThere(planResImage, iDef.InstName, imageId != "") {
+		pc.add(planResImage, iDef.InstName, PlanActionSkip, "nothing to delete")
+	} else if imageState == types.ImageStateDeregistered && !pc.isPlannedCreate(planResImage, iDef.InstName) {
+		pc.add(planResImage, iDef.InstName, PlanActionSkip, "already deregistered")
+	} else {
+		pc.add(planResImage, iDef.InstName, PlanActionDelete, fmt.Sprintf("found %s, will delete its snapshot too", imageId))
+	}
+	return nil
+}
+
+// Commands that run scripts/commands on instances do not touch cloud resources, just make sure the instance is there
+func (p *AwsDeployProvider) planRunOnInstance(pc *planCtx, lb *l.LogBuilder, cmd string, iNickname string, iDef *prj.InstanceDef) error {
+	instanceId, instanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+	if err != nil {
+		return err
+	}
+	if pc.isPlannedCreate(planResInstance, iDef.InstName) || (pc.isThere(planResInstance, iDef.InstName, instanceId != "") && instanceState == types.InstanceStateNameRunning) {
+		pc.add(planResInstanceServices, iNickname, PlanActionRun, fmt.Sprintf("%s on %s", cmd, iDef.BestIpAddress()))
+	} else {
+		pc.add(planResInstanceServices, iNickname, PlanActionFail, fmt.Sprintf("instance %s is not running", iDef.InstName))
+	}
+	return nil
+}
+
+// Plan items come out in the same order every run, so plans can be diffed
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *AwsDeployProvider) planSimpleCmd(pc *planCtx, cmd string, instances map[string]*prj.InstanceDef, execArgs *ExecArgs) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+cmd, p.DeployCtx.IsVerbose)
+
+	var err error
+	switch cmd {
+	case CmdCreateFloatingIps:
+		err = p.planCreateFloatingIp(pc, lb, p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName)
+		if err == nil {
+			err = p.planCreateFloatingIp(pc, lb, p.DeployCtx.Project.Network.PublicSubnet.NatGatewayExternalIpName)
+		}
+	case CmdDeleteFloatingIps:
+		err = p.planDeleteFloatingIp(pc, lb, p.DeployCtx.Project.SshConfig.BastionExternalIpAddressName)
+		if err == nil {
+			err = p.planDeleteFloatingIp(pc, lb, p.DeployCtx.Project.Network.PublicSubnet.NatGatewayExternalIpName)
+		}
+	case CmdCreateNetworking:
+		err = p.planCreateNetworking(pc, lb)
+	case CmdDeleteNetworking:
+		err = p.planDeleteNetworking(pc, lb)
+	case CmdCreateSecurityGroups:
+		err = p.planCreateSecurityGroups(pc, lb)
+	case CmdDeleteSecurityGroups:
+		err = p.planDeleteSecurityGroups(pc, lb)
+	case CmdCreateVolumes, CmdDeleteVolumes, CmdAttachVolumes, CmdDetachVolumes:
+	volLoop:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			for _, volNickname := range sortedMapKeys(instances[iNickname].Volumes) {
+				if err = p.planVolume(pc, lb, cmd, iNickname, instances[iNickname].Volumes[volNickname]); err != nil {
+					break volLoop
+				}
+			}
+		}
+	case CmdCreateInstances, CmdCreateInstancesFromSnapshotImages:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			if err = p.planCreateInstance(pc, lb, iNickname, instances[iNickname], cmd == CmdCreateInstancesFromSnapshotImages); err != nil {
+				break
+			}
+		}
+	case CmdDeleteInstances:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			if err = p.planDeleteInstance(pc, lb, iNickname, instances[iNickname], execArgs.IgnoreAttachedVolumes); err != nil {
+				break
+			}
+		}
+	case CmdCreateSnapshotImages:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			if err = p.planCreateSnapshotImage(pc, lb, instances[iNickname]); err != nil {
+				break
+			}
+		}
+	case CmdDeleteSnapshotImages:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			if err = p.planDeleteSnapshotImage(pc, lb, instances[iNickname]); err != nil {
+				break
+			}
+		}
+	case CmdPingInstances, CmdInstallServices, CmdConfigServices, CmdStartServices, CmdStopServices, CmdUploadFiles, CmdDownloadFiles, CmdWaitCassNodesJoined, CmdWaitServicesReady, CmdReinstallCapillaries:
+		for _, iNickname := range sortedInstanceNicknames(instances) {
+			if err = p.planRunOnInstance(pc, lb, cmd, iNickname, instances[iNickname]); err != nil {
+				break
+			}
+		}
+	case CmdCheckCassStatus:
+		for _, iNickname := range sortedInstanceNicknames(p.DeployCtx.Project.Instances) {
+			if iDef := p.DeployCtx.Project.Instances[iNickname]; iDef.Purpose == string(prj.InstancePurposeCassandra) {
+				if err = p.planRunOnInstance(pc, lb, cmd, iNickname, iDef); err != nil {
+					break
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("cannot plan unknown cmd %s", cmd)
+	}
+
+	return lb.Complete(err)
+}
@@ -1,6 +1,9 @@
 package provider
 
 import (
+	"context"
+	"sync"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
@@ -17,24 +20,97 @@ type AwsCtx struct {
 
 // Everything below is generic. This type will support DeployProvider (public) and deployProviderImpl (internal)
 
+// Independent steps of a combined command run at the same time, and each of them needs bastion ip in the project.
+// The project is written only when the address is populated for the first time or changes, so workers
+// that have populated it already can read the project without holding the mutex.
+type externalAddressState struct {
+	mx        sync.Mutex
+	ipAddress string
+}
+
 type AwsDeployProvider struct {
-	DeployCtx *DeployCtx
+	DeployCtx       *DeployCtx
+	externalAddress *externalAddressState // Shared by copies made with WithContext, they share the project
 }
 
 func (p *AwsDeployProvider) getDeployCtx() *DeployCtx {
 	return p.DeployCtx
 }
 
+// For contexts derived from p.DeployCtx.GoCtx, they carry its hooks already
+func (p *AwsDeployProvider) withGoCtx(goCtx context.Context) deployProviderImpl {
+	deployCtx := *p.DeployCtx
+	deployCtx.GoCtx = goCtx
+	return &AwsDeployProvider{DeployCtx: &deployCtx, externalAddress: p.externalAddress}
+}
+
 // DeployProvider implementation
 
-func (p *AwsDeployProvider) ListDeployments(cOut chan<- string, cErr chan<- string) (map[string]int, error) {
-	return genericListDeployments(p, cOut, cErr)
+// Shares project, clients and ssh limits with p, only the context is replaced
+func (p *AwsDeployProvider) WithContext(goCtx context.Context) DeployProvider {
+	deployCtx := *p.DeployCtx
+	deployCtx.GoCtx = deployCtx.attachCtxHooks(goCtx)
+	return &AwsDeployProvider{DeployCtx: &deployCtx, externalAddress: p.externalAddress}
+}
+
+// Closes the audit journal shared with all copies made by WithContext, call it once when done with all of them
+func (p *AwsDeployProvider) Close() error {
+	return genericClose(p, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ListDeployments(withState bool) ([]*cld.Resource, error) {
+	return genericListDeployments(p, withState, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ListDeploymentResources() ([]*cld.Resource, error) {
+	return genericListDeploymentResources(p, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) CheckDrift() (*DriftReport, error) {
+	return genericCheckDrift(p, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ExecCmd(cmd string, nicknames string, execArgs *ExecArgs) ([]*InstanceCmdResult, error) {
+	return genericExecCmd(p, cmd, nicknames, execArgs, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ExecCmdWithNoResult(cmd string, nicknames string, execArgs *ExecArgs) error {
+	_, err := genericExecCmd(p, cmd, nicknames, execArgs, p.DeployCtx.Events)
+	return err
+}
+
+func (p *AwsDeployProvider) PlanCmd(cmd string, nicknames string, execArgs *ExecArgs) ([]*PlanItem, error) {
+	return genericPlanCmd(p, cmd, nicknames, execArgs, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) Ssh(nickname string, remoteCmd string) (int, error) {
+	return genericSsh(p, nickname, remoteCmd, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ExecOnInstances(nicknames string, shellCmd string) ([]*InstanceExecResult, error) {
+	return genericExecOnInstances(p, nicknames, shellCmd, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) Tunnel(spec string) error {
+	return genericTunnel(p, spec, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ExportInventory(dstDir string) error {
+	return genericExportInventory(p, dstDir, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) Health(nicknames string, waitSeconds int) ([]*HealthCheckResult, error) {
+	return genericHealth(p, nicknames, waitSeconds, p.DeployCtx.Events)
+}
+
+func (p *AwsDeployProvider) ReapExpired(doDelete bool) ([]*cld.DeploymentSummary, error) {
+	return genericReapExpired(p, doDelete, p.DeployCtx.Events)
 }
 
-func (p *AwsDeployProvider) ListDeploymentResources(cOut chan<- string, cErr chan<- string) ([]*cld.Resource, error) {
-	return genericListDeploymentResources(p, cOut, cErr)
+func (p *AwsDeployProvider) DestroyByTag(deploymentName string, confirmedName string, planOnly bool) ([]*PlanItem, error) {
+	return genericDestroyByTag(p, deploymentName, confirmedName, planOnly, p.DeployCtx.Events)
 }
 
-func (p *AwsDeployProvider) ExecCmdWithNoResult(cmd string, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
-	return genericExecCmdWithNoResult(p, cmd, nicknames, execArgs, cOut, cErr)
+func (p *AwsDeployProvider) ForceUnlock(deploymentName string) error {
+	return genericForceUnlock(p, deploymentName, p.DeployCtx.Events)
 }
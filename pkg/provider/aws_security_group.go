@@ -6,17 +6,20 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 )
 
-func createAwsSecurityGroup(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, sgDef *prj.SecurityGroupDef, vpcId string) error {
+func createAwsSecurityGroup(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, events event.Sink, sgDef *prj.SecurityGroupDef, vpcId string) error {
 	groupId, err := cldaws.GetSecurityGroupIdByName(ec2Client, goCtx, lb, sgDef.Name)
 	if err != nil {
 		return err
 	}
 
-	if groupId == "" {
+	if groupId != "" {
+		events.Emit(event.NewResource(event.TypeResourceSkipped, "security-group", sgDef.Name, groupId))
+	} else {
 		groupId, err = cldaws.CreateSecurityGroup(ec2Client, goCtx, tags, lb, sgDef.Name, vpcId)
 		if err != nil {
 			return err
@@ -45,7 +48,7 @@ func (p *AwsDeployProvider) CreateSecurityGroups() (l.LogMsg, error) {
 	}
 
 	for _, sgDef := range p.DeployCtx.Project.SecurityGroups {
-		err := createAwsSecurityGroup(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, sgDef, vpcId)
+		err := createAwsSecurityGroup(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, p.DeployCtx.Events, sgDef, vpcId)
 		if err != nil {
 			return lb.Complete(err)
 		}
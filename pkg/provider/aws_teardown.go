@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	taggingTypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+// Dependency order for tag-only teardown: each type can be deleted once all types before it are gone
+var teardownTypeOrder []string = []string{
+	"instance",
+	"image",
+	"snapshot",
+	"volume",
+	"natgateway",
+	"elastic-ip",
+	"security-group",
+	"subnet",
+	"route-table",
+	"internet-gateway",
+	"vpc"}
+
+// AWS releases network interfaces and volume attachments of deleted instances and NAT gateways a bit later
+const teardownDependencyTimeout time.Duration = 300 * time.Second
+const teardownDependencyPollInterval time.Duration = 10 * time.Second
+
+func isTeardownDependencyErr(err error) bool {
+	return strings.Contains(err.Error(), "DependencyViolation") || strings.Contains(err.Error(), "VolumeInUse") || strings.Contains(err.Error(), "InvalidIPAddress.InUse")
+}
+
+func (p *AwsDeployProvider) deleteWithDependencyRetry(lb *l.LogBuilder, r *cld.Resource, deleteFunc func() error) error {
+	startTime := time.Now()
+	for {
+		err := deleteFunc()
+		if err == nil || !isTeardownDependencyErr(err) || time.Since(startTime) > teardownDependencyTimeout {
+			return err
+		}
+		lb.Add(fmt.Sprintf("%s %s (%s) still has dependencies, retrying: %s", r.Type, r.Name, r.Id, err.Error()))
+		select {
+		case <-p.DeployCtx.GoCtx.Done():
+			return fmt.Errorf("cancelled while deleting %s %s: %s", r.Type, r.Id, p.DeployCtx.GoCtx.Err().Error())
+		case <-time.After(teardownDependencyPollInterval):
+		}
+	}
+}
+
+// Other deployments may come from projects with different timeouts, they get capideploy defaults
+func (p *AwsDeployProvider) teardownTimeouts(deploymentName string) *prj.ExecTimeouts {
+	if deploymentName == p.DeployCtx.Project.DeploymentName {
+		return &p.DeployCtx.Project.Timeouts
+	}
+	timeouts := &prj.ExecTimeouts{}
+	timeouts.InitDefaults()
+	return timeouts
+}
+
+func (p *AwsDeployProvider) deleteTaggedResource(lb *l.LogBuilder, r *cld.Resource, timeouts *prj.ExecTimeouts) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+	switch r.Type {
+	case "instance":
+		return cldaws.DeleteInstance(ec2Client, goCtx, lb, r.Id, timeouts.DeleteInstance)
+	case "image":
+		return cldaws.DeregisterImage(ec2Client, goCtx, lb, r.Id)
+	case "snapshot":
+		return cldaws.DeleteSnapshot(ec2Client, goCtx, lb, r.Id)
+	case "volume":
+		return cldaws.DeleteVolume(ec2Client, goCtx, lb, r.Id)
+	case "natgateway":
+		return cldaws.DeleteNatGateway(ec2Client, goCtx, lb, r.Id, timeouts.DeleteNatGateway)
+	case "elastic-ip":
+		return cldaws.ReleaseFloatingIpByAllocationId(ec2Client, goCtx, lb, r.Id)
+	case "security-group":
+		return cldaws.DeleteSecurityGroup(ec2Client, goCtx, lb, r.Id)
+	case "subnet":
+		return cldaws.DeleteSubnet(ec2Client, goCtx, lb, r.Id)
+	case "route-table":
+		return cldaws.DeleteRouteTable(ec2Client, goCtx, lb, r.Id)
+	case "internet-gateway":
+		vpcId, _, err := cldaws.GetInternetGatewayVpcAttachmentById(ec2Client, goCtx, lb, r.Id)
+		if err != nil {
+			return err
+		}
+		if vpcId != "" {
+			if err := cldaws.DetachInternetGatewayFromVpc(ec2Client, goCtx, lb, r.Id, vpcId); err != nil {
+				return err
+			}
+		}
+		return cldaws.DeleteInternetGateway(ec2Client, goCtx, lb, r.Id)
+	case "vpc":
+		return cldaws.DeleteVpc(ec2Client, goCtx, lb, r.Id)
+	default:
+		return fmt.Errorf("do not know how to delete %s %s (%s)", r.Type, r.Name, r.Id)
+	}
+}
+
+// Resources of the deployment found by DeploymentName tag, grouped by type in teardown order. Resources that are gone already
+// are left out, resources of types capideploy does not create are returned separately.
+func (p *AwsDeployProvider) getTeardownResources(lb *l.LogBuilder, deploymentName string) ([][]*cld.Resource, []*cld.Resource, error) {
+	if strings.TrimSpace(deploymentName) == "" {
+		return nil, nil, fmt.Errorf("cannot tear down a deployment with empty name")
+	}
+	resources, err := cldaws.GetResourcesByTag(p.DeployCtx.Aws.TaggingClient, p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Aws.Config.Region,
+		[]taggingTypes.TagFilter{
+			{Key: aws.String(cld.DeploymentOperatorTagName), Values: []string{cld.DeploymentOperatorTagValue}},
+			{Key: aws.String(cld.DeploymentNameTagName), Values: []string{deploymentName}}}, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list resources of deployment %s: %s", deploymentName, err.Error())
+	}
+
+	typeIdx := map[string]int{}
+	for i, resType := range teardownTypeOrder {
+		typeIdx[resType] = i
+	}
+	stages := make([][]*cld.Resource, len(teardownTypeOrder))
+	unknown := make([]*cld.Resource, 0)
+	for _, r := range resources {
+		if r.BilledState == cld.ResourceBilledStateTerminated {
+			continue
+		}
+		i, ok := typeIdx[r.Type]
+		if !ok || r.Svc != "ec2" {
+			unknown = append(unknown, r)
+			continue
+		}
+		stages[i] = append(stages[i], r)
+	}
+	return stages, unknown, nil
+}
+
+// Deletes everything tagged with this deployment name, no project file needed. Instances go in parallel,
+// everything else one by one. Stops at the first stage that fails, running it again picks up what is left.
+func (p *AwsDeployProvider) deleteDeploymentByTag(deploymentName string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+
+	stages, unknown, err := p.getTeardownResources(lb, deploymentName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	for _, r := range unknown {
+		lb.AddAlways(fmt.Sprintf("leaving %s %s %s (%s) alone, delete it manually", r.Svc, r.Type, r.Name, r.Id))
+	}
+	timeouts := p.teardownTimeouts(deploymentName)
+
+	for _, stage := range stages {
+		if len(stage) == 0 {
+			continue
+		}
+		if stage[0].Type == "instance" {
+			var wg sync.WaitGroup
+			var mx sync.Mutex
+			errs := make([]string, 0)
+			for _, r := range stage {
+				wg.Add(1)
+				go func(r *cld.Resource) {
+					defer wg.Done()
+					instLb := l.NewLogBuilder("delete instance "+r.Name, p.DeployCtx.IsVerbose)
+					err := p.deleteTaggedResource(instLb, r, timeouts)
+					logMsg, _ := instLb.Complete(err)
+					mx.Lock()
+					lb.Add(string(logMsg))
+					if err != nil {
+						errs = append(errs, err.Error())
+					}
+					mx.Unlock()
+				}(r)
+			}
+			wg.Wait()
+			if len(errs) > 0 {
+				return lb.Complete(fmt.Errorf("cannot delete instances of %s: %s", deploymentName, strings.Join(errs, "; ")))
+			}
+			lb.AddAlways(fmt.Sprintf("deleted %d instance(s) of %s", len(stage), deploymentName))
+			continue
+		}
+		for _, r := range stage {
+			if err := p.deleteWithDependencyRetry(lb, r, func() error { return p.deleteTaggedResource(lb, r, timeouts) }); err != nil {
+				return lb.Complete(fmt.Errorf("cannot delete %s %s (%s) of %s: %s", r.Type, r.Name, r.Id, deploymentName, err.Error()))
+			}
+			lb.AddAlways(fmt.Sprintf("deleted %s %s (%s)", r.Type, r.Name, r.Id))
+		}
+	}
+	return lb.Complete(nil)
+}
+
+// What deleteDeploymentByTag would do, in the same order
+func (p *AwsDeployProvider) planDeleteDeploymentByTag(deploymentName string) ([]*PlanItem, l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+deploymentName, p.DeployCtx.IsVerbose)
+
+	stages, unknown, err := p.getTeardownResources(lb, deploymentName)
+	if err != nil {
+		logMsg, err := lb.Complete(err)
+		return nil, logMsg, err
+	}
+	items := make([]*PlanItem, 0)
+	for _, stage := range stages {
+		for _, r := range stage {
+			items = append(items, &PlanItem{CmdDestroyByTag, r.Type, r.Name, PlanActionDelete, fmt.Sprintf("%s, %s", r.Id, r.State)})
+		}
+	}
+	for _, r := range unknown {
+		items = append(items, &PlanItem{CmdDestroyByTag, r.Type, r.Name, PlanActionSkip, fmt.Sprintf("%s %s, not created by capideploy, delete manually", r.Svc, r.Id)})
+	}
+	logMsg, _ := lb.Complete(nil)
+	return items, logMsg, nil
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
@@ -23,6 +24,7 @@ func (p *AwsDeployProvider) CreateVolume(iNickname string, volNickname string) (
 
 	if foundVolIdByName != "" {
 		lb.Add(fmt.Sprintf("volume %s(%s) already there", volDef.Name, foundVolIdByName))
+		p.DeployCtx.Events.Emit(event.NewResource(event.TypeResourceSkipped, "volume", volDef.Name, foundVolIdByName))
 		return lb.Complete(nil)
 	}
 
@@ -123,6 +125,7 @@ func (p *AwsDeployProvider) AttachVolume(iNickname string, volNickname string) (
 	}
 
 	deviceBlockId, er := rexec.ExecSshAndReturnLastLine(
+		p.DeployCtx.GoCtx,
 		p.DeployCtx.Project.SshConfig,
 		p.DeployCtx.Project.Instances[iNickname].BestIpAddress(),
 		fmt.Sprintf("%s\ninit_volume_attachment %s %s %d '%s'",
@@ -171,6 +174,7 @@ func (p *AwsDeployProvider) DetachVolume(iNickname string, volNickname string) (
 	// Unmount
 
 	er := rexec.ExecSsh(
+		p.DeployCtx.GoCtx,
 		p.DeployCtx.Project.SshConfig,
 		p.DeployCtx.Project.Instances[iNickname].BestIpAddress(),
 		fmt.Sprintf("sudo umount -d %s", volDef.MountPoint), map[string]string{})
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+// Local journal of a combined command (or workflow) run, so a failed run can be resumed with -resume
+
+type CheckpointStep struct {
+	Cmd             string         `json:"cmd"`
+	Nicknames       string         `json:"nicknames"`
+	OnFail          StopOnFailType `json:"on_fail"`
+	Id              string         `json:"id,omitempty"`
+	DependsOn       []string       `json:"depends_on,omitempty"`
+	Done            bool           `json:"done"`
+	FailedNicknames []string       `json:"failed_nicknames,omitempty"` // Empty for a failed step means "retry the whole step"
+}
+
+type Checkpoint struct {
+	DeploymentName string            `json:"deployment_name"`
+	Cmd            string            `json:"cmd"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	Steps          []*CheckpointStep `json:"steps"`
+}
+
+var checkpointNicknamesRegex = regexp.MustCompile(`^[A-Za-z0-9_,-]{1,64}$`)
+
+// Next to the project file, one per command and selector: runs with different selectors do not share a checkpoint.
+// Selectors that do not make a good file name, like cass*, are hashed.
+func checkpointFilePath(project *prj.Project, cmd string, nicknames string) string {
+	fileName := fmt.Sprintf("%s.%s", project.DeploymentName, cmd)
+	if checkpointNicknamesRegex.MatchString(nicknames) {
+		fileName += "." + nicknames
+	} else if nicknames != "" {
+		nicknamesHash := sha256.Sum256([]byte(nicknames))
+		fileName += "." + hex.EncodeToString(nicknamesHash[:4])
+	}
+	return filepath.Join(project.ProjectFileDirPath, fileName+".checkpoint.json")
+}
+
+func newCheckpoint(deploymentName string, cmd string, combinedCmdCallSeq []CombinedCmdCall) *Checkpoint {
+	cp := Checkpoint{DeploymentName: deploymentName, Cmd: cmd, Steps: make([]*CheckpointStep, len(combinedCmdCallSeq))}
+	for stepIdx, cmdCall := range combinedCmdCallSeq {
+		cp.Steps[stepIdx] = &CheckpointStep{Cmd: cmdCall.Cmd, Nicknames: cmdCall.Nicknames, OnFail: cmdCall.OnFail, Id: cmdCall.Id, DependsOn: cmdCall.DependsOn}
+	}
+	return &cp
+}
+
+// Returns nil checkpoint if there is no file
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	cpBytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read checkpoint %s: %s", path, err.Error())
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(cpBytes, &cp); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %s: %s", path, err.Error())
+	}
+	return &cp, nil
+}
+
+func (cp *Checkpoint) save(path string) error {
+	cp.UpdatedAt = time.Now()
+	cpBytes, err := json.MarshalIndent(cp, "", "    ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint %s: %s", path, err.Error())
+	}
+	if err := os.WriteFile(path, cpBytes, 0644); err != nil {
+		return fmt.Errorf("cannot write checkpoint %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (c *CombinedCmdCall) String() string {
+	s := fmt.Sprintf("%s(%s)", c.Cmd, c.Nicknames)
+	if c.OnFail == IgnoreFail {
+		s += " ignoring failure"
+	}
+	if c.Id != "" {
+		s += " as " + c.Id
+	}
+	if len(c.DependsOn) > 0 {
+		s += " after " + strings.Join(c.DependsOn, ",")
+	}
+	return s
+}
+
+func (c *CombinedCmdCall) equals(other *CombinedCmdCall) bool {
+	if c.Cmd != other.Cmd || c.Nicknames != other.Nicknames || c.OnFail != other.OnFail || c.Id != other.Id || len(c.DependsOn) != len(other.DependsOn) {
+		return false
+	}
+	for depIdx, dep := range c.DependsOn {
+		if other.DependsOn[depIdx] != dep {
+			return false
+		}
+	}
+	return true
+}
+
+// A checkpoint can be used only if it was written for the very same steps: commands, nicknames, failure handling and dependencies
+func (cp *Checkpoint) matches(combinedCmdCallSeq []CombinedCmdCall) error {
+	if len(cp.Steps) != len(combinedCmdCallSeq) {
+		return fmt.Errorf("checkpoint has %d steps, but %s has %d", len(cp.Steps), cp.Cmd, len(combinedCmdCallSeq))
+	}
+	for stepIdx, cmdCall := range combinedCmdCallSeq {
+		if stepCall := cp.Steps[stepIdx].cmdCall(); !stepCall.equals(&cmdCall) {
+			return fmt.Errorf("checkpoint step %d is %s, expected %s", stepIdx, stepCall.String(), cmdCall.String())
+		}
+	}
+	return nil
+}
+
+// Steps as they were journaled, to be run one after another. Used when the original sequence cannot be rebuilt,
+// because it depended on the state of the deployment the previous run has changed.
+func (cp *Checkpoint) cmdCallSeq() []CombinedCmdCall {
+	combinedCmdCallSeq := make([]CombinedCmdCall, len(cp.Steps))
+	for stepIdx, step := range cp.Steps {
+		combinedCmdCallSeq[stepIdx] = step.cmdCall()
+	}
+	return combinedCmdCallSeq
+}
+
+func (step *CheckpointStep) cmdCall() CombinedCmdCall {
+	return CombinedCmdCall{step.Cmd, step.Nicknames, step.OnFail, step.Id, step.DependsOn}
+}
+
+// Nicknames to run the step with: all of them, or only those that failed last time
+func (step *CheckpointStep) nicknamesToRun() string {
+	if len(step.FailedNicknames) > 0 {
+		return strings.Join(step.FailedNicknames, ",")
+	}
+	return step.Nicknames
+}
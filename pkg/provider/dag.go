@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+)
+
+// Returns, for each step, the indexes of the steps it waits for.
+// If no step in the sequence has an Id, steps run one after another.
+// Otherwise, each step waits only for the steps listed in its DependsOn, and those must be defined earlier,
+// so the sequence order is always a valid execution order and there are no cycles.
+func getCmdCallDeps(combinedCmdCallSeq []CombinedCmdCall) ([][]int, error) {
+	deps := make([][]int, len(combinedCmdCallSeq))
+
+	isDag := false
+	for _, cmdCall := range combinedCmdCallSeq {
+		if cmdCall.Id != "" {
+			isDag = true
+			break
+		}
+	}
+
+	if !isDag {
+		for stepIdx := range combinedCmdCallSeq {
+			if stepIdx > 0 {
+				deps[stepIdx] = []int{stepIdx - 1}
+			}
+		}
+		return deps, nil
+	}
+
+	idToIdx := map[string]int{}
+	for stepIdx, cmdCall := range combinedCmdCallSeq {
+		deps[stepIdx] = make([]int, 0, len(cmdCall.DependsOn))
+		for _, depId := range cmdCall.DependsOn {
+			depIdx, ok := idToIdx[depId]
+			if !ok {
+				return nil, fmt.Errorf("step %d (%s) depends on %s, which is not defined before it", stepIdx, cmdCall.Cmd, depId)
+			}
+			deps[stepIdx] = append(deps[stepIdx], depIdx)
+		}
+		if cmdCall.Id != "" {
+			if _, ok := idToIdx[cmdCall.Id]; ok {
+				return nil, fmt.Errorf("step %d (%s) has duplicate id %s", stepIdx, cmdCall.Cmd, cmdCall.Id)
+			}
+			idToIdx[cmdCall.Id] = stepIdx
+		}
+	}
+	return deps, nil
+}
+
+func cmdCallName(cmdCall *CombinedCmdCall) string {
+	if cmdCall.Id != "" {
+		return fmt.Sprintf("%s:%s(%s)", cmdCall.Id, cmdCall.Cmd, cmdCall.Nicknames)
+	}
+	return fmt.Sprintf("%s(%s)", cmdCall.Cmd, cmdCall.Nicknames)
+}
+
+type cmdCallStepResult struct {
+	StepIdx int
+	Results []*InstanceCmdResult
+	Err     error
+}
+
+// Runs steps as soon as all their dependencies are done, independent branches run at the same time.
+// A failed StopOnFail step stops scheduling of new steps, but steps already running are allowed to finish.
+// Steps marked as done in the checkpoint are not run again. Only this goroutine touches stepStates and checkpoint.
+// Returns results of all steps that ran, in completion order.
+func runCmdCallDag(p deployProviderImpl, combinedCmdCallSeq []CombinedCmdCall, deps [][]int, checkpoint *Checkpoint, checkpointPath string, execArgs *ExecArgs, events event.Sink) ([]*InstanceCmdResult, error) {
+	const (
+		stepPending = iota
+		stepRunning
+		stepSatisfied
+		stepFailed
+	)
+	stepStates := make([]int, len(combinedCmdCallSeq))
+	for stepIdx, step := range checkpoint.Steps {
+		if step.Done {
+			events.Emit(event.NewMessage(fmt.Sprintf("%s already done according to checkpoint %s, skipping", cmdCallName(&combinedCmdCallSeq[stepIdx]), checkpointPath)))
+			stepStates[stepIdx] = stepSatisfied
+		}
+	}
+
+	resultChan := make(chan cmdCallStepResult, len(combinedCmdCallSeq))
+	runningCount := 0
+	failedSteps := make([]string, 0)
+	allResults := make([]*InstanceCmdResult, 0)
+	var firstErr error
+
+	goCtx := p.getDeployCtx().GoCtx
+	for {
+		// Start everything that is ready, unless some step has failed already or we were cancelled
+		if firstErr == nil && goCtx.Err() == nil {
+			for stepIdx := range combinedCmdCallSeq {
+				if stepStates[stepIdx] != stepPending {
+					continue
+				}
+				isReady := true
+				for _, depIdx := range deps[stepIdx] {
+					if stepStates[depIdx] != stepSatisfied {
+						isReady = false
+						break
+					}
+				}
+				if !isReady {
+					continue
+				}
+				stepStates[stepIdx] = stepRunning
+				runningCount++
+				go func(stepIdx int, nicknames string) {
+					results, err := execSimpleParallelCmd(p, combinedCmdCallSeq[stepIdx].Cmd, nicknames, execArgs, events)
+					resultChan <- cmdCallStepResult{stepIdx, results, err}
+				}(stepIdx, checkpoint.Steps[stepIdx].nicknamesToRun())
+			}
+		}
+
+		if runningCount == 0 {
+			break
+		}
+
+		result := <-resultChan
+		runningCount--
+		cmdCall := &combinedCmdCallSeq[result.StepIdx]
+		step := checkpoint.Steps[result.StepIdx]
+		allResults = append(allResults, result.Results...)
+
+		// A cancelled step is never considered done, even if its failures are normally ignored
+		if result.Err != nil && (cmdCall.OnFail == StopOnFail || goCtx.Err() != nil) {
+			stepStates[result.StepIdx] = stepFailed
+			// Nicknames that succeeded this time do not need a retry
+			step.FailedNicknames = failedResultNicknames(result.Results)
+			failedSteps = append(failedSteps, cmdCallName(cmdCall))
+			if firstErr == nil {
+				firstErr = result.Err
+			}
+		} else {
+			stepStates[result.StepIdx] = stepSatisfied
+			step.Done = true
+			step.FailedNicknames = nil
+		}
+		if saveErr := checkpoint.save(checkpointPath); saveErr != nil {
+			events.Emit(event.NewError(saveErr))
+			if firstErr == nil {
+				firstErr = saveErr
+			}
+		}
+	}
+
+	if goCtx.Err() != nil {
+		doneSteps := make([]string, 0)
+		notStartedSteps := make([]string, 0)
+		for stepIdx, stepState := range stepStates {
+			switch stepState {
+			case stepSatisfied:
+				doneSteps = append(doneSteps, cmdCallName(&combinedCmdCallSeq[stepIdx]))
+			case stepPending:
+				notStartedSteps = append(notStartedSteps, cmdCallName(&combinedCmdCallSeq[stepIdx]))
+			}
+		}
+		events.Emit(event.NewMessage(fmt.Sprintf("%s INTERRUPTED: completed [%s], failed or interrupted [%s], not started [%s]",
+			checkpoint.Cmd, strings.Join(doneSteps, ","), strings.Join(failedSteps, ","), strings.Join(notStartedSteps, ","))))
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s cancelled: %s", checkpoint.Cmd, goCtx.Err().Error())
+		}
+	}
+
+	if len(failedSteps) > 0 || goCtx.Err() != nil {
+		events.Emit(event.NewMessage(fmt.Sprintf("%s stopped, run it again with -resume to continue from checkpoint %s", checkpoint.Cmd, checkpointPath)))
+	}
+	return allResults, firstErr
+}
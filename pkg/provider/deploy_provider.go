@@ -2,10 +2,16 @@ package provider
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,7 +21,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/capillariesio/capillaries-deploy/pkg/audit"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
@@ -52,6 +61,26 @@ const (
 	CmdCreateInstancesFromSnapshotImages string = "create_instances_from_snapshot_images"
 	CmdDeleteSnapshotImages              string = "delete_snapshot_images"
 	CmdCheckCassStatus                   string = "check_cassandra_status"
+	CmdWaitCassNodesJoined               string = "wait_cassandra_nodes_joined"
+	CmdCheckDrift                        string = "check_drift"
+	CmdRunWorkflow                       string = "run_workflow"
+	CmdSsh                               string = "ssh"
+	CmdExec                              string = "exec"
+	CmdTunnel                            string = "tunnel"
+	CmdExportInventory                   string = "export_inventory"
+	CmdScale                             string = "scale"
+	CmdRollingRestart                    string = "rolling_restart"
+	CmdRollingConfig                     string = "rolling_config"
+	CmdWaitServicesReady                 string = "wait_services_ready"
+	CmdUpgradeCapillaries                string = "upgrade_capillaries"
+	CmdReinstallCapillaries              string = "reinstall_capillaries"
+	CmdHealth                            string = "health"
+	CmdEstimateCost                      string = "estimate_cost"
+	CmdReapExpired                       string = "reap_expired"
+	CmdDestroyByTag                      string = "destroy_by_tag"
+	CmdForceUnlock                       string = "force_unlock"
+	CmdVerifyAudit                       string = "verify_audit"
+	CmdServe                             string = "serve"
 )
 
 type StopOnFailType int
@@ -66,52 +95,110 @@ type ExecArgs struct {
 	Verbosity             bool
 	NumberOfRepetitions   int
 	ShowProjectDetails    bool
+	SrcPath               string
+	DstPath               string
+	Permissions           int // File mode, like 0644
+	Owner                 string
+	Resume                bool
+	BatchSize             int // Instances processed at a time by rolling commands
+	ReleaseUrl            string
+	Rollback              bool
 }
 
+// Steps with an Id run as a dependency graph: each waits only for the steps listed in DependsOn.
+// Sequences without ids run step by step.
 type CombinedCmdCall struct {
 	Cmd       string
 	Nicknames string
 	OnFail    StopOnFailType
+	Id        string
+	DependsOn []string
 }
 
 var combinedCmdCallSeqMap map[string][]CombinedCmdCall = map[string][]CombinedCmdCall{
 	CmdDeploymentCreate: {
-		{CmdCreateFloatingIps, "", StopOnFail},
-		{CmdCreateNetworking, "", StopOnFail},
-		{CmdCreateSecurityGroups, "", StopOnFail},
-		{CmdCreateVolumes, "*", StopOnFail},
-		{CmdCreateInstances, "*", StopOnFail},
-		{CmdPingInstances, "*", StopOnFail},
-		{CmdAttachVolumes, "bastion", StopOnFail},
-		{CmdInstallServices, "bastion", StopOnFail},
-		{CmdInstallServices, "rabbitmq,prometheus,daemon*,cass*", StopOnFail},
-		{CmdStopServices, "cass*", StopOnFail},
-		{CmdConfigServices, "cass*", StopOnFail},
-		{CmdConfigServices, "bastion,rabbitmq,prometheus,daemon*", StopOnFail},
-		{CmdCheckCassStatus, "", StopOnFail}},
+		{CmdCreateFloatingIps, "", StopOnFail, "floating_ips", nil},
+		{CmdCreateNetworking, "", StopOnFail, "networking", nil},
+		{CmdCreateSecurityGroups, "", StopOnFail, "security_groups", []string{"networking"}},
+		{CmdCreateVolumes, "*", StopOnFail, "volumes", []string{"networking"}},
+		{CmdCreateInstances, "*", StopOnFail, "instances", []string{"security_groups", "floating_ips"}},
+		{CmdPingInstances, "*", StopOnFail, "ping_instances", []string{"instances"}},
+		{CmdAttachVolumes, "bastion", StopOnFail, "attach_bastion_volumes", []string{"ping_instances", "volumes"}},
+		{CmdInstallServices, "bastion", StopOnFail, "install_bastion", []string{"attach_bastion_volumes"}},
+		{CmdInstallServices, "cass*", StopOnFail, "install_cass", []string{"ping_instances"}},
+		{CmdInstallServices, "rabbitmq,prometheus,daemon*", StopOnFail, "install_others", []string{"ping_instances"}},
+		{CmdStopServices, "cass*", StopOnFail, "stop_cass", []string{"install_cass"}},
+		{CmdConfigServices, "cass*", StopOnFail, "config_cass", []string{"stop_cass"}},
+		{CmdConfigServices, "bastion,rabbitmq,prometheus,daemon*", StopOnFail, "config_others", []string{"install_bastion", "install_others"}},
+		{CmdCheckCassStatus, "", StopOnFail, "check_cass_status", []string{"config_cass"}}},
 	CmdDeploymentCreateImages: {
-		{CmdStopServices, "*", IgnoreFail},
-		{CmdDetachVolumes, "bastion", StopOnFail},
-		{CmdCreateSnapshotImages, "*", StopOnFail},
-		{CmdDeleteInstances, "*", StopOnFail}},
+		{CmdStopServices, "*", IgnoreFail, "", nil},
+		{CmdDetachVolumes, "bastion", StopOnFail, "", nil},
+		{CmdCreateSnapshotImages, "*", StopOnFail, "", nil},
+		{CmdDeleteInstances, "*", StopOnFail, "", nil}},
 	CmdDeploymentRestoreInstances: {
-		{CmdCreateInstancesFromSnapshotImages, "*", StopOnFail},
-		{CmdPingInstances, "*", StopOnFail},
-		{CmdAttachVolumes, "bastion", StopOnFail},
-		{CmdStartServices, "*", StopOnFail},
-		{CmdStopServices, "cass*", StopOnFail},
-		{CmdConfigServices, "cass*", StopOnFail}},
+		{CmdCreateInstancesFromSnapshotImages, "*", StopOnFail, "", nil},
+		{CmdPingInstances, "*", StopOnFail, "", nil},
+		{CmdAttachVolumes, "bastion", StopOnFail, "", nil},
+		{CmdStartServices, "*", StopOnFail, "", nil},
+		{CmdStopServices, "cass*", StopOnFail, "", nil},
+		{CmdConfigServices, "cass*", StopOnFail, "", nil}},
 	CmdDeploymentDeleteImages: {
-		{CmdDeleteSnapshotImages, "*", StopOnFail}},
+		{CmdDeleteSnapshotImages, "*", StopOnFail, "", nil}},
 	CmdDeploymentDelete: {
-		{CmdDeleteSnapshotImages, "*", StopOnFail},
-		{CmdStopServices, "*", IgnoreFail},
-		{CmdDetachVolumes, "bastion", StopOnFail},
-		{CmdDeleteInstances, "*", IgnoreFail},
-		{CmdDeleteVolumes, "*", IgnoreFail},
-		{CmdDeleteSecurityGroups, "*", IgnoreFail},
-		{CmdDeleteNetworking, "*", IgnoreFail},
-		{CmdDeleteFloatingIps, "*", IgnoreFail}}}
+		{CmdDeleteSnapshotImages, "*", StopOnFail, "", nil},
+		{CmdStopServices, "*", IgnoreFail, "", nil},
+		{CmdDetachVolumes, "bastion", StopOnFail, "", nil},
+		{CmdDeleteInstances, "*", IgnoreFail, "", nil},
+		{CmdDeleteVolumes, "*", IgnoreFail, "", nil},
+		{CmdDeleteSecurityGroups, "*", IgnoreFail, "", nil},
+		{CmdDeleteNetworking, "*", IgnoreFail, "", nil},
+		{CmdDeleteFloatingIps, "*", IgnoreFail, "", nil}}}
+
+// Commands that can be used as workflow steps
+var simpleCmdSet map[string]struct{} = map[string]struct{}{
+	CmdCreateFloatingIps:                 {},
+	CmdDeleteFloatingIps:                 {},
+	CmdCreateSecurityGroups:              {},
+	CmdDeleteSecurityGroups:              {},
+	CmdCreateNetworking:                  {},
+	CmdDeleteNetworking:                  {},
+	CmdCreateVolumes:                     {},
+	CmdDeleteVolumes:                     {},
+	CmdCreateInstances:                   {},
+	CmdDeleteInstances:                   {},
+	CmdAttachVolumes:                     {},
+	CmdDetachVolumes:                     {},
+	CmdUploadFiles:                       {},
+	CmdDownloadFiles:                     {},
+	CmdInstallServices:                   {},
+	CmdConfigServices:                    {},
+	CmdStartServices:                     {},
+	CmdStopServices:                      {},
+	CmdPingInstances:                     {},
+	CmdCreateSnapshotImages:              {},
+	CmdCreateInstancesFromSnapshotImages: {},
+	CmdDeleteSnapshotImages:              {},
+	CmdCheckCassStatus:                   {},
+	CmdWaitCassNodesJoined:               {},
+	CmdWaitServicesReady:                 {},
+	CmdReinstallCapillaries:              {}}
+
+// Commands run by DeployProvider.ExecCmd, as opposed to queries and interactive commands with their own methods
+func IsExecCmd(cmd string) bool {
+	if _, ok := simpleCmdSet[cmd]; ok {
+		return true
+	}
+	if _, ok := combinedCmdCallSeqMap[cmd]; ok {
+		return true
+	}
+	return cmd == CmdRunWorkflow || cmd == CmdScale || isRollingCmd(cmd) || cmd == CmdUpgradeCapillaries
+}
+
+// Commands that take a positional argument right after the command name: nicknames, workflow name etc
+func IsCmdRequiresPositionalArg(cmd string) bool {
+	return IsCmdRequiresNicknames(cmd) || cmd == CmdRunWorkflow || cmd == CmdSsh || cmd == CmdExec || cmd == CmdTunnel || cmd == CmdScale || isRollingCmd(cmd) || cmd == CmdUpgradeCapillaries || cmd == CmdHealth || cmd == CmdDestroyByTag || cmd == CmdForceUnlock
+}
 
 func IsCmdRequiresNicknames(cmd string) bool {
 	return cmd == CmdCreateVolumes ||
@@ -129,55 +216,215 @@ func IsCmdRequiresNicknames(cmd string) bool {
 		cmd == CmdPingInstances ||
 		cmd == CmdCreateSnapshotImages ||
 		cmd == CmdCreateInstancesFromSnapshotImages ||
-		cmd == CmdDeleteSnapshotImages
+		cmd == CmdDeleteSnapshotImages ||
+		cmd == CmdWaitCassNodesJoined ||
+		cmd == CmdWaitServicesReady ||
+		cmd == CmdReinstallCapillaries
 }
 
 type DeployCtx struct {
-	Project   *prj.Project
-	GoCtx     context.Context
-	IsVerbose bool
-	Tags      map[string]string
+	Project        *prj.Project
+	GoCtx          context.Context
+	IsVerbose      bool
+	Tags           map[string]string
+	SshSem         chan int // Limits ssh sessions across all steps running at the same time
+	CallerIdentity string   // Who runs capideploy: AWS caller identity ARN
+	SessionId      string   // Random, tells apart providers created by one process, like serve jobs
+	Events         event.Sink
+	attachCtxHooks func(goCtx context.Context) context.Context // Script audit and output hooks, see WithContext
+	auditJournal   *audit.Journal                              // Nil if the project has no audit_log, see Close
 	// AWS members:
 	Aws *AwsCtx
 	// Azure members:
 }
 
+// Progress, logs and errors of all methods go to the event.Sink passed to DeployProviderFactory
 type DeployProvider interface {
-	ListDeployments(cOut chan<- string, cErr chan<- string) (map[string]int, error)
-	ListDeploymentResources(cOut chan<- string, cErr chan<- string) ([]*cld.Resource, error)
-	ExecCmdWithNoResult(cmd string, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error
+	WithContext(goCtx context.Context) DeployProvider
+	Close() error
+	ListDeployments(withState bool) ([]*cld.Resource, error)
+	ListDeploymentResources() ([]*cld.Resource, error)
+	CheckDrift() (*DriftReport, error)
+	ExecCmd(cmd string, nicknames string, execArgs *ExecArgs) ([]*InstanceCmdResult, error)
+	ExecCmdWithNoResult(cmd string, nicknames string, execArgs *ExecArgs) error
+	PlanCmd(cmd string, nicknames string, execArgs *ExecArgs) ([]*PlanItem, error)
+	Ssh(nickname string, remoteCmd string) (int, error)
+	ExecOnInstances(nicknames string, shellCmd string) ([]*InstanceExecResult, error)
+	Tunnel(spec string) error
+	ExportInventory(dstDir string) error
+	Health(nicknames string, waitSeconds int) ([]*HealthCheckResult, error)
+	ReapExpired(doDelete bool) ([]*cld.DeploymentSummary, error)
+	DestroyByTag(deploymentName string, confirmedName string, planOnly bool) ([]*PlanItem, error)
+	ForceUnlock(deploymentName string) error
+}
+
+// Reports the journal head, so it can be kept where the journal writer cannot change it, see verify_audit -head
+func genericClose(p deployProviderImpl, events event.Sink) error {
+	journal := p.getDeployCtx().auditJournal
+	if journal == nil {
+		return nil
+	}
+	seq, hash := journal.Head()
+	if err := journal.Close(); err != nil {
+		events.Emit(event.NewError(err))
+		return err
+	}
+	events.Emit(event.NewMessage(fmt.Sprintf("Audit journal %s head: seq %d, hash %s", p.getDeployCtx().Project.AuditLog, seq, hash)))
+	return nil
 }
 
-func genericListDeployments(p deployProviderImpl, cOut chan<- string, cErr chan<- string) (map[string]int, error) {
-	mapResourceCount, logMsg, err := p.listDeployments()
-	cOut <- string(logMsg)
+func genericListDeployments(p deployProviderImpl, withState bool, events event.Sink) ([]*cld.Resource, error) {
+	resources, logMsg, err := p.listDeployments(withState)
+	events.Emit(event.NewLog(logMsg))
 	if err != nil {
-		cErr <- err.Error()
+		events.Emit(event.NewError(err))
 	}
-	return mapResourceCount, err
+	return resources, err
 }
 
-func genericListDeploymentResources(p deployProviderImpl, cOut chan<- string, cErr chan<- string) ([]*cld.Resource, error) {
+func genericListDeploymentResources(p deployProviderImpl, events event.Sink) ([]*cld.Resource, error) {
 	resources, logMsg, err := p.listDeploymentResources()
-	cOut <- string(logMsg)
+	events.Emit(event.NewLog(logMsg))
 	if err != nil {
-		cErr <- err.Error()
+		events.Emit(event.NewError(err))
 	}
 	return resources, err
 }
 
-func genericExecCmdWithNoResult(p deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
-	if combinedCmdCallSeq, ok := combinedCmdCallSeqMap[cmd]; ok {
-		for _, combinedCmdCallSeq := range combinedCmdCallSeq {
-			err := execSimpleParallelCmd(p, combinedCmdCallSeq.Cmd, combinedCmdCallSeq.Nicknames, execArgs, cOut, cErr)
-			if err != nil && combinedCmdCallSeq.OnFail == StopOnFail {
-				return err
+func workflowToCombinedCmdCallSeq(workflowName string, steps []*prj.WorkflowStepDef) ([]CombinedCmdCall, error) {
+	combinedCmdCallSeq := make([]CombinedCmdCall, len(steps))
+	for stepIdx, step := range steps {
+		if _, ok := simpleCmdSet[step.Cmd]; !ok {
+			return nil, fmt.Errorf("workflow %s step %d has unsupported cmd %s", workflowName, stepIdx, step.Cmd)
+		}
+		if IsCmdRequiresNicknames(step.Cmd) && step.Nicknames == "" {
+			return nil, fmt.Errorf("workflow %s step %d (%s) requires nicknames", workflowName, stepIdx, step.Cmd)
+		}
+		onFail := StopOnFail
+		if step.OnFail == prj.WorkflowStepOnFailIgnore {
+			onFail = IgnoreFail
+		}
+		combinedCmdCallSeq[stepIdx] = CombinedCmdCall{step.Cmd, step.Nicknames, onFail, step.Id, step.DependsOn}
+	}
+	return combinedCmdCallSeq, nil
+}
+
+// Returns the sequence of simple commands to run for cmd. Project workflows take precedence over
+// built-in combined commands, so a project can override deployment_create and friends.
+// For run_workflow, the workflow name comes in place of nicknames.
+func getCombinedCmdCallSeq(project *prj.Project, cmd string, nicknames string) ([]CombinedCmdCall, error) {
+	workflowName := cmd
+	if cmd == CmdRunWorkflow {
+		if nicknames == "" {
+			return nil, fmt.Errorf("not enough args, expected workflow name")
+		}
+		workflowName = nicknames
+	}
+
+	builtinCombinedCmdCallSeq, isBuiltin := combinedCmdCallSeqMap[workflowName]
+
+	if cmd == CmdRunWorkflow || isBuiltin {
+		if steps, ok := project.Workflows[workflowName]; ok {
+			return workflowToCombinedCmdCallSeq(workflowName, steps)
+		}
+	}
+
+	if isBuiltin {
+		return builtinCombinedCmdCallSeq, nil
+	}
+
+	if cmd == CmdRunWorkflow {
+		availableWorkflows := make([]string, 0, len(project.Workflows)+len(combinedCmdCallSeqMap))
+		for name := range project.Workflows {
+			availableWorkflows = append(availableWorkflows, name)
+		}
+		for name := range combinedCmdCallSeqMap {
+			if _, ok := project.Workflows[name]; !ok {
+				availableWorkflows = append(availableWorkflows, name)
 			}
 		}
-		return nil
+		sort.Strings(availableWorkflows)
+		return nil, fmt.Errorf("workflow %s not found, available workflows: %s", workflowName, strings.Join(availableWorkflows, ","))
+	}
+
+	return []CombinedCmdCall{{cmd, nicknames, StopOnFail, "", nil}}, nil
+}
+
+// Everything but read-only commands runs under the deployment lock
+func genericExecCmd(p deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, events event.Sink) ([]*InstanceCmdResult, error) {
+	if isReadOnlyCmd(cmd) {
+		return execCmd(p, cmd, nicknames, execArgs, events)
+	}
+	var results []*InstanceCmdResult
+	err := withDeploymentLock(p, p.getDeployCtx().Project.DeploymentName, cmd, events, func(lockedP deployProviderImpl) error {
+		var err error
+		results, err = execCmd(lockedP, cmd, nicknames, execArgs, events)
+		return err
+	})
+	return results, err
+}
+
+func execCmd(p deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, events event.Sink) ([]*InstanceCmdResult, error) {
+	var combinedCmdCallSeq []CombinedCmdCall
+	var err error
+	if cmd == CmdScale {
+		combinedCmdCallSeq, err = getScaleCmdCallSeq(p, nicknames, execArgs.Resume, events)
+	} else if isRollingCmd(cmd) {
+		combinedCmdCallSeq, err = getRollingCmdCallSeq(p.getDeployCtx().Project, cmd, nicknames, execArgs.BatchSize)
+	} else if cmd == CmdUpgradeCapillaries {
+		combinedCmdCallSeq, err = getUpgradeCmdCallSeq(p.getDeployCtx().Project, nicknames, execArgs)
 	} else {
-		return execSimpleParallelCmd(p, cmd, nicknames, execArgs, cOut, cErr)
+		combinedCmdCallSeq, err = getCombinedCmdCallSeq(p.getDeployCtx().Project, cmd, nicknames)
+	}
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	// Simple commands are not journaled, just run them
+	if _, ok := simpleCmdSet[cmd]; ok {
+		if execArgs.Resume {
+			events.Emit(event.NewMessage(fmt.Sprintf("%s is not a combined command, nothing to resume, running it", cmd)))
+		}
+		return execSimpleParallelCmd(p, cmd, nicknames, execArgs, events)
+	}
+
+	deps, err := getCmdCallDeps(combinedCmdCallSeq)
+	if err != nil {
+		err = fmt.Errorf("cannot run %s: %s", cmd, err.Error())
+		events.Emit(event.NewError(err))
+		return nil, err
 	}
+
+	checkpointPath := checkpointFilePath(p.getDeployCtx().Project, cmd, nicknames)
+	var checkpoint *Checkpoint
+	if execArgs.Resume {
+		checkpoint, err = loadCheckpoint(checkpointPath)
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+		if checkpoint == nil {
+			events.Emit(event.NewMessage(fmt.Sprintf("no checkpoint %s found, running %s from the start", checkpointPath, cmd)))
+		} else if err := checkpoint.matches(combinedCmdCallSeq); err != nil {
+			err = fmt.Errorf("cannot resume from checkpoint %s, delete it or run without -resume: %s", checkpointPath, err.Error())
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+	}
+	if checkpoint == nil {
+		checkpoint = newCheckpoint(p.getDeployCtx().Project.DeploymentName, cmd, combinedCmdCallSeq)
+	}
+
+	results, err := runCmdCallDag(p, combinedCmdCallSeq, deps, checkpoint, checkpointPath, execArgs, events)
+	if err != nil {
+		return results, err
+	}
+
+	if err := os.Remove(checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		events.Emit(event.NewError(fmt.Errorf("cannot remove checkpoint %s: %s", checkpointPath, err.Error())))
+	}
+	return results, nil
 }
 
 type AssumeRoleConfig struct {
@@ -187,21 +434,32 @@ type AssumeRoleConfig struct {
 	// Azure members:
 }
 
-func DeployProviderFactory(project *prj.Project, goCtx context.Context, assumeRoleCfg *AssumeRoleConfig, isVerbose bool, cOut chan<- string, cErr chan<- string) (DeployProvider, error) {
+func DeployProviderFactory(project *prj.Project, goCtx context.Context, assumeRoleCfg *AssumeRoleConfig, isVerbose bool, events event.Sink) (DeployProvider, error) {
 	if project.DeployProviderName == prj.DeployProviderAws {
+		ttl, err := project.DeploymentTtlDuration()
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
 		cfg, err := config.LoadDefaultConfig(goCtx)
 		if err != nil {
-			cErr <- err.Error()
+			events.Emit(event.NewError(err))
 			return nil, err
 		}
+		cldaws.ConfigureRateLimitAndRetry(&cfg,
+			cldaws.NewAdaptiveTokenBucket(project.Limits.AwsCallsPerSecond, project.Limits.AwsBurst),
+			project.Limits.AwsMaxAttempts,
+			time.Duration(project.Limits.AwsMaxBackoff)*time.Second)
 
 		callerIdentityOutBefore, err := sts.NewFromConfig(cfg).GetCallerIdentity(goCtx, &sts.GetCallerIdentityInput{})
 		if err != nil {
 			err = fmt.Errorf("cannot get caller identity before assuming role %s: %s", assumeRoleCfg.RoleArn, err.Error())
-			cErr <- err.Error()
+			events.Emit(event.NewError(err))
 			return nil, err
 		}
 
+		callerIdentity := *callerIdentityOutBefore.Arn
 		if assumeRoleCfg != nil && assumeRoleCfg.RoleArn != "" {
 			creds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), assumeRoleCfg.RoleArn,
 				func(o *stscreds.AssumeRoleOptions) {
@@ -214,33 +472,92 @@ func DeployProviderFactory(project *prj.Project, goCtx context.Context, assumeRo
 			callerIdentityOutAfter, err := sts.NewFromConfig(cfg).GetCallerIdentity(goCtx, &sts.GetCallerIdentityInput{})
 			if err != nil {
 				err = fmt.Errorf("cannot get caller identity after assuming role %s: %s", assumeRoleCfg.RoleArn, err.Error())
-				cErr <- err.Error()
+				events.Emit(event.NewError(err))
 				return nil, err
 			}
 
 			if *callerIdentityOutBefore.Arn == *callerIdentityOutAfter.Arn {
 				err = fmt.Errorf("cannot proceed with the same caller identity after assuming role %s: %s", assumeRoleCfg.RoleArn, *callerIdentityOutAfter.Arn)
-				cErr <- err.Error()
+				events.Emit(event.NewError(err))
 				return nil, err
 			}
-			cOut <- fmt.Sprintf("Caller identity (role assumed): %s", *callerIdentityOutAfter.Arn)
+			events.Emit(event.NewMessage(fmt.Sprintf("Caller identity (role assumed): %s", *callerIdentityOutAfter.Arn)))
+			callerIdentity = *callerIdentityOutAfter.Arn
 		} else {
-			cOut <- fmt.Sprintf("Caller identity (no role assumed): %s", *callerIdentityOutBefore.Arn)
+			events.Emit(event.NewMessage(fmt.Sprintf("Caller identity (no role assumed): %s", *callerIdentityOutBefore.Arn)))
+		}
+
+		var scriptAuditFunc rexec.ScriptAuditFunc
+		var journal *audit.Journal
+		if project.AuditLog != "" {
+			journal, err = audit.OpenJournal(project.AuditLog, []byte(project.AuditKey), project.DeploymentName, callerIdentity)
+			if err != nil {
+				events.Emit(event.NewError(err))
+				return nil, err
+			}
+			// Clients below are created after this, so they report their calls
+			cldaws.ConfigureCallAudit(&cfg, func(deploymentName string, nickname string, operation string, resourceName string, resourceIds []string, duration time.Duration, opErr error) {
+				if err := journal.Record(deploymentName, audit.KindCloud, nickname, resourceName, operation, resourceIds, duration, opErr); err != nil {
+					events.Emit(event.NewError(err))
+				}
+			})
+			scriptAuditFunc = func(ipAddress string, scriptPath string, duration time.Duration, opErr error) {
+				if err := journal.Record("", audit.KindScript, project.InstanceNicknameByIpAddress(ipAddress), "", scriptPath, []string{ipAddress}, duration, opErr); err != nil {
+					events.Emit(event.NewError(err))
+				}
+			}
+			events.Emit(event.NewMessage(fmt.Sprintf("Recording cloud calls and scripts in audit journal %s", project.AuditLog)))
+		}
+
+		cldaws.ConfigureResourceEvents(&cfg, func(isCreated bool, resourceType string, resourceName string, resourceId string) {
+			if isCreated {
+				events.Emit(event.NewResource(event.TypeResourceCreated, resourceType, resourceName, resourceId))
+			} else {
+				events.Emit(event.NewResource(event.TypeResourceDeleted, resourceType, resourceName, resourceId))
+			}
+		})
+		scriptOutputFunc := func(ipAddress string, scriptPath string, er *rexec.ExecResult) {
+			events.Emit(event.NewScriptOutput(project.InstanceNicknameByIpAddress(ipAddress), ipAddress, scriptPath, er.Stdout, er.Stderr, time.Duration(er.Elapsed*float64(time.Second)), er.Error))
+		}
+		attachCtxHooks := func(goCtx context.Context) context.Context {
+			if scriptAuditFunc != nil {
+				goCtx = rexec.WithScriptAudit(goCtx, scriptAuditFunc)
+			}
+			return rexec.WithScriptOutput(goCtx, scriptOutputFunc)
+		}
+
+		tags := map[string]string{
+			cld.DeploymentNameTagName:     project.DeploymentName,
+			cld.DeploymentOperatorTagName: cld.DeploymentOperatorTagValue}
+		if ttl > 0 {
+			// Counted from now: every command that creates resources pushes the expiry of the deployment further
+			tags[cld.DeploymentExpiresTagName] = cld.FormatExpiry(time.Now().Add(ttl))
+			events.Emit(event.NewMessage(fmt.Sprintf("Resources created by this command expire at %s", tags[cld.DeploymentExpiresTagName])))
+		}
+
+		sessionIdBytes := make([]byte, 4)
+		if _, err := rand.Read(sessionIdBytes); err != nil {
+			return nil, fmt.Errorf("cannot generate session id: %s", err.Error())
 		}
 
 		return &AwsDeployProvider{
 			DeployCtx: &DeployCtx{
-				Project:   project,
-				GoCtx:     goCtx,
-				IsVerbose: isVerbose,
-				Tags: map[string]string{
-					cld.DeploymentNameTagName:     project.DeploymentName,
-					cld.DeploymentOperatorTagName: cld.DeploymentOperatorTagValue},
+				Project:        project,
+				GoCtx:          attachCtxHooks(goCtx),
+				IsVerbose:      isVerbose,
+				SshSem:         make(chan int, project.Limits.SshConcurrency),
+				Tags:           tags,
+				CallerIdentity: callerIdentity,
+				SessionId:      hex.EncodeToString(sessionIdBytes),
+				Events:         events,
+				attachCtxHooks: attachCtxHooks,
+				auditJournal:   journal,
 				Aws: &AwsCtx{
 					Ec2Client:     ec2.NewFromConfig(cfg),
 					TaggingClient: resourcegroupstaggingapi.NewFromConfig(cfg),
 				},
 			},
+			externalAddress: &externalAddressState{},
 		}, nil
 	}
 	return nil, fmt.Errorf("unsupported deploy provider %s", project.DeployProviderName)
@@ -250,7 +567,66 @@ const MaxWorkerThreads int = 50
 
 type SingleThreadCmdHandler func() (l.LogMsg, error)
 
-func pingOneHost(sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool, numberOfRepetitions int) (l.LogMsg, error) {
+var errCancelledBeforeStart = errors.New("cancelled before start")
+
+// Workers that were not started yet when the command was cancelled report errCancelledBeforeStart
+func isCancelledBeforeStart(goCtx context.Context, errChan chan<- cmdResult, iNickname string) bool {
+	if goCtx.Err() == nil {
+		return false
+	}
+	errChan <- cmdResult{iNickname, errCancelledBeforeStart, "", 0}
+	return true
+}
+
+type cmdResult struct {
+	Nickname string // Empty for commands that do not run per instance
+	Err      error
+	LogMsg   l.LogMsg
+	Elapsed  time.Duration
+}
+
+// What a simple command did on one instance. Commands that do not run per instance, like create_networking,
+// report one result with empty nickname. Volume commands report one result per instance for all its volumes.
+type InstanceCmdResult struct {
+	Cmd      string  `json:"cmd"`
+	Nickname string  `json:"nickname,omitempty"`
+	Elapsed  float64 `json:"elapsed"` // Seconds
+	Log      string  `json:"log,omitempty"`
+	Error    string  `json:"error,omitempty"` // Empty if succeeded
+}
+
+func (r *InstanceCmdResult) IsFailed() bool {
+	return r.Error != ""
+}
+
+func failedResultNicknames(results []*InstanceCmdResult) []string {
+	failedNicknames := make([]string, 0)
+	for _, r := range results {
+		if r.IsFailed() && r.Nickname != "" {
+			failedNicknames = append(failedNicknames, r.Nickname)
+		}
+	}
+	return failedNicknames
+}
+
+// Volume commands run once per volume, their results are merged per instance
+func addCmdResult(resultMap map[string]*InstanceCmdResult, cmd string, cmdRes *cmdResult) {
+	r, ok := resultMap[cmdRes.Nickname]
+	if !ok {
+		r = &InstanceCmdResult{Cmd: cmd, Nickname: cmdRes.Nickname}
+		resultMap[cmdRes.Nickname] = r
+	}
+	r.Elapsed = max(r.Elapsed, cmdRes.Elapsed.Seconds())
+	r.Log += cmdRes.LogMsg.Plain()
+	if cmdRes.Err != nil {
+		if r.Error != "" {
+			r.Error += "; "
+		}
+		r.Error += cmdRes.Err.Error()
+	}
+}
+
+func pingOneHost(goCtx context.Context, sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool, numberOfRepetitions int) (l.LogMsg, error) {
 	var err error
 	var logMsg l.LogMsg
 
@@ -262,14 +638,18 @@ func pingOneHost(sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool
 	lb := l.NewLogBuilder(l.CurFuncName()+" "+ipAddress, verbosity)
 
 	for {
-		logMsg, err = rexec.ExecCommandOnInstance(sshConfig, ipAddress, "id", verbosity)
+		logMsg, err = rexec.ExecCommandOnInstance(goCtx, sshConfig, ipAddress, "id", verbosity)
 		lb.Add(string(logMsg))
 		repetitions--
 		if err == nil || repetitions == 0 {
 			break
 		}
 		lb.Add(err.Error())
-		time.Sleep(5 * time.Second)
+		select {
+		case <-goCtx.Done():
+			return lb.Complete(fmt.Errorf("cancelled while pinging %s: %s", ipAddress, goCtx.Err().Error()))
+		case <-time.After(5 * time.Second):
+		}
 	}
 
 	return lb.Complete(err)
@@ -303,11 +683,36 @@ func filterByNickname[GenericDef prj.InstanceDef](nicknames string, sourceMap ma
 	return defMap, nil
 }
 
-func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+func sortedInstanceNicknames(instances map[string]*prj.InstanceDef) []string {
+	nicknames := make([]string, 0, len(instances))
+	for iNickname := range instances {
+		nicknames = append(nicknames, iNickname)
+	}
+	sort.Strings(nicknames)
+	return nicknames
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Cloud calls made by the returned provider are journaled with the instance nickname
+func instanceProvider(p deployProviderImpl, iNickname string) deployProviderImpl {
+	return p.withGoCtx(audit.WithNickname(p.getDeployCtx().GoCtx, iNickname))
+}
+
+// Returns results sorted by nickname and the last error
+func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, events event.Sink) ([]*InstanceCmdResult, error) {
 	cmdStartTs := time.Now()
-	throttle := time.NewTicker(time.Second) // One call per second, to avoid error 429 on openstack/aws/azure calls
+	events.Emit(event.NewStepStarted(cmd, ""))
+	// AWS calls are rate-limited centrally (see cldaws.ConfigureRateLimitAndRetry), ssh sessions by DeployCtx.SshSem
 	var sem = make(chan int, MaxWorkerThreads)
-	var errChan chan error
+	var errChan chan cmdResult
 	var errorsExpected int
 
 	singleThreadNoResultCommands := map[string]SingleThreadCmdHandler{
@@ -324,19 +729,20 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 		if cmd == CmdCheckCassStatus {
 			// We need Cassandra node ip addresses populated
 			logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-			cOut <- string(logMsgBastionIp)
+			events.Emit(event.NewLog(logMsgBastionIp))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 		}
 		errorsExpected = 1
-		errChan = make(chan error, errorsExpected)
+		errChan = make(chan cmdResult, errorsExpected)
 		sem <- 1
 		go func() {
+			stepStartTs := time.Now()
 			logMsg, err := cmdHandler()
-			cOut <- string(logMsg)
-			errChan <- err
+			events.Emit(event.NewLog(logMsg))
+			errChan <- cmdResult{"", err, logMsg, time.Since(stepStartTs)}
 			<-sem
 		}()
 	} else if cmd == CmdCreateInstances ||
@@ -346,28 +752,28 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 		cmd == CmdDeleteSnapshotImages {
 		if len(nicknames) == 0 {
 			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
 		if err != nil {
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		errorsExpected = len(instances)
-		errChan = make(chan error, errorsExpected)
+		errChan = make(chan cmdResult, errorsExpected)
 
 		usedFlavors := map[string]string{}
 		usedImages := map[string]bool{}
 		if cmd == CmdCreateInstances ||
 			cmd == CmdCreateInstancesFromSnapshotImages {
 			logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-			cOut <- string(logMsgBastionIp)
+			events.Emit(event.NewLog(logMsgBastionIp))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 
 			// Make sure image/flavor is supported
@@ -378,185 +784,272 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				usedKeypairs[instDef.RootKeyName] = struct{}{}
 			}
 			logMsg, err := deployProvider.HarvestInstanceTypesByFlavorNames(usedFlavors)
-			cOut <- string(logMsg)
+			events.Emit(event.NewLog(logMsg))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 
 			logMsg, err = deployProvider.HarvestImageIds(usedImages)
-			cOut <- string(logMsg)
+			events.Emit(event.NewLog(logMsg))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 
 			// Make sure the keypairs are there
 			logMsg, err = deployProvider.VerifyKeypairs(usedKeypairs)
-			cOut <- string(logMsg)
+			events.Emit(event.NewLog(logMsg))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 
-			cOut <- "Creating instances, consider clearing known_hosts to avoid ssh complaints:"
+			events.Emit(event.NewMessage("Creating instances, consider clearing known_hosts to avoid ssh complaints:"))
 			for _, i := range instances {
-				cOut <- fmt.Sprintf("ssh-keygen -f ~/.ssh/known_hosts -R %s;", i.BestIpAddress())
+				events.Emit(event.NewMessage(fmt.Sprintf("ssh-keygen -f ~/.ssh/known_hosts -R %s;", i.BestIpAddress())))
 			}
 		}
 
 		switch cmd {
 		case CmdCreateInstances:
 			logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-			cOut <- string(logMsgBastionIp)
+			events.Emit(event.NewLog(logMsgBastionIp))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 			for iNickname := range instances {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
-				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.CreateInstanceAndWaitForCompletion(
+				go func(project *prj.Project, errChan chan<- cmdResult, iNickname string) {
+					stepStartTs := time.Now()
+					events.Emit(event.NewStepStarted(cmd, iNickname))
+					logMsg, err := instanceProvider(deployProvider, iNickname).CreateInstanceAndWaitForCompletion(
 						iNickname,
 						usedFlavors[deployProvider.getDeployCtx().Project.Instances[iNickname].FlavorName],
 						deployProvider.getDeployCtx().Project.Instances[iNickname].ImageId)
-					logChan <- string(logMsg)
-					errChan <- err
+					events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+					errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 					<-sem
-				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+				}(deployProvider.getDeployCtx().Project, errChan, iNickname)
 			}
 		case CmdDeleteInstances:
 			logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-			cOut <- string(logMsgBastionIp)
+			events.Emit(event.NewLog(logMsgBastionIp))
 			if err != nil {
-				cErr <- err.Error()
-				return err
+				events.Emit(event.NewError(err))
+				return nil, err
 			}
 			for iNickname := range instances {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
-				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.DeleteInstance(iNickname, execArgs.IgnoreAttachedVolumes)
-					logChan <- string(logMsg)
-					errChan <- err
+				go func(project *prj.Project, errChan chan<- cmdResult, iNickname string) {
+					stepStartTs := time.Now()
+					events.Emit(event.NewStepStarted(cmd, iNickname))
+					logMsg, err := instanceProvider(deployProvider, iNickname).DeleteInstance(iNickname, execArgs.IgnoreAttachedVolumes)
+					events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+					errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 					<-sem
-				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+				}(deployProvider.getDeployCtx().Project, errChan, iNickname)
 			}
 		case CmdCreateSnapshotImages:
 			for iNickname := range instances {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
-				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.CreateSnapshotImage(iNickname)
-					logChan <- string(logMsg)
-					errChan <- err
+				go func(project *prj.Project, errChan chan<- cmdResult, iNickname string) {
+					stepStartTs := time.Now()
+					events.Emit(event.NewStepStarted(cmd, iNickname))
+					logMsg, err := instanceProvider(deployProvider, iNickname).CreateSnapshotImage(iNickname)
+					events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+					errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 					<-sem
-				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+				}(deployProvider.getDeployCtx().Project, errChan, iNickname)
 			}
 		case CmdCreateInstancesFromSnapshotImages:
 			for iNickname := range instances {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
-				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname,
+				go func(project *prj.Project, errChan chan<- cmdResult, iNickname string) {
+					stepStartTs := time.Now()
+					events.Emit(event.NewStepStarted(cmd, iNickname))
+					logMsg, err := instanceProvider(deployProvider, iNickname).CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname,
 						usedFlavors[deployProvider.getDeployCtx().Project.Instances[iNickname].FlavorName])
-					logChan <- string(logMsg)
-					errChan <- err
+					events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+					errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 					<-sem
-				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+				}(deployProvider.getDeployCtx().Project, errChan, iNickname)
 			}
 		case CmdDeleteSnapshotImages:
 			for iNickname := range instances {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
-				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.DeleteSnapshotImage(iNickname)
-					logChan <- string(logMsg)
-					errChan <- err
+				go func(project *prj.Project, errChan chan<- cmdResult, iNickname string) {
+					stepStartTs := time.Now()
+					events.Emit(event.NewStepStarted(cmd, iNickname))
+					logMsg, err := instanceProvider(deployProvider, iNickname).DeleteSnapshotImage(iNickname)
+					events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+					errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 					<-sem
-				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+				}(deployProvider.getDeployCtx().Project, errChan, iNickname)
 			}
 		default:
 			err := fmt.Errorf("unknown create/delete instance command %s", cmd)
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 	} else if cmd == CmdPingInstances ||
 		cmd == CmdInstallServices ||
 		cmd == CmdConfigServices ||
 		cmd == CmdStartServices ||
-		cmd == CmdStopServices {
+		cmd == CmdStopServices ||
+		cmd == CmdWaitServicesReady ||
+		cmd == CmdReinstallCapillaries {
 		if len(nicknames) == 0 {
 			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
 		if err != nil {
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-		cOut <- string(logMsgBastionIp)
+		events.Emit(event.NewLog(logMsgBastionIp))
 		if err != nil {
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		errorsExpected = len(instances)
-		errChan = make(chan error, len(instances))
-		for _, iDef := range instances {
-			<-throttle.C
+		errChan = make(chan cmdResult, len(instances))
+		sem = deployProvider.getDeployCtx().SshSem
+		for iNickname, iDef := range instances {
+			if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+				continue
+			}
 			sem <- 1
-			go func(prj *prj.Project, logChan chan<- string, errChan chan<- error, iDef *prj.InstanceDef) {
+			go func(prj *prj.Project, errChan chan<- cmdResult, iNickname string, iDef *prj.InstanceDef) {
+				stepStartTs := time.Now()
+				events.Emit(event.NewStepStarted(cmd, iNickname))
 				var logMsg l.LogMsg
 				var err error
 				switch cmd {
 				case CmdPingInstances:
-					logMsg, err = pingOneHost(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, execArgs.NumberOfRepetitions)
+					logMsg, err = pingOneHost(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, execArgs.NumberOfRepetitions)
 
 				case CmdInstallServices:
 					// Make sure ping passes
-					logMsg, err = pingOneHost(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, 5)
+					logMsg, err = pingOneHost(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, 5)
 
 					// If ping passed, it's ok to move on
 					if err == nil {
-						logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Install, iDef.Service.Env, execArgs.Verbosity)
+						logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Install, iDef.Service.Env, execArgs.Verbosity)
 					}
 
 				case CmdConfigServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, iDef.Service.Env, execArgs.Verbosity)
+					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, iDef.Service.Env, execArgs.Verbosity)
 
 				case CmdStartServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, execArgs.Verbosity)
+					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, execArgs.Verbosity)
 
 				case CmdStopServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, execArgs.Verbosity)
+					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, execArgs.Verbosity)
+
+				case CmdWaitServicesReady:
+					logMsg, err = waitServiceReady(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iNickname, iDef, deployProvider.getDeployCtx().Project.Timeouts.ServiceReady, execArgs.Verbosity)
+
+				case CmdReinstallCapillaries:
+					logMsg, err = reinstallCapillariesOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iNickname, iDef, execArgs, deployProvider.getDeployCtx().Project.Timeouts.ServiceReady)
 
 				default:
 					err = fmt.Errorf("unknown service command:%s", cmd)
 				}
 
-				logChan <- string(logMsg)
-				errChan <- err
+				events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+				errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
+				<-sem
+			}(deployProvider.getDeployCtx().Project, errChan, iNickname, iDef)
+		}
+
+	} else if cmd == CmdUploadFiles || cmd == CmdDownloadFiles {
+		if len(nicknames) == 0 {
+			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		if execArgs.SrcPath == "" || execArgs.DstPath == "" {
+			err := fmt.Errorf("not enough args, expected source and destination paths")
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+		events.Emit(event.NewLog(logMsgBastionIp))
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		errorsExpected = len(instances)
+		errChan = make(chan cmdResult, len(instances))
+		sem = deployProvider.getDeployCtx().SshSem
+		for iNickname, iDef := range instances {
+			if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+				continue
+			}
+			sem <- 1
+			go func(prj *prj.Project, errChan chan<- cmdResult, iNickname string, iDef *prj.InstanceDef) {
+				stepStartTs := time.Now()
+				events.Emit(event.NewStepStarted(cmd, iNickname))
+				var logMsg l.LogMsg
+				var err error
+				switch cmd {
+				case CmdUploadFiles:
+					logMsg, err = rexec.UploadFiles(deployProvider.getDeployCtx().GoCtx, prj.SshConfig, iDef.BestIpAddress(), execArgs.SrcPath, execArgs.DstPath, execArgs.Permissions, execArgs.Owner, execArgs.Verbosity)
+				case CmdDownloadFiles:
+					// Each instance gets its own local subdirectory, so same-named files from different instances do not collide
+					logMsg, err = rexec.DownloadFiles(deployProvider.getDeployCtx().GoCtx, prj.SshConfig, iDef.BestIpAddress(), execArgs.SrcPath, filepath.Join(execArgs.DstPath, iNickname), execArgs.Verbosity)
+				default:
+					err = fmt.Errorf("unknown file transfer command:%s", cmd)
+				}
+				events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+				errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 				<-sem
-			}(deployProvider.getDeployCtx().Project, cOut, errChan, iDef)
+			}(deployProvider.getDeployCtx().Project, errChan, iNickname, iDef)
 		}
 
 	} else if cmd == CmdCreateVolumes || cmd == CmdAttachVolumes || cmd == CmdDetachVolumes || cmd == CmdDeleteVolumes {
 		if len(nicknames) == 0 {
 			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
 		if err != nil {
-			cErr <- err.Error()
-			return err
+			events.Emit(event.NewError(err))
+			return nil, err
 		}
 
 		volCount := 0
@@ -564,94 +1057,163 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 			volCount += len(iDef.Volumes)
 		}
 		if volCount == 0 {
-			fmt.Printf("No volumes to create/attach/detach/delete")
-			return nil
+			events.Emit(event.NewMessage("No volumes to create/attach/detach/delete"))
+			return nil, nil
 		}
 		errorsExpected = volCount
-		errChan = make(chan error, volCount)
+		errChan = make(chan cmdResult, volCount)
 		for iNickname, iDef := range instances {
 			for volNickname := range iDef.Volumes {
-				<-throttle.C
+				if isCancelledBeforeStart(deployProvider.getDeployCtx().GoCtx, errChan, iNickname) {
+					continue
+				}
 				sem <- 1
 				switch cmd {
 				case CmdCreateVolumes:
-					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
-						logMsg, err := deployProvider.CreateVolume(iNickname, volNickname)
-						logChan <- string(logMsg)
-						errChan <- err
+					go func(project *prj.Project, errChan chan<- cmdResult, iNickname string, volNickname string) {
+						stepStartTs := time.Now()
+						events.Emit(event.NewStepStarted(cmd, iNickname))
+						logMsg, err := instanceProvider(deployProvider, iNickname).CreateVolume(iNickname, volNickname)
+						events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+						errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 						<-sem
-					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+					}(deployProvider.getDeployCtx().Project, errChan, iNickname, volNickname)
 				case CmdAttachVolumes:
 					logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-					cOut <- string(logMsgBastionIp)
+					events.Emit(event.NewLog(logMsgBastionIp))
 					if err != nil {
-						cErr <- err.Error()
-						return err
+						events.Emit(event.NewError(err))
+						return nil, err
 					}
-					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
-						logMsg, err := deployProvider.AttachVolume(iNickname, volNickname)
-						logChan <- string(logMsg)
-						errChan <- err
+					go func(project *prj.Project, errChan chan<- cmdResult, iNickname string, volNickname string) {
+						stepStartTs := time.Now()
+						events.Emit(event.NewStepStarted(cmd, iNickname))
+						logMsg, err := instanceProvider(deployProvider, iNickname).AttachVolume(iNickname, volNickname)
+						events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+						errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 						<-sem
-					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+					}(deployProvider.getDeployCtx().Project, errChan, iNickname, volNickname)
 				case CmdDetachVolumes:
 					logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
-					cOut <- string(logMsgBastionIp)
+					events.Emit(event.NewLog(logMsgBastionIp))
 					if err != nil {
-						cErr <- err.Error()
-						return err
+						events.Emit(event.NewError(err))
+						return nil, err
 					}
-					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
-						logMsg, err := deployProvider.DetachVolume(iNickname, volNickname)
-						logChan <- string(logMsg)
-						errChan <- err
+					go func(project *prj.Project, errChan chan<- cmdResult, iNickname string, volNickname string) {
+						stepStartTs := time.Now()
+						events.Emit(event.NewStepStarted(cmd, iNickname))
+						logMsg, err := instanceProvider(deployProvider, iNickname).DetachVolume(iNickname, volNickname)
+						events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+						errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 						<-sem
-					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+					}(deployProvider.getDeployCtx().Project, errChan, iNickname, volNickname)
 				case CmdDeleteVolumes:
-					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
-						logMsg, err := deployProvider.DeleteVolume(iNickname, volNickname)
-						logChan <- string(logMsg)
-						errChan <- err
+					go func(project *prj.Project, errChan chan<- cmdResult, iNickname string, volNickname string) {
+						stepStartTs := time.Now()
+						events.Emit(event.NewStepStarted(cmd, iNickname))
+						logMsg, err := instanceProvider(deployProvider, iNickname).DeleteVolume(iNickname, volNickname)
+						events.Emit(event.NewStepFinished(cmd, iNickname, logMsg, time.Since(stepStartTs), err))
+						errChan <- cmdResult{iNickname, err, logMsg, time.Since(stepStartTs)}
 						<-sem
-					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+					}(deployProvider.getDeployCtx().Project, errChan, iNickname, volNickname)
 				default:
 					err := fmt.Errorf("unknown cmd %s", cmd)
-					cErr <- err.Error()
-					return err
+					events.Emit(event.NewError(err))
+					return nil, err
 				}
 			}
 		}
+	} else if cmd == CmdWaitCassNodesJoined {
+		if len(nicknames) == 0 {
+			err := fmt.Errorf("not enough args, expected comma-separated list of cassandra instances")
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+		events.Emit(event.NewLog(logMsgBastionIp))
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		// One wait loop for all of them, failure is not attributed to a particular instance
+		errorsExpected = 1
+		errChan = make(chan cmdResult, errorsExpected)
+		go func() {
+			stepStartTs := time.Now()
+			logMsg, err := deployProvider.WaitCassNodesJoined(sortedInstanceNicknames(instances))
+			events.Emit(event.NewLog(logMsg))
+			errChan <- cmdResult{"", err, logMsg, time.Since(stepStartTs)}
+		}()
 	} else {
 		err := fmt.Errorf("unknown cmd %s", cmd)
-		cErr <- err.Error()
-		return err
+		events.Emit(event.NewError(err))
+		return nil, err
 	}
 
 	// Wait for all workers to finish
 
 	var finalCmdErr error
+	failedNicknameMap := map[string]struct{}{}
+	completedNicknameMap := map[string]struct{}{}
+	notStartedNicknameMap := map[string]struct{}{}
+	resultMap := map[string]*InstanceCmdResult{}
 	for errorsExpected > 0 {
-		cmdErr := <-errChan
-		if cmdErr != nil {
-			cErr <- cmdErr.Error()
-			finalCmdErr = cmdErr
+		cmdRes := <-errChan
+		addCmdResult(resultMap, cmd, &cmdRes)
+		if cmdRes.Err == errCancelledBeforeStart {
+			finalCmdErr = cmdRes.Err
+			notStartedNicknameMap[cmdRes.Nickname] = struct{}{}
+		} else if cmdRes.Err != nil {
+			events.Emit(event.NewError(cmdRes.Err).WithStep(cmd, cmdRes.Nickname))
+			finalCmdErr = cmdRes.Err
+			if cmdRes.Nickname != "" {
+				failedNicknameMap[cmdRes.Nickname] = struct{}{}
+			}
+		} else if cmdRes.Nickname != "" {
+			completedNicknameMap[cmdRes.Nickname] = struct{}{}
 		}
 		errorsExpected--
 	}
+	// Volume commands report once per volume, an instance is complete only if all its volumes are
+	for iNickname := range failedNicknameMap {
+		delete(completedNicknameMap, iNickname)
+	}
+	for iNickname := range notStartedNicknameMap {
+		delete(completedNicknameMap, iNickname)
+		failedNicknameMap[iNickname] = struct{}{}
+	}
+	results := make([]*InstanceCmdResult, 0, len(resultMap))
+	for _, r := range resultMap {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Nickname < results[j].Nickname })
+
+	if deployProvider.getDeployCtx().GoCtx.Err() != nil {
+		events.Emit(event.NewMessage(fmt.Sprintf("%s INTERRUPTED: completed on [%s], failed or interrupted on [%s], not started on [%s]",
+			cmd,
+			strings.Join(sortedKeys(completedNicknameMap), ","),
+			strings.Join(sortedKeys(failedNicknameMap), ","),
+			strings.Join(sortedKeys(notStartedNicknameMap), ","))))
+	}
 
 	if execArgs.ShowProjectDetails {
 		prjJsonBytes, err := json.MarshalIndent(deployProvider.getDeployCtx().Project, "", "    ")
 		if err != nil {
-			return fmt.Errorf("cannot show project json: %s", err.Error())
+			return results, fmt.Errorf("cannot show project json: %s", err.Error())
 		}
-		cOut <- string(prjJsonBytes)
+		events.Emit(event.NewMessage(string(prjJsonBytes)))
 	}
 
-	if finalCmdErr != nil {
-		cOut <- fmt.Sprintf("%s %sERROR%s, elapsed %.3fs", cmd, l.LogColorRed, l.LogColorReset, time.Since(cmdStartTs).Seconds())
-	} else {
-		cOut <- fmt.Sprintf("%s %sOK%s, elapsed %.3fs", cmd, l.LogColorGreen, l.LogColorReset, time.Since(cmdStartTs).Seconds())
-	}
+	events.Emit(event.NewStepFinished(cmd, "", "", time.Since(cmdStartTs), finalCmdErr))
 
-	return finalCmdErr
+	return results, finalCmdErr
 }
@@ -1,9 +1,11 @@
 package provider
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
@@ -13,8 +15,16 @@ import (
 
 type deployProviderImpl interface {
 	getDeployCtx() *DeployCtx
-	listDeployments() (map[string]int, l.LogMsg, error)
+	withGoCtx(goCtx context.Context) deployProviderImpl
+	listDeployments(withState bool) ([]*cld.Resource, l.LogMsg, error)
 	listDeploymentResources() ([]*cld.Resource, l.LogMsg, error)
+	checkDrift() (*DriftReport, l.LogMsg, error)
+	deleteDeploymentByTag(deploymentName string) (l.LogMsg, error)
+	planDeleteDeploymentByTag(deploymentName string) ([]*PlanItem, l.LogMsg, error)
+	acquireLock(deploymentName string, operation string) (l.LogMsg, error)
+	renewLock(deploymentName string) (l.LogMsg, error)
+	releaseLock(deploymentName string) (l.LogMsg, error)
+	forceUnlock(deploymentName string) (l.LogMsg, error)
 	CreateFloatingIps() (l.LogMsg, error)
 	DeleteFloatingIps() (l.LogMsg, error)
 	CreateSecurityGroups() (l.LogMsg, error)
@@ -35,40 +45,86 @@ type deployProviderImpl interface {
 	DeleteVolume(iNickname string, volNickname string) (l.LogMsg, error)
 	PopulateInstanceExternalAddressByName() (l.LogMsg, error)
 	CheckCassStatus() (l.LogMsg, error)
+	WaitCassNodesJoined(nicknames []string) (l.LogMsg, error)
+	getMissingInstances(instances map[string]*prj.InstanceDef) ([]string, l.LogMsg, error)
+	planSimpleCmd(pc *planCtx, cmd string, instances map[string]*prj.InstanceDef, execArgs *ExecArgs) (l.LogMsg, error)
 }
 
-func isAllNodesJoined(strOut string, instances map[string]*prj.InstanceDef) error {
-	missingIps := make([]string, 0)
-	for _, iDef := range instances {
-		if iDef.Purpose == string(prj.InstancePurposeCassandra) {
-			re := regexp.MustCompile(`UN  ` + iDef.IpAddress)
-			matches := re.FindAllString(strOut, -1)
-			if len(matches) == 0 {
-				missingIps = append(missingIps, iDef.IpAddress)
-			}
-		}
+// Every Cassandra node must see all project Cassandra nodes as UN, nodes that have just been started get some time for that
+func (p *AwsDeployProvider) CheckCassStatus() (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+
+	cassInstances := instancesByPurpose(p.DeployCtx.Project, prj.InstancePurposeCassandra)
+	if len(cassInstances) == 0 {
+		return lb.Complete(fmt.Errorf("cannot find even a single cassandra node"))
 	}
-	if len(missingIps) > 0 {
-		return fmt.Errorf("nodes did not join cassandra cluster: %s", strings.Join(missingIps, ","))
+
+	results, err := waitHealthy(p.DeployCtx, cassInstances, p.DeployCtx.Project.Timeouts.ServiceReady, lb.Add)
+
+	table, _ := FormatHealthResults(results, cld.OutputFormatTable)
+	lb.Add(table)
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cassandra cluster is not healthy: %s\n%s", err.Error(), table))
 	}
-	return nil
+	return lb.Complete(nil)
 }
 
-func (p *AwsDeployProvider) CheckCassStatus() (l.LogMsg, error) {
-	for _, iDef := range p.DeployCtx.Project.Instances {
-		if iDef.Purpose == string(prj.InstancePurposeCassandra) {
-			logMsg, err := rexec.ExecCommandOnInstance(p.DeployCtx.Project.SshConfig, iDef.IpAddress, "nodetool describecluster;nodetool status", true)
-			if err == nil {
-				// All Cassandra nodes must have "UN  $cassNodeIp"
-				err = isAllNodesJoined(string(logMsg), p.DeployCtx.Project.Instances)
-			}
-			if p.DeployCtx.IsVerbose {
-				return logMsg, err
-			} else {
-				return "", err
-			}
+const cassJoinPollInterval time.Duration = 10 * time.Second
+
+// Waits until nodetool status, as seen by some other node, reports each of the nicknames as UN (up, normal).
+// New nodes bootstrap one at a time, so this is called after each of them was configured and started.
+func (p *AwsDeployProvider) WaitCassNodesJoined(nicknames []string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+strings.Join(nicknames, ","), p.DeployCtx.IsVerbose)
+
+	waitedIps := map[string]string{}
+	for _, iNickname := range nicknames {
+		iDef, ok := p.DeployCtx.Project.Instances[iNickname]
+		if !ok || iDef.Purpose != string(prj.InstancePurposeCassandra) {
+			return lb.Complete(fmt.Errorf("%s is not a cassandra instance", iNickname))
 		}
+		waitedIps[iNickname] = iDef.IpAddress
 	}
 
-	return "", fmt.Errorf("cannot find even a single cassandra node")
+	// Ask a node that is already in the cluster, if there is one
+	queryIp := ""
+	for _, iNickname := range sortedInstanceNicknames(p.DeployCtx.Project.Instances) {
+		iDef := p.DeployCtx.Project.Instances[iNickname]
+		if iDef.Purpose != string(prj.InstancePurposeCassandra) {
+			continue
+		}
+		if _, ok := waitedIps[iNickname]; !ok {
+			queryIp = iDef.IpAddress
+			break
+		}
+	}
+	if queryIp == "" {
+		queryIp = waitedIps[nicknames[0]]
+	}
+
+	goCtx := p.DeployCtx.GoCtx
+	timeout := time.Duration(p.DeployCtx.Project.Timeouts.JoinCassandra) * time.Second
+	startTime := time.Now()
+	for {
+		er := rexec.ExecSsh(goCtx, p.DeployCtx.Project.SshConfig, queryIp, "nodetool status", map[string]string{})
+		notJoined := make([]string, 0)
+		for _, iNickname := range nicknames {
+			if er.ExitStatus != 0 || !regexp.MustCompile(`UN\s+`+regexp.QuoteMeta(waitedIps[iNickname])+`\s`).MatchString(er.Stdout) {
+				notJoined = append(notJoined, iNickname)
+			}
+		}
+		if len(notJoined) == 0 {
+			lb.Add(er.ToString())
+			return lb.Complete(nil)
+		}
+		if time.Since(startTime) > timeout {
+			lb.Add(er.ToString())
+			return lb.Complete(fmt.Errorf("cassandra nodes %s did not join the cluster in %ds, check nodetool status on %s", strings.Join(notJoined, ","), p.DeployCtx.Project.Timeouts.JoinCassandra, queryIp))
+		}
+		lb.Add(fmt.Sprintf("%s not joined yet after %.0fs", strings.Join(notJoined, ","), time.Since(startTime).Seconds()))
+		select {
+		case <-goCtx.Done():
+			return lb.Complete(fmt.Errorf("cancelled while waiting for cassandra nodes %s to join: %s", strings.Join(notJoined, ","), goCtx.Err().Error()))
+		case <-time.After(cassJoinPollInterval):
+		}
+	}
 }
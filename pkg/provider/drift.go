@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+)
+
+type DriftKind string
+
+const (
+	DriftKindMissing  DriftKind = "missing"  // In the project, not in the cloud
+	DriftKindExtra    DriftKind = "extra"    // Tagged with this deployment name in the cloud, not in the project
+	DriftKindMismatch DriftKind = "mismatch" // In both, but some attribute differs
+)
+
+type DriftItem struct {
+	Kind         DriftKind `json:"kind"`
+	ResourceType string    `json:"resource_type"`
+	Name         string    `json:"name"`
+	Id           string    `json:"id,omitempty"`
+	Attribute    string    `json:"attribute,omitempty"`
+	Expected     string    `json:"expected,omitempty"`
+	Actual       string    `json:"actual,omitempty"`
+}
+
+func (di *DriftItem) String() string {
+	if di.Kind == DriftKindMismatch {
+		return fmt.Sprintf("%s %s %s(%s) %s: expected %s, actual %s", di.Kind, di.ResourceType, di.Name, di.Id, di.Attribute, di.Expected, di.Actual)
+	}
+	return fmt.Sprintf("%s %s %s(%s)", di.Kind, di.ResourceType, di.Name, di.Id)
+}
+
+type DriftReport struct {
+	DeploymentName string       `json:"deployment_name"`
+	Items          []*DriftItem `json:"items"`
+}
+
+func (r *DriftReport) addMissing(resourceType string, name string) {
+	r.Items = append(r.Items, &DriftItem{Kind: DriftKindMissing, ResourceType: resourceType, Name: name})
+}
+
+func (r *DriftReport) addExtra(resourceType string, name string, id string) {
+	r.Items = append(r.Items, &DriftItem{Kind: DriftKindExtra, ResourceType: resourceType, Name: name, Id: id})
+}
+
+// Adds a mismatch item only if expected and actual differ
+func (r *DriftReport) checkAttr(resourceType string, name string, id string, attribute string, expected string, actual string) {
+	if expected != actual {
+		r.Items = append(r.Items, &DriftItem{Kind: DriftKindMismatch, ResourceType: resourceType, Name: name, Id: id, Attribute: attribute, Expected: expected, Actual: actual})
+	}
+}
+
+func genericCheckDrift(p deployProviderImpl, events event.Sink) (*DriftReport, error) {
+	report, logMsg, err := p.checkDrift()
+	events.Emit(event.NewLog(logMsg))
+	if err != nil {
+		events.Emit(event.NewError(err))
+	}
+	return report, err
+}
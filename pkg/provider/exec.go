@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+type InstanceExecResult struct {
+	Nickname   string
+	IpAddress  string
+	Stdout     string
+	Stderr     string
+	ExitStatus int // rexec.ExitStatusUnknown if the command could not be run
+	Elapsed    float64
+	Err        error
+}
+
+// Remote stderr alone does not make it a failure: df, nodetool etc write warnings there
+func (r *InstanceExecResult) IsFailed() bool {
+	return r.ExitStatus != 0
+}
+
+func (r *InstanceExecResult) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("===== %s (%s) exit status %s, %.3fs\n", r.Nickname, r.IpAddress, exitStatusToString(r.ExitStatus), r.Elapsed))
+	r.writeOutput(&sb)
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func (r *InstanceExecResult) writeOutput(sb *strings.Builder) {
+	if r.Stdout != "" {
+		sb.WriteString(strings.TrimRight(r.Stdout, "\n") + "\n")
+	}
+	if r.Stderr != "" {
+		sb.WriteString("----- stderr:\n")
+		sb.WriteString(strings.TrimRight(r.Stderr, "\n") + "\n")
+	}
+	if r.ExitStatus == rexec.ExitStatusUnknown && r.Err != nil {
+		sb.WriteString(fmt.Sprintf("----- error: %s\n", r.Err.Error()))
+	}
+}
+
+func exitStatusToString(exitStatus int) string {
+	if exitStatus == rexec.ExitStatusUnknown {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d", exitStatus)
+}
+
+// Runs shellCmd on all instances matching nicknames in parallel, reports each host output as soon as it is available.
+// Returns results sorted by nickname, error is not nil if the command failed or returned non-zero status on any host.
+func genericExecOnInstances(p deployProviderImpl, nicknames string, shellCmd string, events event.Sink) ([]*InstanceExecResult, error) {
+	if len(nicknames) == 0 {
+		err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	if strings.TrimSpace(shellCmd) == "" {
+		err := fmt.Errorf("not enough args, expected shell command to execute (-c)")
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	instances, err := filterByNickname(nicknames, p.getDeployCtx().Project.Instances, "instance")
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		events.Emit(event.NewLog(logMsgBastionIp))
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsgBastionIp))
+	}
+
+	goCtx := p.getDeployCtx().GoCtx
+	sem := p.getDeployCtx().SshSem
+	resultChan := make(chan *InstanceExecResult, len(instances))
+	for iNickname, iDef := range instances {
+		if goCtx.Err() != nil {
+			resultChan <- &InstanceExecResult{iNickname, iDef.BestIpAddress(), "", "", rexec.ExitStatusUnknown, 0, errCancelledBeforeStart}
+			continue
+		}
+		sem <- 1
+		go func(iNickname string, iDef *prj.InstanceDef) {
+			er := rexec.ExecSsh(goCtx, p.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), shellCmd, map[string]string{})
+			resultChan <- &InstanceExecResult{iNickname, iDef.BestIpAddress(), er.Stdout, er.Stderr, er.ExitStatus, er.Elapsed, er.Error}
+			<-sem
+		}(iNickname, iDef)
+	}
+
+	results := make([]*InstanceExecResult, 0, len(instances))
+	failedCount := 0
+	for range instances {
+		r := <-resultChan
+		results = append(results, r)
+		if r.IsFailed() {
+			failedCount++
+			events.Emit(event.NewError(errors.New(r.String())).WithStep(CmdExec, r.Nickname))
+		} else {
+			events.Emit(event.NewMessage(r.String()).WithStep(CmdExec, r.Nickname))
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Nickname < results[j].Nickname })
+
+	if goCtx.Err() != nil {
+		err := fmt.Errorf("cancelled: %s", goCtx.Err().Error())
+		events.Emit(event.NewError(err))
+		return results, err
+	}
+	if failedCount > 0 {
+		err := fmt.Errorf("command failed on %d of %d instances", failedCount, len(results))
+		events.Emit(event.NewError(err))
+		return results, err
+	}
+	return results, nil
+}
+
+// Groups hosts that returned identical stdout, stderr and exit status, so differences across a cluster stand out.
+// Largest groups go first.
+func FormatExecSummary(results []*InstanceExecResult) string {
+	type execOutputGroup struct {
+		sample    *InstanceExecResult
+		nicknames []string
+	}
+	groupMap := map[string]*execOutputGroup{}
+	groups := make([]*execOutputGroup, 0)
+	for _, r := range results {
+		key := fmt.Sprintf("%d\x00%s\x00%s", r.ExitStatus, r.Stdout, r.Stderr)
+		if r.ExitStatus == rexec.ExitStatusUnknown && r.Err != nil {
+			key += "\x00" + r.Err.Error()
+		}
+		g, ok := groupMap[key]
+		if !ok {
+			g = &execOutputGroup{sample: r}
+			groupMap[key] = g
+			groups = append(groups, g)
+		}
+		g.nicknames = append(g.nicknames, r.Nickname)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i].nicknames) > len(groups[j].nicknames) })
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Summary: %d instances, %d distinct outputs\n", len(results), len(groups)))
+	for _, g := range groups {
+		sb.WriteString(fmt.Sprintf("===== %d instance(s), exit status %s: %s\n", len(g.nicknames), exitStatusToString(g.sample.ExitStatus), strings.Join(g.nicknames, ",")))
+		g.sample.writeOutput(&sb)
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,349 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+type HealthStatus string
+
+const (
+	HealthStatusOk   HealthStatus = "ok"
+	HealthStatusWarn HealthStatus = "warn" // Worth a look, but does not make the instance unhealthy
+	HealthStatusFail HealthStatus = "fail"
+)
+
+type HealthCheckResult struct {
+	Nickname string       `json:"nickname"`
+	Purpose  string       `json:"purpose"`
+	Check    string       `json:"check"`
+	Status   HealthStatus `json:"status"`
+	Detail   string       `json:"detail"`
+}
+
+// Cmd runs on the instance with the instance service env. Non-zero exit status is a failure,
+// otherwise Eval (if any) looks at the stdout.
+type healthCheck struct {
+	Name string
+	Cmd  func(project *prj.Project, iDef *prj.InstanceDef) string
+	Eval func(project *prj.Project, iDef *prj.InstanceDef, stdout string) (HealthStatus, string)
+}
+
+const healthRetryInterval time.Duration = 10 * time.Second
+
+// Daemon log not written to for longer than that may mean an idle or a stuck daemon
+const daemonLogMaxAgeSeconds int = 900
+
+func fixedCmd(cmd string) func(*prj.Project, *prj.InstanceDef) string {
+	return func(*prj.Project, *prj.InstanceDef) string { return cmd }
+}
+
+func systemdUnitCheck(unit string) healthCheck {
+	return healthCheck{unit, fixedCmd("systemctl is-active " + unit), nil}
+}
+
+var healthChecks map[prj.InstancePurpose][]healthCheck = map[prj.InstancePurpose][]healthCheck{
+	prj.InstancePurposeBastion: {
+		systemdUnitCheck("nginx"),
+		{"webapi", func(_ *prj.Project, iDef *prj.InstanceDef) string {
+			port := iDef.Service.Env["INTERNAL_WEBAPI_PORT"]
+			if port == "" {
+				port = "6543"
+			}
+			return fmt.Sprintf("curl -s -m 5 -o /dev/null -w '%%{http_code}' http://localhost:%s/ks", port)
+		}, evalWebapiHttpCode}},
+	prj.InstancePurposeRabbitmq: {
+		{"management_api", fixedCmd(`curl -sf -m 5 -u "$RABBITMQ_ADMIN_NAME:$RABBITMQ_ADMIN_PASS" http://localhost:15672/api/overview`), evalRabbitmqOverview},
+		{"queues", fixedCmd(`curl -sf -m 5 -u "$RABBITMQ_ADMIN_NAME:$RABBITMQ_ADMIN_PASS" http://localhost:15672/api/queues`), evalRabbitmqQueues}},
+	prj.InstancePurposePrometheus: {
+		systemdUnitCheck("prometheus"),
+		{"targets", fixedCmd("curl -sf -m 5 'http://localhost:9090/api/v1/targets?state=active'"), evalPrometheusTargets}},
+	prj.InstancePurposeDaemon: {
+		{"capidaemon", fixedCmd("pgrep -c capidaemon"), nil},
+		systemdUnitCheck("node_exporter"),
+		{"log", fixedCmd("echo $(( $(date +%s) - $(stat -c %Y /var/log/capidaemon/capidaemon.log) ))"), evalDaemonLogAge}},
+	prj.InstancePurposeCassandra: {
+		systemdUnitCheck("cassandra"),
+		{"ring", fixedCmd("nodetool status"), evalCassandraRing}}}
+
+func evalWebapiHttpCode(_ *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	code, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil || code == 0 {
+		return HealthStatusFail, "no http response"
+	}
+	if code >= 500 {
+		return HealthStatusFail, fmt.Sprintf("http %d", code)
+	}
+	return HealthStatusOk, fmt.Sprintf("http %d", code)
+}
+
+func evalRabbitmqOverview(_ *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	var overview struct {
+		RabbitmqVersion string `json:"rabbitmq_version"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &overview); err != nil {
+		return HealthStatusFail, fmt.Sprintf("cannot parse /api/overview: %s", err.Error())
+	}
+	return HealthStatusOk, "rabbitmq " + overview.RabbitmqVersion
+}
+
+func evalRabbitmqQueues(_ *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	var queues []struct {
+		Name      string `json:"name"`
+		Messages  int    `json:"messages"`
+		Consumers int    `json:"consumers"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &queues); err != nil {
+		return HealthStatusFail, fmt.Sprintf("cannot parse /api/queues: %s", err.Error())
+	}
+	totalMessages := 0
+	orphaned := make([]string, 0)
+	for _, q := range queues {
+		totalMessages += q.Messages
+		if q.Messages > 0 && q.Consumers == 0 {
+			orphaned = append(orphaned, fmt.Sprintf("%s(%d)", q.Name, q.Messages))
+		}
+	}
+	detail := fmt.Sprintf("%d queues, %d messages", len(queues), totalMessages)
+	if len(orphaned) > 0 {
+		sort.Strings(orphaned)
+		return HealthStatusWarn, detail + ", no consumers for " + strings.Join(orphaned, ",")
+	}
+	return HealthStatusOk, detail
+}
+
+func evalPrometheusTargets(_ *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	var resp struct {
+		Data struct {
+			ActiveTargets []struct {
+				ScrapeUrl string `json:"scrapeUrl"`
+				Health    string `json:"health"`
+			} `json:"activeTargets"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &resp); err != nil {
+		return HealthStatusFail, fmt.Sprintf("cannot parse targets: %s", err.Error())
+	}
+	down := make([]string, 0)
+	for _, t := range resp.Data.ActiveTargets {
+		if t.Health != "up" {
+			down = append(down, t.ScrapeUrl)
+		}
+	}
+	total := len(resp.Data.ActiveTargets)
+	if total == 0 {
+		return HealthStatusFail, "no active targets"
+	}
+	if len(down) > 0 {
+		sort.Strings(down)
+		return HealthStatusFail, fmt.Sprintf("%d/%d targets up, down: %s", total-len(down), total, strings.Join(down, ","))
+	}
+	return HealthStatusOk, fmt.Sprintf("%d/%d targets up", total, total)
+}
+
+func evalDaemonLogAge(_ *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	ageSeconds, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil {
+		return HealthStatusFail, fmt.Sprintf("cannot get log age: %s", strings.TrimSpace(stdout))
+	}
+	detail := fmt.Sprintf("written %ds ago", ageSeconds)
+	if ageSeconds > daemonLogMaxAgeSeconds {
+		return HealthStatusWarn, detail
+	}
+	return HealthStatusOk, detail
+}
+
+var nodetoolStatusLineRegex = regexp.MustCompile(`^([UD][NLJM])\s+(\S+)\s`)
+
+// Each node has its own view of the ring: all project Cassandra nodes must be there and UN (up, normal)
+func evalCassandraRing(project *prj.Project, _ *prj.InstanceDef, stdout string) (HealthStatus, string) {
+	seen := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		if m := nodetoolStatusLineRegex.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			seen[m[2]] = m[1]
+		}
+	}
+	expectedCount := 0
+	upCount := 0
+	problems := make([]string, 0)
+	for _, iNickname := range sortedInstanceNicknames(instancesByPurpose(project, prj.InstancePurposeCassandra)) {
+		ip := project.Instances[iNickname].IpAddress
+		expectedCount++
+		state, ok := seen[ip]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s missing", ip))
+		} else if state != "UN" {
+			problems = append(problems, fmt.Sprintf("%s %s", ip, state))
+		} else {
+			upCount++
+		}
+		delete(seen, ip)
+	}
+	for ip, state := range seen {
+		problems = append(problems, fmt.Sprintf("%s %s not in project", ip, state))
+	}
+	detail := fmt.Sprintf("%d/%d UN", upCount, expectedCount)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return HealthStatusFail, detail + ", " + strings.Join(problems, ",")
+	}
+	return HealthStatusOk, detail
+}
+
+func lastNonEmptyLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func runInstanceHealthChecks(goCtx context.Context, project *prj.Project, iNickname string, iDef *prj.InstanceDef) []*HealthCheckResult {
+	results := make([]*HealthCheckResult, 0)
+	for _, check := range healthChecks[prj.InstancePurpose(iDef.Purpose)] {
+		r := &HealthCheckResult{Nickname: iNickname, Purpose: inventoryGroupName(iDef), Check: check.Name}
+		er := rexec.ExecSsh(goCtx, project.SshConfig, iDef.BestIpAddress(), check.Cmd(project, iDef), iDef.Service.Env)
+		if er.Error != nil || er.ExitStatus != 0 {
+			r.Status = HealthStatusFail
+			r.Detail = lastNonEmptyLine(er.Stderr + "\n" + er.Stdout)
+			if r.Detail == "" && er.Error != nil {
+				r.Detail = er.Error.Error()
+			}
+		} else if check.Eval != nil {
+			r.Status, r.Detail = check.Eval(project, iDef, er.Stdout)
+		} else {
+			r.Status, r.Detail = HealthStatusOk, lastNonEmptyLine(er.Stdout)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// All checks of all instances, sorted by nickname. Instances are checked in parallel, checks of one instance one after another.
+func runHealthChecks(deployCtx *DeployCtx, instances map[string]*prj.InstanceDef) []*HealthCheckResult {
+	resultChan := make(chan []*HealthCheckResult, len(instances))
+	for iNickname, iDef := range instances {
+		deployCtx.SshSem <- 1
+		go func(iNickname string, iDef *prj.InstanceDef) {
+			resultChan <- runInstanceHealthChecks(deployCtx.GoCtx, deployCtx.Project, iNickname, iDef)
+			<-deployCtx.SshSem
+		}(iNickname, iDef)
+	}
+	results := make([]*HealthCheckResult, 0)
+	for range instances {
+		results = append(results, <-resultChan...)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Nickname < results[j].Nickname })
+	return results
+}
+
+func countFailedHealthChecks(results []*HealthCheckResult) int {
+	failedCount := 0
+	for _, r := range results {
+		if r.Status == HealthStatusFail {
+			failedCount++
+		}
+	}
+	return failedCount
+}
+
+// Repeats the checks until none of them fails or timeoutSeconds pass. With zero timeout, checks once.
+func waitHealthy(deployCtx *DeployCtx, instances map[string]*prj.InstanceDef, timeoutSeconds int, logRetry func(string)) ([]*HealthCheckResult, error) {
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	startTime := time.Now()
+	for {
+		results := runHealthChecks(deployCtx, instances)
+		failedCount := countFailedHealthChecks(results)
+		if failedCount == 0 {
+			return results, nil
+		}
+		if time.Since(startTime)+healthRetryInterval > timeout {
+			if timeoutSeconds > 0 {
+				return results, fmt.Errorf("%d of %d health checks still failing after %ds", failedCount, len(results), timeoutSeconds)
+			}
+			return results, fmt.Errorf("%d of %d health checks failed", failedCount, len(results))
+		}
+		logRetry(fmt.Sprintf("%d of %d health checks failing after %.0fs, retrying", failedCount, len(results), time.Since(startTime).Seconds()))
+		select {
+		case <-deployCtx.GoCtx.Done():
+			return results, fmt.Errorf("cancelled while waiting for instances to become healthy: %s", deployCtx.GoCtx.Err().Error())
+		case <-time.After(healthRetryInterval):
+		}
+	}
+}
+
+func genericHealth(p deployProviderImpl, nicknames string, waitSeconds int, events event.Sink) ([]*HealthCheckResult, error) {
+	if len(nicknames) == 0 {
+		err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	instances, err := filterByNickname(nicknames, p.getDeployCtx().Project.Instances, "instance")
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		events.Emit(event.NewLog(logMsgBastionIp))
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsgBastionIp))
+	}
+
+	results, err := waitHealthy(p.getDeployCtx(), instances, waitSeconds, func(msg string) { events.Emit(event.NewMessage(msg)) })
+	if err != nil {
+		events.Emit(event.NewError(err))
+	}
+	return results, err
+}
+
+// Table for humans, or json/csv
+func FormatHealthResults(results []*HealthCheckResult, format string) (string, error) {
+	switch format {
+	case cld.OutputFormatJson:
+		resultBytes, err := json.MarshalIndent(results, "", "    ")
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal health results: %s", err.Error())
+		}
+		return string(resultBytes), nil
+	case cld.OutputFormatCsv:
+		buf := bytes.Buffer{}
+		w := csv.NewWriter(&buf)
+		if err := w.Write([]string{"nickname", "purpose", "check", "status", "detail"}); err != nil {
+			return "", fmt.Errorf("cannot write health csv: %s", err.Error())
+		}
+		for _, r := range results {
+			if err := w.Write([]string{r.Nickname, r.Purpose, r.Check, string(r.Status), r.Detail}); err != nil {
+				return "", fmt.Errorf("cannot write health csv: %s", err.Error())
+			}
+		}
+		w.Flush()
+		return strings.TrimRight(buf.String(), "\n"), w.Error()
+	default:
+		buf := bytes.Buffer{}
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "INSTANCE\tPURPOSE\tCHECK\tSTATUS\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Nickname, r.Purpose, r.Check, r.Status, r.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return "", fmt.Errorf("cannot format health table: %s", err.Error())
+		}
+		return strings.TrimRight(buf.String(), "\n"), nil
+	}
+}
@@ -0,0 +1,254 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+const ungroupedInventoryGroup string = "ungrouped"
+
+// cass001 -> cassandra etc
+func inventoryGroupName(iDef *prj.InstanceDef) string {
+	if iDef.Purpose == "" {
+		return ungroupedInventoryGroup
+	}
+	return strings.ToLower(strings.TrimPrefix(iDef.Purpose, "CAPIDEPLOY.INTERNAL.PURPOSE_"))
+}
+
+func isEmbeddedPrivateKey(privateKeyOrPath string) bool {
+	return strings.Contains(privateKeyOrPath, "-----BEGIN ")
+}
+
+// Nicknames of instances reachable directly (bastion) and via bastion, both sorted
+func splitInstancesByReachability(project *prj.Project) ([]string, []string) {
+	direct := make([]string, 0)
+	viaBastion := make([]string, 0)
+	for iNickname, iDef := range project.Instances {
+		if iDef.ExternalIpAddress != "" {
+			direct = append(direct, iNickname)
+		} else {
+			viaBastion = append(viaBastion, iNickname)
+		}
+	}
+	sort.Strings(direct)
+	sort.Strings(viaBastion)
+	return direct, viaBastion
+}
+
+func inventoryHeader(project *prj.Project, commentPrefix string) string {
+	return fmt.Sprintf("%s Generated by capideploy %s for deployment %s, bastion %s\n", commentPrefix, CmdExportInventory, project.DeploymentName, project.SshConfig.BastionExternalIp)
+}
+
+// Use with ssh -F <file> <nickname>, or Include it from ~/.ssh/config
+func FormatSshConfig(project *prj.Project) string {
+	sshConfig := project.SshConfig
+	direct, viaBastion := splitInstancesByReachability(project)
+
+	sb := strings.Builder{}
+	sb.WriteString(inventoryHeader(project, "#"))
+	if isEmbeddedPrivateKey(sshConfig.PrivateKeyOrPath) {
+		sb.WriteString("# Private key is embedded in the project file, save it to a file and add IdentityFile to the entries below\n")
+	}
+	writeHost := func(iNickname string, hostName string, proxyJump string) {
+		sb.WriteString(fmt.Sprintf("\nHost %s\n", iNickname))
+		sb.WriteString(fmt.Sprintf("  HostName %s\n", hostName))
+		sb.WriteString(fmt.Sprintf("  Port %d\n", sshConfig.Port))
+		sb.WriteString(fmt.Sprintf("  User %s\n", sshConfig.User))
+		if !isEmbeddedPrivateKey(sshConfig.PrivateKeyOrPath) {
+			sb.WriteString(fmt.Sprintf("  IdentityFile %s\n", sshConfig.PrivateKeyOrPath))
+			sb.WriteString("  IdentitiesOnly yes\n")
+		}
+		if proxyJump != "" {
+			sb.WriteString(fmt.Sprintf("  ProxyJump %s\n", proxyJump))
+		}
+		// Instances are re-created with the same addresses all the time
+		sb.WriteString("  StrictHostKeyChecking no\n")
+		sb.WriteString("  UserKnownHostsFile /dev/null\n")
+	}
+	bastionAlias := ""
+	for _, iNickname := range direct {
+		writeHost(iNickname, project.Instances[iNickname].ExternalIpAddress, "")
+		if project.Instances[iNickname].ExternalIpAddress == sshConfig.BastionExternalIp {
+			bastionAlias = iNickname
+		}
+	}
+	for _, iNickname := range viaBastion {
+		writeHost(iNickname, project.Instances[iNickname].IpAddress, bastionAlias)
+	}
+	return sb.String()
+}
+
+// Internal addresses, as seen from inside the network (or through the SOCKS proxy)
+func FormatHostsFile(project *prj.Project) string {
+	nicknames := make([]string, 0, len(project.Instances))
+	for iNickname := range project.Instances {
+		nicknames = append(nicknames, iNickname)
+	}
+	sort.Strings(nicknames)
+
+	sb := strings.Builder{}
+	sb.WriteString(inventoryHeader(project, "#"))
+	for _, iNickname := range nicknames {
+		iDef := project.Instances[iNickname]
+		if iDef.InstName != "" && iDef.InstName != iNickname {
+			sb.WriteString(fmt.Sprintf("%-15s %s %s\n", iDef.IpAddress, iNickname, iDef.InstName))
+		} else {
+			sb.WriteString(fmt.Sprintf("%-15s %s\n", iDef.IpAddress, iNickname))
+		}
+	}
+	return sb.String()
+}
+
+type inventoryHost struct {
+	Nickname string
+	Vars     [][2]string // Ordered, so generated files are stable
+}
+
+// Groups sorted by name, hosts sorted by nickname
+func buildInventory(project *prj.Project) ([]string, map[string][]*inventoryHost) {
+	sshConfig := project.SshConfig
+	// Instances behind the bastion: connect through it, with the same key and without host key checks
+	proxyCommandIdentity := ""
+	if !isEmbeddedPrivateKey(sshConfig.PrivateKeyOrPath) {
+		proxyCommandIdentity = fmt.Sprintf("-i %s ", sshConfig.PrivateKeyOrPath)
+	}
+	viaBastionArgs := fmt.Sprintf(`-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o ProxyCommand="ssh -W %%h:%%p -p %d %s-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null %s@%s"`,
+		sshConfig.Port, proxyCommandIdentity, sshConfig.User, sshConfig.BastionExternalIp)
+	directArgs := "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+
+	groups := map[string][]*inventoryHost{}
+	direct, viaBastion := splitInstancesByReachability(project)
+	for _, iNickname := range append(direct, viaBastion...) {
+		iDef := project.Instances[iNickname]
+		host := &inventoryHost{Nickname: iNickname}
+		if iDef.ExternalIpAddress != "" {
+			host.Vars = append(host.Vars, [2]string{"ansible_host", iDef.ExternalIpAddress}, [2]string{"ansible_ssh_common_args", directArgs})
+		} else {
+			host.Vars = append(host.Vars, [2]string{"ansible_host", iDef.IpAddress}, [2]string{"ansible_ssh_common_args", viaBastionArgs})
+		}
+		host.Vars = append(host.Vars, [2]string{"internal_ip", iDef.IpAddress})
+		groupName := inventoryGroupName(iDef)
+		groups[groupName] = append(groups[groupName], host)
+	}
+	for _, hosts := range groups {
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Nickname < hosts[j].Nickname })
+	}
+	groupNames := make([]string, 0, len(groups))
+	for groupName := range groups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	return groupNames, groups
+}
+
+func inventoryCommonVars(sshConfig *rexec.SshConfigDef) [][2]string {
+	vars := [][2]string{{"ansible_user", sshConfig.User}, {"ansible_port", fmt.Sprintf("%d", sshConfig.Port)}}
+	if !isEmbeddedPrivateKey(sshConfig.PrivateKeyOrPath) {
+		vars = append(vars, [2]string{"ansible_ssh_private_key_file", sshConfig.PrivateKeyOrPath})
+	}
+	return vars
+}
+
+func yamlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Ansible YAML inventory, one group per instance purpose
+func FormatAnsibleYamlInventory(project *prj.Project) string {
+	groupNames, groups := buildInventory(project)
+	sb := strings.Builder{}
+	sb.WriteString(inventoryHeader(project, "#"))
+	sb.WriteString("all:\n  vars:\n")
+	for _, kv := range inventoryCommonVars(project.SshConfig) {
+		sb.WriteString(fmt.Sprintf("    %s: %s\n", kv[0], yamlQuote(kv[1])))
+	}
+	sb.WriteString("  children:\n")
+	for _, groupName := range groupNames {
+		sb.WriteString(fmt.Sprintf("    %s:\n      hosts:\n", groupName))
+		for _, host := range groups[groupName] {
+			sb.WriteString(fmt.Sprintf("        %s:\n", host.Nickname))
+			for _, kv := range host.Vars {
+				sb.WriteString(fmt.Sprintf("          %s: %s\n", kv[0], yamlQuote(kv[1])))
+			}
+		}
+	}
+	return sb.String()
+}
+
+func iniQuote(s string) string {
+	if !strings.ContainsAny(s, " '\"") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+// Ansible INI inventory, one group per instance purpose
+func FormatAnsibleIniInventory(project *prj.Project) string {
+	groupNames, groups := buildInventory(project)
+	sb := strings.Builder{}
+	sb.WriteString(inventoryHeader(project, ";"))
+	sb.WriteString("[all:vars]\n")
+	for _, kv := range inventoryCommonVars(project.SshConfig) {
+		sb.WriteString(fmt.Sprintf("%s=%s\n", kv[0], iniQuote(kv[1])))
+	}
+	for _, groupName := range groupNames {
+		sb.WriteString(fmt.Sprintf("\n[%s]\n", groupName))
+		for _, host := range groups[groupName] {
+			sb.WriteString(host.Nickname)
+			for _, kv := range host.Vars {
+				sb.WriteString(fmt.Sprintf(" %s=%s", kv[0], iniQuote(kv[1])))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// Writes <deployment>.ssh_config, <deployment>.hosts, <deployment>.inventory.yml and <deployment>.inventory.ini to dstDir
+func genericExportInventory(p deployProviderImpl, dstDir string, events event.Sink) error {
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		events.Emit(event.NewLog(logMsgBastionIp))
+		events.Emit(event.NewError(err))
+		return err
+	}
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsgBastionIp))
+	}
+
+	if dstDir == "" {
+		dstDir = "."
+	}
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		err = fmt.Errorf("cannot create inventory directory %s: %s", dstDir, err.Error())
+		events.Emit(event.NewError(err))
+		return err
+	}
+
+	project := p.getDeployCtx().Project
+	files := []struct {
+		suffix  string
+		content string
+	}{
+		{"ssh_config", FormatSshConfig(project)},
+		{"hosts", FormatHostsFile(project)},
+		{"inventory.yml", FormatAnsibleYamlInventory(project)},
+		{"inventory.ini", FormatAnsibleIniInventory(project)}}
+	for _, f := range files {
+		filePath := filepath.Join(dstDir, fmt.Sprintf("%s.%s", project.DeploymentName, f.suffix))
+		if err := os.WriteFile(filePath, []byte(f.content), 0644); err != nil {
+			err = fmt.Errorf("cannot write %s: %s", filePath, err.Error())
+			events.Emit(event.NewError(err))
+			return err
+		}
+		events.Emit(event.NewMessage(fmt.Sprintf("written %s", filePath)))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/audit"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+)
+
+// A lock that is not renewed for this long is considered stale: its holder crashed or lost connectivity
+const lockTtl time.Duration = 10 * time.Minute
+const lockRenewInterval time.Duration = 2 * time.Minute
+
+type DeploymentLock struct {
+	DeploymentName string `json:"deployment_name"`
+	Holder         string `json:"holder"`
+	Operation      string `json:"operation"`
+	AcquiredAt     string `json:"acquired_at"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+func (lock *DeploymentLock) String() string {
+	return fmt.Sprintf("deployment %s is locked by %s running %s since %s, lock expires at %s unless renewed", lock.DeploymentName, lock.Holder, lock.Operation, lock.AcquiredAt, lock.ExpiresAt)
+}
+
+func (lock *DeploymentLock) isExpired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, lock.ExpiresAt)
+	if err != nil {
+		// Not written by capideploy, leave it to force_unlock
+		return false
+	}
+	return now.After(expiresAt)
+}
+
+// Caller identity, host and process, so operators can tell who to talk to before force_unlock.
+// Session id tells apart jobs of one serve process.
+func lockHolder(deployCtx *DeployCtx) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown-host"
+	}
+	return fmt.Sprintf("%s@%s/%d/%s", deployCtx.CallerIdentity, hostname, os.Getpid(), deployCtx.SessionId)
+}
+
+// Commands that only look at the deployment, they do not need the lock and run while somebody else holds it
+func isReadOnlyCmd(cmd string) bool {
+	switch cmd {
+	case CmdPingInstances, CmdCheckCassStatus, CmdDownloadFiles, CmdWaitCassNodesJoined, CmdWaitServicesReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// Runs f while holding the deployment lock, renews the lock in the background and releases it when f returns,
+// even if f was cancelled. f gets a copy of p with a context that is cancelled if the lock cannot be renewed:
+// somebody else may take the deployment over once the lock expires.
+func withDeploymentLock(p deployProviderImpl, deploymentName string, operation string, events event.Sink, f func(lockedP deployProviderImpl) error) error {
+	logMsg, err := p.acquireLock(deploymentName, operation)
+	events.Emit(event.NewLog(logMsg))
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return err
+	}
+
+	lockedCtx, cancelLocked := context.WithCancelCause(p.getDeployCtx().GoCtx)
+	defer cancelLocked(nil)
+	// reap_expired and destroy_by_tag delete other deployments, their audit records go under the name of the deleted one
+	lockedP := p.withGoCtx(audit.WithDeploymentName(lockedCtx, deploymentName))
+
+	stopRenew := make(chan struct{})
+	renewDone := make(chan struct{})
+	go func() {
+		defer close(renewDone)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopRenew:
+				return
+			case <-ticker.C:
+				if logMsg, err := p.renewLock(deploymentName); err != nil {
+					events.Emit(event.NewLog(logMsg))
+					events.Emit(event.NewError(err))
+					cancelLocked(err)
+					return
+				}
+			}
+		}
+	}()
+
+	err = f(lockedP)
+	if err != nil && context.Cause(lockedCtx) != nil && p.getDeployCtx().GoCtx.Err() == nil {
+		err = fmt.Errorf("%s stopped, the deployment lock could not be renewed: %s", operation, context.Cause(lockedCtx).Error())
+	}
+
+	close(stopRenew)
+	<-renewDone
+	logMsg, releaseErr := p.releaseLock(deploymentName)
+	events.Emit(event.NewLog(logMsg))
+	if releaseErr != nil {
+		events.Emit(event.NewError(releaseErr))
+	}
+	return err
+}
+
+func genericForceUnlock(p deployProviderImpl, deploymentName string, events event.Sink) error {
+	logMsg, err := p.forceUnlock(deploymentName)
+	events.Emit(event.NewLog(logMsg))
+	if err != nil {
+		events.Emit(event.NewError(err))
+	}
+	return err
+}
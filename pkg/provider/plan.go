@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+type PlanAction string
+
+const (
+	PlanActionCreate PlanAction = "create"
+	PlanActionSkip   PlanAction = "skip"
+	PlanActionFail   PlanAction = "fail"
+	PlanActionDelete PlanAction = "delete"
+	PlanActionRun    PlanAction = "run"
+)
+
+type PlanItem struct {
+	Cmd          string     `json:"cmd"`
+	ResourceType string     `json:"resource_type"`
+	Name         string     `json:"name"`
+	Action       PlanAction `json:"action"`
+	Reason       string     `json:"reason"`
+}
+
+func (pi *PlanItem) String() string {
+	return fmt.Sprintf("%-6s %-18s %-40s %s (%s)", pi.Action, pi.ResourceType, pi.Name, pi.Reason, pi.Cmd)
+}
+
+// Accumulates plan items across all steps of a (combined) command, so later steps
+// see resources that earlier steps would create or delete
+type planCtx struct {
+	Items     []*PlanItem
+	curCmd    string
+	curFailed bool
+	created   map[string]struct{}
+	deleted   map[string]struct{}
+}
+
+func newPlanCtx() *planCtx {
+	return &planCtx{
+		Items:   make([]*PlanItem, 0),
+		created: map[string]struct{}{},
+		deleted: map[string]struct{}{}}
+}
+
+func planKey(resourceType string, name string) string {
+	return resourceType + "/" + name
+}
+
+func (pc *planCtx) add(resourceType string, name string, action PlanAction, reason string) {
+	pc.Items = append(pc.Items, &PlanItem{Cmd: pc.curCmd, ResourceType: resourceType, Name: name, Action: action, Reason: reason})
+	switch action {
+	case PlanActionCreate:
+		pc.markCreated(resourceType, name)
+	case PlanActionDelete:
+		pc.markDeleted(resourceType, name)
+	case PlanActionFail:
+		pc.curFailed = true
+	}
+}
+
+func (pc *planCtx) markCreated(resourceType string, name string) {
+	key := planKey(resourceType, name)
+	pc.created[key] = struct{}{}
+	delete(pc.deleted, key)
+}
+
+func (pc *planCtx) markDeleted(resourceType string, name string) {
+	key := planKey(resourceType, name)
+	pc.deleted[key] = struct{}{}
+	delete(pc.created, key)
+}
+
+// Tells if the resource will be there by the time the current step runs: found in the cloud
+// (foundNow) and not deleted by previous steps, or created by previous steps
+func (pc *planCtx) isThere(resourceType string, name string, foundNow bool) bool {
+	key := planKey(resourceType, name)
+	if _, ok := pc.deleted[key]; ok {
+		return false
+	}
+	if _, ok := pc.created[key]; ok {
+		return true
+	}
+	return foundNow
+}
+
+func (pc *planCtx) isPlannedCreate(resourceType string, name string) bool {
+	_, ok := pc.created[planKey(resourceType, name)]
+	return ok
+}
+
+func genericPlanCmd(p deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, events event.Sink) ([]*PlanItem, error) {
+	var combinedCmdCallSeq []CombinedCmdCall
+	var err error
+	if cmd == CmdScale {
+		combinedCmdCallSeq, err = getScaleCmdCallSeq(p, nicknames, false, events)
+	} else if isRollingCmd(cmd) {
+		combinedCmdCallSeq, err = getRollingCmdCallSeq(p.getDeployCtx().Project, cmd, nicknames, execArgs.BatchSize)
+	} else if cmd == CmdUpgradeCapillaries {
+		combinedCmdCallSeq, err = getUpgradeCmdCallSeq(p.getDeployCtx().Project, nicknames, execArgs)
+	} else {
+		combinedCmdCallSeq, err = getCombinedCmdCallSeq(p.getDeployCtx().Project, cmd, nicknames)
+	}
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	pc := newPlanCtx()
+	for stepIdx, cmdCall := range combinedCmdCallSeq {
+		var instances map[string]*prj.InstanceDef
+		if IsCmdRequiresNicknames(cmdCall.Cmd) {
+			if len(cmdCall.Nicknames) == 0 {
+				err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+				events.Emit(event.NewError(err))
+				return nil, err
+			}
+			var err error
+			instances, err = filterByNickname(cmdCall.Nicknames, p.getDeployCtx().Project.Instances, "instance")
+			if err != nil {
+				events.Emit(event.NewError(err))
+				return nil, err
+			}
+		}
+
+		pc.curCmd = cmdCall.Cmd
+		pc.curFailed = false
+		logMsg, err := p.planSimpleCmd(pc, cmdCall.Cmd, instances, execArgs)
+		events.Emit(event.NewLog(logMsg))
+		if err != nil {
+			events.Emit(event.NewError(err))
+			return nil, err
+		}
+
+		if pc.curFailed && cmdCall.OnFail == StopOnFail && stepIdx < len(combinedCmdCallSeq)-1 {
+			events.Emit(event.NewMessage(fmt.Sprintf("%s would fail and stop %s, remaining steps not planned", cmdCall.Cmd, cmd)))
+			break
+		}
+	}
+
+	return pc.Items, nil
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+const serviceReadyPollInterval time.Duration = 5 * time.Second
+
+// Shell command that exits with 0 when the instance is ready to serve. Empty if there is nothing to check.
+func serviceReadinessCmd(iDef *prj.InstanceDef) string {
+	switch prj.InstancePurpose(iDef.Purpose) {
+	case prj.InstancePurposeCassandra:
+		// The node sees itself as up and normal
+		return fmt.Sprintf(`nodetool status 2>/dev/null | awk '$1=="UN" && $2=="%s" {found=1} END {exit !found}'`, iDef.IpAddress)
+	case prj.InstancePurposeDaemon:
+		return "pgrep capidaemon"
+	case prj.InstancePurposeRabbitmq:
+		return "sudo rabbitmq-diagnostics -q ping"
+	case prj.InstancePurposePrometheus:
+		return "curl -sf http://localhost:9090/-/ready"
+	case prj.InstancePurposeBastion:
+		return "pgrep capiwebapi && sudo systemctl is-active --quiet nginx"
+	default:
+		return ""
+	}
+}
+
+// Polls the readiness check until it passes, times out or gets cancelled
+func waitServiceReady(goCtx context.Context, sshConfig *rexec.SshConfigDef, iNickname string, iDef *prj.InstanceDef, timeoutSeconds int, isVerbose bool) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, isVerbose)
+
+	readinessCmd := serviceReadinessCmd(iDef)
+	if readinessCmd == "" {
+		lb.Add(fmt.Sprintf("no readiness check for %s purpose '%s', assuming it is ready", iNickname, iDef.Purpose))
+		return lb.Complete(nil)
+	}
+
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	startTime := time.Now()
+	for {
+		er := rexec.ExecSsh(goCtx, sshConfig, iDef.BestIpAddress(), readinessCmd, map[string]string{})
+		if er.Error == nil && er.ExitStatus == 0 {
+			lb.Add(er.ToString())
+			return lb.Complete(nil)
+		}
+		if time.Since(startTime) > timeout {
+			lb.Add(er.ToString())
+			return lb.Complete(fmt.Errorf("%s is not ready after %ds, readiness check failed: %s", iNickname, timeoutSeconds, readinessCmd))
+		}
+		lb.Add(fmt.Sprintf("%s not ready yet after %.0fs", iNickname, time.Since(startTime).Seconds()))
+		select {
+		case <-goCtx.Done():
+			return lb.Complete(fmt.Errorf("cancelled while waiting for %s to become ready: %s", iNickname, goCtx.Err().Error()))
+		case <-time.After(serviceReadyPollInterval):
+		}
+	}
+}
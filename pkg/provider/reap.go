@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+)
+
+// Deployments past their DeploymentExpires tag that still have billed resources, in name order
+func expiredDeployments(resources []*cld.Resource, now time.Time) []*cld.DeploymentSummary {
+	expired := make([]*cld.DeploymentSummary, 0)
+	for _, summary := range cld.SummarizeDeployments(resources) {
+		if summary.BilledResources > 0 && summary.IsExpired(now) {
+			expired = append(expired, summary)
+		}
+	}
+	return expired
+}
+
+// Reports expired deployments, deletes them by tag if asked. A failed deletion does not stop the others.
+func genericReapExpired(p deployProviderImpl, doDelete bool, events event.Sink) ([]*cld.DeploymentSummary, error) {
+	resources, logMsg, err := p.listDeployments(true)
+	events.Emit(event.NewLog(logMsg))
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+
+	expired := expiredDeployments(resources, time.Now())
+	for _, summary := range expired {
+		events.Emit(event.NewMessage(fmt.Sprintf("%s expired at %s, %d billed resource(s)", summary.DeploymentName, summary.ExpiresAt, summary.BilledResources)))
+	}
+	if !doDelete || len(expired) == 0 {
+		return expired, nil
+	}
+
+	failed := 0
+	for _, summary := range expired {
+		err := withDeploymentLock(p, summary.DeploymentName, CmdReapExpired, events, func(lockedP deployProviderImpl) error {
+			logMsg, err := lockedP.deleteDeploymentByTag(summary.DeploymentName)
+			events.Emit(event.NewLog(logMsg))
+			if err != nil {
+				events.Emit(event.NewError(err))
+			}
+			return err
+		})
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		err := fmt.Errorf("cannot delete %d of %d expired deployment(s)", failed, len(expired))
+		events.Emit(event.NewError(err))
+		return expired, err
+	}
+	return expired, nil
+}
+
+// Deletes (or, with planOnly, lists) everything tagged with the deployment name, the project is not consulted.
+// Deleting needs the name repeated in confirmedName, a typo in the name would delete some other deployment.
+func genericDestroyByTag(p deployProviderImpl, deploymentName string, confirmedName string, planOnly bool, events event.Sink) ([]*PlanItem, error) {
+	if strings.TrimSpace(deploymentName) == "" {
+		err := fmt.Errorf("%s needs a deployment name", CmdDestroyByTag)
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	if !planOnly && confirmedName != deploymentName {
+		err := fmt.Errorf("%s deletes everything tagged with %s, confirm it with -confirm %s", CmdDestroyByTag, deploymentName, deploymentName)
+		events.Emit(event.NewError(err))
+		return nil, err
+	}
+	if planOnly {
+		items, logMsg, err := p.planDeleteDeploymentByTag(deploymentName)
+		events.Emit(event.NewLog(logMsg))
+		if err != nil {
+			events.Emit(event.NewError(err))
+		}
+		return items, err
+	}
+	return nil, withDeploymentLock(p, deploymentName, CmdDestroyByTag, events, func(lockedP deployProviderImpl) error {
+		logMsg, err := lockedP.deleteDeploymentByTag(deploymentName)
+		events.Emit(event.NewLog(logMsg))
+		if err != nil {
+			events.Emit(event.NewError(err))
+		}
+		return err
+	})
+}
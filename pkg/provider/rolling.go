@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+func isRollingCmd(cmd string) bool {
+	return cmd == CmdRollingRestart || cmd == CmdRollingConfig
+}
+
+// Instances are processed batchSize at a time, in nickname order. Each batch is stopped, (re)configured
+// for rolling_config, started and has to pass the readiness check before the next batch is touched.
+// Steps have no ids, so they run one after another and stop on the first failure.
+func getRollingCmdCallSeq(project *prj.Project, cmd string, nicknames string, batchSize int) ([]CombinedCmdCall, error) {
+	if len(nicknames) == 0 {
+		return nil, fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+	}
+	if batchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+	if batchSize == 0 {
+		batchSize = 1
+	}
+
+	instances, err := filterByNickname(nicknames, project.Instances, "instance")
+	if err != nil {
+		return nil, err
+	}
+	sortedNicknames := sortedInstanceNicknames(instances)
+
+	seq := make([]CombinedCmdCall, 0)
+	for batchStart := 0; batchStart < len(sortedNicknames); batchStart += batchSize {
+		batchEnd := min(batchStart+batchSize, len(sortedNicknames))
+		batchList := strings.Join(sortedNicknames[batchStart:batchEnd], ",")
+		seq = append(seq, CombinedCmdCall{CmdStopServices, batchList, StopOnFail, "", nil})
+		if cmd == CmdRollingConfig {
+			seq = append(seq, CombinedCmdCall{CmdConfigServices, batchList, StopOnFail, "", nil})
+		}
+		seq = append(seq,
+			CombinedCmdCall{CmdStartServices, batchList, StopOnFail, "", nil},
+			CombinedCmdCall{CmdWaitServicesReady, batchList, StopOnFail, "", nil})
+	}
+	return seq, nil
+}
@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+)
+
+// Purposes that can grow on a live deployment, by the name used on the command line
+var scalablePurposes map[string]prj.InstancePurpose = map[string]prj.InstancePurpose{
+	"cassandra": prj.InstancePurposeCassandra,
+	"daemon":    prj.InstancePurposeDaemon}
+
+func scalablePurposeNames() []string {
+	names := make([]string, 0, len(scalablePurposes))
+	for name := range scalablePurposes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func instancesByPurpose(project *prj.Project, purpose prj.InstancePurpose) map[string]*prj.InstanceDef {
+	instances := map[string]*prj.InstanceDef{}
+	for iNickname, iDef := range project.Instances {
+		if iDef.Purpose == string(purpose) {
+			instances[iNickname] = iDef
+		}
+	}
+	return instances
+}
+
+// Seed nodes never bootstrap: they would join with no data streamed to them
+func checkCassNodesCanBootstrap(project *prj.Project, newNicknames []string) error {
+	for _, iNickname := range newNicknames {
+		iDef := project.Instances[iNickname]
+		for _, seedIp := range strings.Split(iDef.Service.Env["CASSANDRA_SEEDS"], ",") {
+			if strings.TrimSpace(seedIp) == iDef.IpAddress {
+				return fmt.Errorf("cannot add cassandra node %s: it is listed in its own CASSANDRA_SEEDS and would not bootstrap, keep only the nodes the cluster was created with as seeds", iNickname)
+			}
+		}
+	}
+	return nil
+}
+
+// New instances are created, installed and configured. New Cassandra nodes are started one at a time,
+// each waits for the previous one to bootstrap. Existing daemons get new CASSANDRA_HOSTS one at a time,
+// each has to pass its readiness check before the next one is touched, so processing never stops completely.
+// Prometheus gets new targets.
+func buildScaleCmdCallSeq(project *prj.Project, purpose prj.InstancePurpose, newNicknames []string, runningDaemonNicknames []string) []CombinedCmdCall {
+	newList := strings.Join(newNicknames, ",")
+	hasVolumes := false
+	for _, iNickname := range newNicknames {
+		if len(project.Instances[iNickname].Volumes) > 0 {
+			hasVolumes = true
+		}
+	}
+
+	seq := make([]CombinedCmdCall, 0)
+	var instancesDeps []string
+	if hasVolumes {
+		seq = append(seq, CombinedCmdCall{CmdCreateVolumes, newList, StopOnFail, "volumes", nil})
+		instancesDeps = []string{"volumes"}
+	}
+	seq = append(seq,
+		CombinedCmdCall{CmdCreateInstances, newList, StopOnFail, "instances", instancesDeps},
+		CombinedCmdCall{CmdPingInstances, newList, StopOnFail, "ping_instances", []string{"instances"}})
+	lastId := "ping_instances"
+	if hasVolumes {
+		seq = append(seq, CombinedCmdCall{CmdAttachVolumes, newList, StopOnFail, "attach_volumes", []string{lastId}})
+		lastId = "attach_volumes"
+	}
+	seq = append(seq, CombinedCmdCall{CmdInstallServices, newList, StopOnFail, "install", []string{lastId}})
+	lastId = "install"
+
+	switch purpose {
+	case prj.InstancePurposeCassandra:
+		// Cassandra starts with default config after install, stop it before it forms a cluster of its own
+		seq = append(seq, CombinedCmdCall{CmdStopServices, newList, StopOnFail, "stop_new", []string{lastId}})
+		lastId = "stop_new"
+		for _, iNickname := range newNicknames {
+			seq = append(seq,
+				CombinedCmdCall{CmdConfigServices, iNickname, StopOnFail, "join_" + iNickname, []string{lastId}},
+				CombinedCmdCall{CmdWaitCassNodesJoined, iNickname, StopOnFail, "joined_" + iNickname, []string{"join_" + iNickname}})
+			lastId = "joined_" + iNickname
+		}
+		seq = append(seq, CombinedCmdCall{CmdCheckCassStatus, "", StopOnFail, "check_cass_status", []string{lastId}})
+		lastId = "check_cass_status"
+		for _, iNickname := range runningDaemonNicknames {
+			seq = append(seq,
+				CombinedCmdCall{CmdConfigServices, iNickname, StopOnFail, "reconfig_" + iNickname, []string{lastId}},
+				CombinedCmdCall{CmdWaitServicesReady, iNickname, StopOnFail, "ready_" + iNickname, []string{"reconfig_" + iNickname}})
+			lastId = "ready_" + iNickname
+		}
+	case prj.InstancePurposeDaemon:
+		seq = append(seq, CombinedCmdCall{CmdConfigServices, newList, StopOnFail, "config_new", []string{lastId}})
+		lastId = "config_new"
+	}
+
+	prometheusNicknames := sortedInstanceNicknames(instancesByPurpose(project, prj.InstancePurposePrometheus))
+	if len(prometheusNicknames) > 0 {
+		prometheusList := strings.Join(prometheusNicknames, ",")
+		seq = append(seq,
+			CombinedCmdCall{CmdConfigServices, prometheusList, StopOnFail, "reconfig_prometheus", []string{lastId}},
+			CombinedCmdCall{CmdWaitServicesReady, prometheusList, StopOnFail, "ready_prometheus", []string{"reconfig_prometheus"}})
+	}
+	return seq
+}
+
+// Instances of the purpose that are in the project, but not in the cloud, are the ones to add.
+// On resume, the steps come from the checkpoint: the previous run has created some of the instances already.
+func getScaleCmdCallSeq(p deployProviderImpl, purposeName string, isResume bool, events event.Sink) ([]CombinedCmdCall, error) {
+	purpose, ok := scalablePurposes[purposeName]
+	if !ok {
+		return nil, fmt.Errorf("cannot scale %s, expected one of: %s", purposeName, strings.Join(scalablePurposeNames(), ","))
+	}
+	project := p.getDeployCtx().Project
+
+	if isResume {
+		checkpointPath := checkpointFilePath(project, CmdScale, purposeName)
+		checkpoint, err := loadCheckpoint(checkpointPath)
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			events.Emit(event.NewMessage(fmt.Sprintf("resuming %s %s with steps from checkpoint %s", CmdScale, purposeName, checkpointPath)))
+			return checkpoint.cmdCallSeq(), nil
+		}
+	}
+
+	purposeInstances := instancesByPurpose(project, purpose)
+	if len(purposeInstances) == 0 {
+		return nil, fmt.Errorf("cannot scale %s, there are no instances with purpose %s in the project", purposeName, purpose)
+	}
+	newNicknames, logMsg, err := p.getMissingInstances(purposeInstances)
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsg))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(newNicknames) == 0 {
+		events.Emit(event.NewMessage(fmt.Sprintf("all %d %s instances are already there, nothing to scale; add instances to the project first", len(purposeInstances), purposeName)))
+		return []CombinedCmdCall{}, nil
+	}
+	if len(newNicknames) == len(purposeInstances) {
+		return nil, fmt.Errorf("cannot scale %s, none of its instances exist yet, create the deployment first", purposeName)
+	}
+	events.Emit(event.NewMessage(fmt.Sprintf("adding %s: %s", purposeName, strings.Join(newNicknames, ","))))
+
+	runningDaemonNicknames := make([]string, 0)
+	if purpose == prj.InstancePurposeCassandra {
+		if err := checkCassNodesCanBootstrap(project, newNicknames); err != nil {
+			return nil, err
+		}
+		// Daemons not created yet will get new CASSANDRA_HOSTS when they are
+		daemonInstances := instancesByPurpose(project, prj.InstancePurposeDaemon)
+		missingDaemonNicknames, logMsg, err := p.getMissingInstances(daemonInstances)
+		if p.getDeployCtx().IsVerbose {
+			events.Emit(event.NewLog(logMsg))
+		}
+		if err != nil {
+			return nil, err
+		}
+		missingDaemonSet := map[string]struct{}{}
+		for _, iNickname := range missingDaemonNicknames {
+			missingDaemonSet[iNickname] = struct{}{}
+		}
+		for _, iNickname := range sortedInstanceNicknames(daemonInstances) {
+			if _, ok := missingDaemonSet[iNickname]; !ok {
+				runningDaemonNicknames = append(runningDaemonNicknames, iNickname)
+			}
+		}
+	}
+
+	return buildScaleCmdCallSeq(project, purpose, newNicknames, runningDaemonNicknames), nil
+}
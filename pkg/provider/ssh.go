@@ -0,0 +1,35 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Interactive session (or a single command) on one instance, via bastion if needed. Returns remote exit status.
+func genericSsh(p deployProviderImpl, nickname string, remoteCmd string, events event.Sink) (int, error) {
+	iDef, ok := p.getDeployCtx().Project.Instances[nickname]
+	if !ok {
+		err := fmt.Errorf("instance %s not found, available instances: %s", nickname, reflect.ValueOf(p.getDeployCtx().Project.Instances).MapKeys())
+		events.Emit(event.NewError(err))
+		return 0, err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		events.Emit(event.NewLog(logMsgBastionIp))
+		events.Emit(event.NewError(err))
+		return 0, err
+	}
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsgBastionIp))
+	}
+
+	exitStatus, err := rexec.RunInteractiveSsh(p.getDeployCtx().GoCtx, p.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), remoteCmd)
+	if err != nil {
+		events.Emit(event.NewError(err))
+	}
+	return exitStatus, err
+}
@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+const DefaultSocksPort int = 1080
+
+type tunnelPreset struct {
+	Purpose prj.InstancePurpose // The first instance with this purpose (sorted by nickname) is used
+	Ports   []int
+	Desc    string
+}
+
+// Well-known services of a Capillaries deployment, local port is the same as remote
+var tunnelPresets map[string]tunnelPreset = map[string]tunnelPreset{
+	"prometheus": {prj.InstancePurposePrometheus, []int{9090}, "Prometheus UI"},
+	"rabbitmq":   {prj.InstancePurposeRabbitmq, []int{15672, 5672}, "RabbitMQ"},
+	"cassandra":  {prj.InstancePurposeCassandra, []int{9042}, "Cassandra CQL"},
+	"webapi":     {prj.InstancePurposeBastion, []int{6543}, "Capillaries webapi"}}
+
+func tunnelPresetNames() []string {
+	names := make([]string, 0, len(tunnelPresets))
+	for name := range tunnelPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Address the bastion uses to reach the instance
+func tunnelRemoteHost(iDef *prj.InstanceDef) string {
+	if iDef.Purpose == string(prj.InstancePurposeBastion) {
+		return "127.0.0.1"
+	}
+	return iDef.IpAddress
+}
+
+func parsePort(s string, what string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s port '%s'", what, s)
+	}
+	return port, nil
+}
+
+// Each spec item is one of:
+// <preset> (prometheus, rabbitmq, cassandra, webapi)
+// <nickname>:<remote port> (local port is the same)
+// <local port>:<nickname>:<remote port>
+// socks or socks:<local port>
+// Returns forwards and SOCKS port (0 if no SOCKS proxy requested).
+func parseTunnelSpec(project *prj.Project, spec string) ([]*rexec.PortForwardDef, int, error) {
+	forwards := make([]*rexec.PortForwardDef, 0)
+	socksPort := 0
+	usedLocalPorts := map[int]string{}
+	addForward := func(localPort int, iNickname string, remotePort int, desc string) error {
+		iDef, ok := project.Instances[iNickname]
+		if !ok {
+			return fmt.Errorf("instance %s not found", iNickname)
+		}
+		if prevItem, ok := usedLocalPorts[localPort]; ok {
+			return fmt.Errorf("local port %d used by both %s and %s", localPort, prevItem, desc)
+		}
+		usedLocalPorts[localPort] = desc
+		forwards = append(forwards, &rexec.PortForwardDef{LocalPort: localPort, RemoteHost: tunnelRemoteHost(iDef), RemotePort: remotePort, Desc: desc})
+		return nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if parts[0] == "socks" {
+			if socksPort != 0 {
+				return nil, 0, fmt.Errorf("only one SOCKS proxy allowed")
+			}
+			socksPort = DefaultSocksPort
+			if len(parts) == 2 {
+				var err error
+				if socksPort, err = parsePort(parts[1], "SOCKS"); err != nil {
+					return nil, 0, err
+				}
+			} else if len(parts) > 2 {
+				return nil, 0, fmt.Errorf("invalid tunnel spec '%s', expected socks or socks:<local port>", item)
+			}
+			if prevItem, ok := usedLocalPorts[socksPort]; ok {
+				return nil, 0, fmt.Errorf("local port %d used by both %s and SOCKS proxy", socksPort, prevItem)
+			}
+			usedLocalPorts[socksPort] = "SOCKS proxy"
+			continue
+		}
+
+		switch len(parts) {
+		case 1:
+			preset, ok := tunnelPresets[item]
+			if !ok {
+				return nil, 0, fmt.Errorf("unknown tunnel preset '%s', expected one of %s, <nickname>:<remote port>, <local port>:<nickname>:<remote port> or socks[:<local port>]", item, strings.Join(tunnelPresetNames(), ","))
+			}
+			nicknames := make([]string, 0)
+			for iNickname, iDef := range project.Instances {
+				if iDef.Purpose == string(preset.Purpose) {
+					nicknames = append(nicknames, iNickname)
+				}
+			}
+			if len(nicknames) == 0 {
+				return nil, 0, fmt.Errorf("cannot use tunnel preset %s: no instances with purpose %s", item, preset.Purpose)
+			}
+			sort.Strings(nicknames)
+			for _, port := range preset.Ports {
+				if err := addForward(port, nicknames[0], port, fmt.Sprintf("%s on %s", preset.Desc, nicknames[0])); err != nil {
+					return nil, 0, err
+				}
+			}
+		case 2, 3:
+			localPortStr, iNickname, remotePortStr := parts[len(parts)-1], parts[0], parts[1]
+			if len(parts) == 3 {
+				localPortStr, iNickname, remotePortStr = parts[0], parts[1], parts[2]
+			}
+			localPort, err := parsePort(localPortStr, "local")
+			if err != nil {
+				return nil, 0, err
+			}
+			remotePort, err := parsePort(remotePortStr, "remote")
+			if err != nil {
+				return nil, 0, err
+			}
+			if err := addForward(localPort, iNickname, remotePort, fmt.Sprintf("%s:%d", iNickname, remotePort)); err != nil {
+				return nil, 0, err
+			}
+		default:
+			return nil, 0, fmt.Errorf("invalid tunnel spec '%s'", item)
+		}
+	}
+
+	if len(forwards) == 0 && socksPort == 0 {
+		return nil, 0, fmt.Errorf("nothing to forward, expected comma-separated list of %s, <nickname>:<remote port>, <local port>:<nickname>:<remote port> or socks[:<local port>]", strings.Join(tunnelPresetNames(), ","))
+	}
+	return forwards, socksPort, nil
+}
+
+// Runs until cancelled (Ctrl-C), bastion connection is re-established if it drops
+func genericTunnel(p deployProviderImpl, spec string, events event.Sink) error {
+	forwards, socksPort, err := parseTunnelSpec(p.getDeployCtx().Project, spec)
+	if err != nil {
+		events.Emit(event.NewError(err))
+		return err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		events.Emit(event.NewLog(logMsgBastionIp))
+		events.Emit(event.NewError(err))
+		return err
+	}
+	if p.getDeployCtx().IsVerbose {
+		events.Emit(event.NewLog(logMsgBastionIp))
+	}
+
+	events.Emit(event.NewMessage("press Ctrl-C to stop"))
+	err = rexec.RunTunnels(p.getDeployCtx().GoCtx, p.getDeployCtx().Project.SshConfig, forwards, socksPort, func(msg string) { events.Emit(event.NewMessage(msg)) })
+	if err != nil {
+		events.Emit(event.NewError(err))
+	}
+	return err
+}
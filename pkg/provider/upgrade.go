@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Scripts that deal with Capillaries binaries and UI, everything else on the instance is left alone by upgrades
+var capillariesScriptPrefixes []string = []string{
+	"scripts/daemon/",
+	"scripts/webapi/",
+	"scripts/toolbelt/",
+	"scripts/ui/"}
+
+// Kept in the ssh user home dir on each instance, one key=value per line
+const capillariesReleaseFile string = "capillaries_release"
+
+// Release URLs like .../latest do not say what was installed, so installed binaries and UI files are fingerprinted
+const capillariesBuildFingerprintCmd string = `cd ~ && { find bin -maxdepth 1 -type f -name 'capi*' 2>/dev/null; find ui -type f 2>/dev/null; } | sort | xargs -r sha256sum | sha256sum | cut -c1-16`
+
+// Release URLs end up in install scripts and in the release file, so only plain http(s) URLs are accepted
+func validateReleaseUrl(releaseUrl string) error {
+	u, err := url.Parse(releaseUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(releaseUrl, "'\"`$\\ \t\r\n") {
+		return fmt.Errorf("invalid release url '%s', expected http(s) url", releaseUrl)
+	}
+	return nil
+}
+
+func filterCapillariesScripts(scriptPaths []string) []string {
+	result := make([]string, 0)
+	for _, scriptPath := range scriptPaths {
+		for _, prefix := range capillariesScriptPrefixes {
+			if strings.HasPrefix(scriptPath, prefix) {
+				result = append(result, scriptPath)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func hasCapillariesScripts(iDef *prj.InstanceDef) bool {
+	return len(filterCapillariesScripts(iDef.Service.Cmd.Install)) > 0
+}
+
+// Current and previous release URLs and the current build fingerprint recorded on the instance, empty if never recorded
+func readCapillariesRelease(goCtx context.Context, sshConfig *rexec.SshConfigDef, ipAddress string) (string, string, string, rexec.ExecResult) {
+	er := rexec.ExecSsh(goCtx, sshConfig, ipAddress, fmt.Sprintf("cat ~/%s 2>/dev/null || true", capillariesReleaseFile), map[string]string{})
+	currentUrl, previousUrl, currentBuild := "", "", ""
+	for _, line := range strings.Split(er.Stdout, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			switch k {
+			case "current":
+				currentUrl = v
+			case "previous":
+				previousUrl = v
+			case "build":
+				currentBuild = v
+			}
+		}
+	}
+	return currentUrl, previousUrl, currentBuild, er
+}
+
+// Stops Capillaries services on the instance, installs them from the new release URL (or the previously
+// installed one on rollback), configures and starts them, records the release and waits until the instance is ready
+func reinstallCapillariesOnInstance(goCtx context.Context, sshConfig *rexec.SshConfigDef, iNickname string, iDef *prj.InstanceDef, execArgs *ExecArgs, readyTimeoutSeconds int) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, execArgs.Verbosity)
+
+	if !hasCapillariesScripts(iDef) {
+		lb.Add(fmt.Sprintf("%s has no Capillaries components, skipping", iNickname))
+		return lb.Complete(nil)
+	}
+
+	currentUrl, previousUrl, currentBuild, er := readCapillariesRelease(goCtx, sshConfig, iDef.BestIpAddress())
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return lb.Complete(fmt.Errorf("cannot read %s on %s: %s", capillariesReleaseFile, iNickname, er.Error.Error()))
+	}
+	if currentUrl == "" {
+		// Installed by install_services, release came from the project
+		currentUrl = iDef.Service.Env["CAPILLARIES_RELEASE_URL"]
+	}
+
+	newUrl := execArgs.ReleaseUrl
+	if execArgs.Rollback {
+		if previousUrl == "" {
+			return lb.Complete(fmt.Errorf("cannot roll back %s, no previous release recorded in ~/%s", iNickname, capillariesReleaseFile))
+		}
+		// Came from a file on the instance, anyone with access to it could have put anything there
+		if err := validateReleaseUrl(previousUrl); err != nil {
+			return lb.Complete(fmt.Errorf("cannot roll back %s to the release recorded in ~/%s: %s", iNickname, capillariesReleaseFile, err.Error()))
+		}
+		newUrl = previousUrl
+	} else if newUrl == "" {
+		newUrl = iDef.Service.Env["CAPILLARIES_RELEASE_URL"]
+	}
+	lb.AddAlways(fmt.Sprintf("%s: %s (build %s) -> %s", iNickname, currentUrl, currentBuild, newUrl))
+
+	env := make(map[string]string, len(iDef.Service.Env))
+	for k, v := range iDef.Service.Env {
+		env[k] = v
+	}
+	env["CAPILLARIES_RELEASE_URL"] = newUrl
+
+	for _, scripts := range [][]string{iDef.Service.Cmd.Stop, iDef.Service.Cmd.Install, iDef.Service.Cmd.Config, iDef.Service.Cmd.Start} {
+		logMsg, err := rexec.ExecEmbeddedScriptsOnInstance(goCtx, sshConfig, iDef.BestIpAddress(), filterCapillariesScripts(scripts), env, execArgs.Verbosity)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(fmt.Errorf("cannot install %s on %s: %s", newUrl, iNickname, err.Error()))
+		}
+	}
+
+	er = rexec.ExecSsh(goCtx, sshConfig, iDef.BestIpAddress(), capillariesBuildFingerprintCmd, map[string]string{})
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return lb.Complete(fmt.Errorf("cannot fingerprint installed build on %s: %s", iNickname, er.Error.Error()))
+	}
+	newBuild := strings.TrimSpace(er.Stdout)
+
+	// On rollback, the release we roll back from becomes the previous one, so rollback can be undone the same way.
+	// Reinstalling the same release (a new build under the same URL) keeps the previous one.
+	recordedPreviousUrl := currentUrl
+	if newUrl == currentUrl {
+		recordedPreviousUrl = previousUrl
+	}
+	recordCmd := fmt.Sprintf("printf 'current=%%s\\nbuild=%%s\\nprevious=%%s\\nupdated=%%s\\n' %s %s %s %s > ~/%s",
+		rexec.ShellQuote(newUrl), rexec.ShellQuote(newBuild), rexec.ShellQuote(recordedPreviousUrl), rexec.ShellQuote(time.Now().UTC().Format(time.RFC3339)), capillariesReleaseFile)
+	er = rexec.ExecSsh(goCtx, sshConfig, iDef.BestIpAddress(), recordCmd, map[string]string{})
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return lb.Complete(fmt.Errorf("cannot record release %s on %s: %s", newUrl, iNickname, er.Error.Error()))
+	}
+	lb.AddAlways(fmt.Sprintf("%s: installed build %s", iNickname, newBuild))
+
+	logMsg, err := waitServiceReady(goCtx, sshConfig, iNickname, iDef, readyTimeoutSeconds, execArgs.Verbosity)
+	lb.Add(string(logMsg))
+	return lb.Complete(err)
+}
+
+// Instances with Capillaries components are upgraded batchSize at a time, the rest of the selection is ignored
+func getUpgradeCmdCallSeq(project *prj.Project, nicknames string, execArgs *ExecArgs) ([]CombinedCmdCall, error) {
+	if execArgs.Rollback == (execArgs.ReleaseUrl != "") {
+		return nil, fmt.Errorf("%s expects either -url <new release url> or -rollback", CmdUpgradeCapillaries)
+	}
+	if execArgs.ReleaseUrl != "" {
+		if err := validateReleaseUrl(execArgs.ReleaseUrl); err != nil {
+			return nil, err
+		}
+	}
+	if len(nicknames) == 0 {
+		return nil, fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+	}
+
+	instances, err := filterByNickname(nicknames, project.Instances, "instance")
+	if err != nil {
+		return nil, err
+	}
+	upgradedInstances := map[string]*prj.InstanceDef{}
+	for iNickname, iDef := range instances {
+		if hasCapillariesScripts(iDef) {
+			upgradedInstances[iNickname] = iDef
+		}
+	}
+	if len(upgradedInstances) == 0 {
+		return nil, fmt.Errorf("none of the selected instances (%s) has Capillaries components to upgrade", nicknames)
+	}
+
+	batchSize := execArgs.BatchSize
+	if batchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+	if batchSize == 0 {
+		batchSize = 1
+	}
+	sortedNicknames := sortedInstanceNicknames(upgradedInstances)
+	seq := make([]CombinedCmdCall, 0)
+	for batchStart := 0; batchStart < len(sortedNicknames); batchStart += batchSize {
+		batchEnd := min(batchStart+batchSize, len(sortedNicknames))
+		seq = append(seq, CombinedCmdCall{CmdReinstallCapillaries, strings.Join(sortedNicknames[batchStart:batchEnd], ","), StopOnFail, "", nil})
+	}
+	return seq, nil
+}
@@ -2,6 +2,8 @@ package rexec
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -11,12 +13,15 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+const ExitStatusUnknown int = -1
+
 type ExecResult struct {
-	Cmd     string
-	Stdout  string
-	Stderr  string
-	Elapsed float64
-	Error   error
+	Cmd        string
+	Stdout     string
+	Stderr     string
+	Elapsed    float64
+	Error      error
+	ExitStatus int // ExitStatusUnknown if the command did not run or did not report its exit status
 }
 
 func (er *ExecResult) ToString() string {
@@ -34,9 +39,10 @@ stderr:
 %s
 error:
 %s
+exit status:%d
 remote cmd elapsed:%0.3f
 -----------------------
-`, er.Cmd, er.Stdout, er.Stderr, errString, er.Elapsed)
+`, er.Cmd, er.Stdout, er.Stderr, errString, er.ExitStatus, er.Elapsed)
 }
 
 type SshConfigDef struct {
@@ -69,8 +75,26 @@ func (tsc *TunneledSshClient) Close() {
 	}
 }
 
+// Closes the client as soon as goCtx is cancelled, so sessions running on it return immediately.
+// Call the returned func when the client is not needed anymore.
+func (tsc *TunneledSshClient) closeOnCancel(goCtx context.Context) func() {
+	doneChan := make(chan struct{})
+	go func() {
+		select {
+		case <-goCtx.Done():
+			tsc.Close()
+		case <-doneChan:
+		}
+	}()
+	return func() { close(doneChan) }
+}
+
 // Our jumphost implementation
-func NewTunneledSshClient(sshConfig *SshConfigDef, ipAddress string) (*TunneledSshClient, error) {
+func NewTunneledSshClient(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string) (*TunneledSshClient, error) {
+	if goCtx.Err() != nil {
+		return nil, fmt.Errorf("cancelled before connecting to %s: %s", ipAddress, goCtx.Err().Error())
+	}
+
 	bastionSshClientConfig, err := NewSshClientConfig(
 		sshConfig.User,
 		sshConfig.PrivateKeyOrPath)
@@ -121,7 +145,7 @@ func NewTunneledSshClient(sshConfig *SshConfigDef, ipAddress string) (*TunneledS
 	return &tsc, nil
 }
 
-func ExecSsh(sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[string]string) ExecResult {
+func ExecSsh(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[string]string) ExecResult {
 	cmdBuilder := strings.Builder{}
 	for k, v := range envVars {
 		if strings.Contains(v, " ") {
@@ -132,15 +156,16 @@ func ExecSsh(sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[
 	}
 	cmdBuilder.WriteString(cmd)
 
-	tsc, err := NewTunneledSshClient(sshConfig, ipAddress)
+	tsc, err := NewTunneledSshClient(goCtx, sshConfig, ipAddress)
 	if err != nil {
-		return ExecResult{cmdBuilder.String(), "", "", 0, err}
+		return ExecResult{cmdBuilder.String(), "", "", 0, err, ExitStatusUnknown}
 	}
 	defer tsc.Close()
+	defer tsc.closeOnCancel(goCtx)()
 
 	session, err := tsc.SshClient.NewSession()
 	if err != nil {
-		return ExecResult{cmdBuilder.String(), "", "", 0, fmt.Errorf("cannot create session for %s: %s", ipAddress, err.Error())}
+		return ExecResult{cmdBuilder.String(), "", "", 0, fmt.Errorf("cannot create session for %s: %s", ipAddress, err.Error()), ExitStatusUnknown}
 	}
 	defer session.Close()
 
@@ -153,7 +178,17 @@ func ExecSsh(sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[
 	runStartTime := time.Now()
 	err = session.Run(cmdBuilder.String())
 	elapsed := time.Since(runStartTime).Seconds()
+	exitStatus := ExitStatusUnknown
+	var exitErr *ssh.ExitError
 	if err == nil {
+		exitStatus = 0
+	} else if errors.As(err, &exitErr) {
+		exitStatus = exitErr.ExitStatus()
+	}
+	if goCtx.Err() != nil {
+		// The connection was closed under the session, whatever session.Run returned is not informative
+		err = fmt.Errorf("cancelled while executing on %s: %s", ipAddress, goCtx.Err().Error())
+	} else if err == nil {
 		if len(stderr.String()) > 0 {
 			err = fmt.Errorf("%s", stderr.String())
 		}
@@ -165,13 +200,13 @@ func ExecSsh(sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[
 		}
 	}
 
-	er := ExecResult{cmd, stdout.String(), stderr.String(), elapsed, err}
+	er := ExecResult{cmd, stdout.String(), stderr.String(), elapsed, err, exitStatus}
 	return er
 }
 
-func ExecCommandOnInstance(sshConfig *SshConfigDef, ipAddress string, cmd string, isVerbose bool) (l.LogMsg, error) {
+func ExecCommandOnInstance(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string, isVerbose bool) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(fmt.Sprintf("ExecCommandOnInstance: %s - %s", ipAddress, cmd), isVerbose)
-	er := ExecSsh(sshConfig, ipAddress, cmd, map[string]string{})
+	er := ExecSsh(goCtx, sshConfig, ipAddress, cmd, map[string]string{})
 	lb.Add(er.ToString())
 	if er.Error != nil {
 		return lb.Complete(er.Error)
@@ -197,8 +232,8 @@ func ExecSshForClient(sshClient *ssh.Client, cmd string) (string, string, error)
 }
 
 // Used on volume attachment
-func ExecSshAndReturnLastLine(sshConfig *SshConfigDef, ipAddress string, cmd string) (string, ExecResult) {
-	er := ExecSsh(sshConfig, ipAddress, cmd, map[string]string{})
+func ExecSshAndReturnLastLine(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string) (string, ExecResult) {
+	er := ExecSsh(goCtx, sshConfig, ipAddress, cmd, map[string]string{})
 	if er.Error != nil {
 		return "", er
 	}
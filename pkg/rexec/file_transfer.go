@@ -0,0 +1,214 @@
+package rexec
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"golang.org/x/crypto/ssh"
+)
+
+// Single-quotes a string so it survives remote shell expansion
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Octal, as chmod takes it: 644 and 0644 both mean rw-r--r--. Empty means leave as is.
+func ParsePermissions(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	permissions, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || permissions > 07777 {
+		return 0, fmt.Errorf("invalid permissions %s, expected octal mode like 644", s)
+	}
+	return int(permissions), nil
+}
+
+// user or user:group, as chown takes it
+var ownerRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+
+// Creates the remote directory. If owner is set, the directories that did not exist yet get that owner too.
+func makeRemoteDir(sshClient *ssh.Client, dirPath string, owner string) error {
+	if owner == "" {
+		_, _, err := ExecSshForClient(sshClient, fmt.Sprintf("mkdir -p %s", ShellQuote(dirPath)))
+		return err
+	}
+	// Collect missing directories in positional parameters before creating them, so paths with spaces survive
+	_, _, err := ExecSshForClient(sshClient, fmt.Sprintf(
+		`p=%s; set --; while [ ! -d "$p" ]; do set -- "$p" "$@"; p=$(dirname "$p"); done; mkdir -p %s && for d in "$@"; do sudo chown %s "$d" || exit 1; done`,
+		ShellQuote(dirPath), ShellQuote(dirPath), ShellQuote(owner)))
+	return err
+}
+
+func uploadOneFile(sshClient *ssh.Client, lb *l.LogBuilder, srcFilePath string, dstFilePath string, permissions int, owner string) error {
+	f, err := os.Open(srcFilePath)
+	if err != nil {
+		return fmt.Errorf("cannot open local file %s: %s", srcFilePath, err.Error())
+	}
+	defer f.Close()
+
+	if err := makeRemoteDir(sshClient, path.Dir(dstFilePath), owner); err != nil {
+		return err
+	}
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("cannot create session for %s: %s", sshClient.RemoteAddr(), err.Error())
+	}
+	defer session.Close()
+
+	session.Stdin = f
+	if err := session.Run(fmt.Sprintf("cat > %s", ShellQuote(dstFilePath))); err != nil {
+		return fmt.Errorf("cannot upload %s to %s:%s: %s", srcFilePath, sshClient.RemoteAddr(), dstFilePath, err.Error())
+	}
+
+	if permissions != 0 {
+		if _, _, err := ExecSshForClient(sshClient, fmt.Sprintf("chmod %o %s", permissions, ShellQuote(dstFilePath))); err != nil {
+			return err
+		}
+	}
+
+	if owner != "" {
+		if _, _, err := ExecSshForClient(sshClient, fmt.Sprintf("sudo chown %s %s", ShellQuote(owner), ShellQuote(dstFilePath))); err != nil {
+			return err
+		}
+	}
+
+	lb.Add(fmt.Sprintf("uploaded %s to %s", srcFilePath, dstFilePath))
+	return nil
+}
+
+// Uploads a local file or a directory (recursively) to the instance. If srcPath is a directory,
+// dstPath is the remote directory that receives its contents. Permissions is a file mode like 0644, 0 leaves it as is.
+func UploadFiles(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, srcPath string, dstPath string, permissions int, owner string, isVerbose bool) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(fmt.Sprintf("UploadFiles: %s to %s:%s", srcPath, ipAddress, dstPath), isVerbose)
+
+	if srcPath == "" || dstPath == "" {
+		return lb.Complete(fmt.Errorf("empty parameter not allowed: srcPath (%s), dstPath (%s)", srcPath, dstPath))
+	}
+	if permissions < 0 || permissions > 07777 {
+		return lb.Complete(fmt.Errorf("invalid permissions %o", permissions))
+	}
+	if owner != "" && !ownerRegex.MatchString(owner) {
+		return lb.Complete(fmt.Errorf("invalid owner %s, expected user or user:group", owner))
+	}
+
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return lb.Complete(fmt.Errorf("cannot find local path %s: %s", srcPath, err.Error()))
+	}
+
+	tsc, err := NewTunneledSshClient(goCtx, sshConfig, ipAddress)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	defer tsc.Close()
+	defer tsc.closeOnCancel(goCtx)()
+
+	if !srcInfo.IsDir() {
+		return lb.Complete(uploadOneFile(tsc.SshClient, lb, srcPath, dstPath, permissions, owner))
+	}
+
+	fileCount := 0
+	err = filepath.WalkDir(srcPath, func(curPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcPath, curPath)
+		if err != nil {
+			return err
+		}
+		fileCount++
+		return uploadOneFile(tsc.SshClient, lb, curPath, path.Join(dstPath, filepath.ToSlash(relPath)), permissions, owner)
+	})
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	lb.Add(fmt.Sprintf("uploaded %d files to %s:%s", fileCount, ipAddress, dstPath))
+	return lb.Complete(nil)
+}
+
+func downloadOneFile(sshClient *ssh.Client, lb *l.LogBuilder, srcFilePath string, dstFilePath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstFilePath), 0755); err != nil {
+		return fmt.Errorf("cannot create local directory for %s: %s", dstFilePath, err.Error())
+	}
+
+	f, err := os.Create(dstFilePath)
+	if err != nil {
+		return fmt.Errorf("cannot create local file %s: %s", dstFilePath, err.Error())
+	}
+	defer f.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("cannot create session for %s: %s", sshClient.RemoteAddr(), err.Error())
+	}
+	defer session.Close()
+
+	session.Stdout = f
+	if err := session.Run(fmt.Sprintf("cat %s", ShellQuote(srcFilePath))); err != nil {
+		return fmt.Errorf("cannot download %s:%s to %s: %s", sshClient.RemoteAddr(), srcFilePath, dstFilePath, err.Error())
+	}
+
+	lb.Add(fmt.Sprintf("downloaded %s to %s", srcFilePath, dstFilePath))
+	return nil
+}
+
+// Downloads a remote file or a directory (recursively) from the instance to a local directory dstDirPath
+func DownloadFiles(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, srcPath string, dstDirPath string, isVerbose bool) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(fmt.Sprintf("DownloadFiles: %s:%s to %s", ipAddress, srcPath, dstDirPath), isVerbose)
+
+	if srcPath == "" || dstDirPath == "" {
+		return lb.Complete(fmt.Errorf("empty parameter not allowed: srcPath (%s), dstDirPath (%s)", srcPath, dstDirPath))
+	}
+
+	tsc, err := NewTunneledSshClient(goCtx, sshConfig, ipAddress)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	defer tsc.Close()
+	defer tsc.closeOnCancel(goCtx)()
+
+	// For a single file, find returns the file itself
+	stdout, _, err := ExecSshForClient(tsc.SshClient, fmt.Sprintf("find %s -type f", ShellQuote(srcPath)))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	srcRoot := strings.TrimRight(srcPath, "/")
+	fileCount := 0
+	for _, remoteFilePath := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		if remoteFilePath == "" {
+			continue
+		}
+		var relPath string
+		if remoteFilePath == srcRoot {
+			relPath = path.Base(remoteFilePath)
+		} else {
+			relPath = strings.TrimPrefix(remoteFilePath, srcRoot+"/")
+		}
+		if err := downloadOneFile(tsc.SshClient, lb, remoteFilePath, filepath.Join(dstDirPath, filepath.FromSlash(relPath))); err != nil {
+			return lb.Complete(err)
+		}
+		fileCount++
+	}
+
+	if fileCount == 0 {
+		return lb.Complete(fmt.Errorf("no files found at %s:%s", ipAddress, srcPath))
+	}
+
+	lb.Add(fmt.Sprintf("downloaded %d files from %s:%s", fileCount, ipAddress, srcPath))
+	return lb.Complete(nil)
+}
@@ -0,0 +1,79 @@
+package rexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Runs an interactive shell (cmd is empty) or cmd on the instance, with local stdin/stdout/stderr attached.
+// If stdin is a terminal, it is switched to raw mode and the remote side gets a PTY that follows local window size.
+// Returns remote exit status.
+func RunInteractiveSsh(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string) (int, error) {
+	tsc, err := NewTunneledSshClient(goCtx, sshConfig, ipAddress)
+	if err != nil {
+		return 0, err
+	}
+	defer tsc.Close()
+	defer tsc.closeOnCancel(goCtx)()
+
+	session, err := tsc.SshClient.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("cannot create session for %s: %s", ipAddress, err.Error())
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stdinFd := int(os.Stdin.Fd())
+	if term.IsTerminal(stdinFd) {
+		width, height, err := term.GetSize(stdinFd)
+		if err != nil {
+			return 0, fmt.Errorf("cannot get terminal size: %s", err.Error())
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		if err := session.RequestPty(termType, height, width, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return 0, fmt.Errorf("cannot request pty on %s: %s", ipAddress, err.Error())
+		}
+
+		oldState, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			return 0, fmt.Errorf("cannot switch terminal to raw mode: %s", err.Error())
+		}
+		defer term.Restore(stdinFd, oldState)
+
+		stopWatching := watchWindowSize(stdinFd, session)
+		defer stopWatching()
+	}
+
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot start session on %s: %s", ipAddress, err.Error())
+	}
+
+	err = session.Wait()
+	if goCtx.Err() != nil {
+		return 0, fmt.Errorf("cancelled while in session on %s: %s", ipAddress, goCtx.Err().Error())
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("session on %s failed: %s", ipAddress, err.Error())
+	}
+	return 0, nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package rexec
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Forwards local terminal resizes (SIGWINCH) to the remote PTY. Call the returned func to stop.
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGWINCH)
+	doneChan := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				if width, height, err := term.GetSize(fd); err == nil {
+					session.WindowChange(height, width)
+				}
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(doneChan)
+	}
+}
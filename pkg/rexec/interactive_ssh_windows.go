@@ -0,0 +1,33 @@
+//go:build windows
+
+package rexec
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// No SIGWINCH on Windows: poll console size and forward changes to the remote PTY. Call the returned func to stop.
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	doneChan := make(chan struct{})
+	go func() {
+		lastWidth, lastHeight, _ := term.GetSize(fd)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				width, height, err := term.GetSize(fd)
+				if err == nil && (width != lastWidth || height != lastHeight) {
+					session.WindowChange(height, width)
+					lastWidth, lastHeight = width, height
+				}
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+	return func() { close(doneChan) }
+}
@@ -0,0 +1,126 @@
+package rexec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Minimal SOCKS5 server side (RFC 1928): no authentication, CONNECT only
+const (
+	socks5Version          byte = 0x05
+	socks5NoAuth           byte = 0x00
+	socks5NoAcceptableAuth byte = 0xFF
+	socks5CmdConnect       byte = 0x01
+	socks5AddrIpv4         byte = 0x01
+	socks5AddrDomain       byte = 0x03
+	socks5AddrIpv6         byte = 0x04
+	socks5ReplySuccess     byte = 0x00
+	socks5ReplyFailure     byte = 0x01
+	socks5ReplyHostUnreach byte = 0x04
+	socks5ReplyCmdNotSupp  byte = 0x07
+	socks5ReplyAddrNotSupp byte = 0x08
+)
+
+func writeSocks5Reply(conn net.Conn, reply byte) error {
+	// Bound address is not meaningful for us, report 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIpv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func readSocks5Request(conn net.Conn) (string, byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", socks5ReplyFailure, err
+	}
+	if header[0] != socks5Version {
+		return "", socks5ReplyFailure, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", socks5ReplyFailure, err
+	}
+	isNoAuthOffered := false
+	for _, method := range methods {
+		if method == socks5NoAuth {
+			isNoAuthOffered = true
+		}
+	}
+	if !isNoAuthOffered {
+		conn.Write([]byte{socks5Version, socks5NoAcceptableAuth})
+		return "", socks5ReplyFailure, fmt.Errorf("SOCKS client does not support no-auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", socks5ReplyFailure, err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", socks5ReplyFailure, err
+	}
+	if request[1] != socks5CmdConnect {
+		return "", socks5ReplyCmdNotSupp, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIpv4, socks5AddrIpv6:
+		addrLen := net.IPv4len
+		if request[3] == socks5AddrIpv6 {
+			addrLen = net.IPv6len
+		}
+		addr := make([]byte, addrLen)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", socks5ReplyFailure, err
+		}
+		host = net.IP(addr).String()
+	case socks5AddrDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, domainLen); err != nil {
+			return "", socks5ReplyFailure, err
+		}
+		domain := make([]byte, domainLen[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", socks5ReplyFailure, err
+		}
+		host = string(domain)
+	default:
+		return "", socks5ReplyAddrNotSupp, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", socks5ReplyFailure, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socks5ReplySuccess, nil
+}
+
+// Handles one SOCKS5 client connection, dialing the requested address with dialFunc. Closes localConn when done.
+func serveSocks5Conn(localConn net.Conn, dialFunc func(addr string) (net.Conn, error), logFunc func(msg string)) {
+	addr, reply, err := readSocks5Request(localConn)
+	if err != nil {
+		if reply != socks5ReplyFailure {
+			writeSocks5Reply(localConn, reply)
+		}
+		logFunc(fmt.Sprintf("SOCKS: %s", err.Error()))
+		localConn.Close()
+		return
+	}
+
+	remoteConn, err := dialFunc(addr)
+	if err != nil {
+		writeSocks5Reply(localConn, socks5ReplyHostUnreach)
+		logFunc(fmt.Sprintf("SOCKS: %s", err.Error()))
+		localConn.Close()
+		return
+	}
+
+	if err := writeSocks5Reply(localConn, socks5ReplySuccess); err != nil {
+		remoteConn.Close()
+		localConn.Close()
+		return
+	}
+	pipeConns(localConn, remoteConn)
+}
@@ -0,0 +1,209 @@
+package rexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const tunnelKeepaliveInterval time.Duration = 15 * time.Second
+
+// Local port forwarded to RemoteHost:RemotePort, as seen from the bastion
+type PortForwardDef struct {
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+	Desc       string
+}
+
+func (fd *PortForwardDef) String() string {
+	return fmt.Sprintf("127.0.0.1:%d -> %s:%d (%s)", fd.LocalPort, fd.RemoteHost, fd.RemotePort, fd.Desc)
+}
+
+// Bastion ssh connection shared by all forwards; dropped and re-established when it goes away
+type bastionConn struct {
+	mx        sync.Mutex
+	goCtx     context.Context
+	sshConfig *SshConfigDef
+	tsc       *TunneledSshClient
+	logFunc   func(msg string)
+}
+
+func (bc *bastionConn) get() (*ssh.Client, error) {
+	bc.mx.Lock()
+	defer bc.mx.Unlock()
+	if bc.tsc == nil {
+		tsc, err := NewTunneledSshClient(bc.goCtx, bc.sshConfig, bc.sshConfig.BastionExternalIp)
+		if err != nil {
+			return nil, err
+		}
+		bc.tsc = tsc
+		bc.logFunc(fmt.Sprintf("connected to bastion %s", bc.sshConfig.BastionExternalIp))
+	}
+	return bc.tsc.SshClient, nil
+}
+
+// Only drops the connection if nobody has replaced it yet
+func (bc *bastionConn) drop(client *ssh.Client, reason error) {
+	bc.mx.Lock()
+	defer bc.mx.Unlock()
+	if bc.tsc != nil && bc.tsc.SshClient == client {
+		bc.tsc.Close()
+		bc.tsc = nil
+		if bc.goCtx.Err() == nil {
+			bc.logFunc(fmt.Sprintf("connection to bastion %s dropped, reconnecting: %s", bc.sshConfig.BastionExternalIp, reason.Error()))
+		}
+	}
+}
+
+func (bc *bastionConn) close() {
+	bc.mx.Lock()
+	defer bc.mx.Unlock()
+	if bc.tsc != nil {
+		bc.tsc.Close()
+		bc.tsc = nil
+	}
+}
+
+// Opens a TCP connection from the bastion, reconnecting to the bastion once if the current connection is dead
+func (bc *bastionConn) dial(addr string) (net.Conn, error) {
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		client, err := bc.get()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		var openChannelErr *ssh.OpenChannelError
+		if errors.As(err, &openChannelErr) {
+			// Bastion is fine, it just cannot reach addr
+			return nil, fmt.Errorf("bastion cannot connect to %s: %s", addr, err.Error())
+		}
+		bc.drop(client, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("cannot connect to %s via bastion: %s", addr, lastErr.Error())
+}
+
+// Detects dead bastion connections even when there is no traffic, so reconnect happens before the next client shows up
+func (bc *bastionConn) keepAlive() {
+	ticker := time.NewTicker(tunnelKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.goCtx.Done():
+			return
+		case <-ticker.C:
+			client, err := bc.get()
+			if err != nil {
+				if bc.goCtx.Err() == nil {
+					bc.logFunc(fmt.Sprintf("cannot reconnect to bastion, will retry in %s: %s", tunnelKeepaliveInterval, err.Error()))
+				}
+				continue
+			}
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				bc.drop(client, err)
+			}
+		}
+	}
+}
+
+func pipeConns(localConn net.Conn, remoteConn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(remoteConn, localConn)
+		remoteConn.Close()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(localConn, remoteConn)
+		localConn.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+// Accepts connections until the listener is closed, handler owns the accepted connection
+func serveListener(listener net.Listener, handler func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handler(conn)
+	}
+}
+
+// Forwards local ports (and, if socksPort is not 0, runs a SOCKS5 proxy) over one ssh connection to the bastion.
+// Local ports are bound to 127.0.0.1 only. Runs until goCtx is cancelled, reconnecting to the bastion when the connection drops.
+func RunTunnels(goCtx context.Context, sshConfig *SshConfigDef, forwards []*PortForwardDef, socksPort int, logFunc func(msg string)) error {
+	listeners := make([]net.Listener, 0, len(forwards)+1)
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	for _, fd := range forwards {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", fd.LocalPort))
+		if err != nil {
+			closeListeners()
+			return fmt.Errorf("cannot listen on local port %d for %s: %s", fd.LocalPort, fd.Desc, err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	var socksListener net.Listener
+	if socksPort != 0 {
+		var err error
+		socksListener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", socksPort))
+		if err != nil {
+			closeListeners()
+			return fmt.Errorf("cannot listen on local port %d for SOCKS proxy: %s", socksPort, err.Error())
+		}
+		listeners = append(listeners, socksListener)
+	}
+
+	bc := &bastionConn{goCtx: goCtx, sshConfig: sshConfig, logFunc: logFunc}
+	// Fail early if the bastion is not reachable at all
+	if _, err := bc.get(); err != nil {
+		closeListeners()
+		return err
+	}
+
+	for i, fd := range forwards {
+		remoteAddr := fmt.Sprintf("%s:%d", fd.RemoteHost, fd.RemotePort)
+		go serveListener(listeners[i], func(localConn net.Conn) {
+			remoteConn, err := bc.dial(remoteAddr)
+			if err != nil {
+				logFunc(fmt.Sprintf("%s: %s", fd.Desc, err.Error()))
+				localConn.Close()
+				return
+			}
+			pipeConns(localConn, remoteConn)
+		})
+		logFunc(fmt.Sprintf("forwarding %s", fd.String()))
+	}
+	if socksListener != nil {
+		go serveListener(socksListener, func(localConn net.Conn) {
+			serveSocks5Conn(localConn, bc.dial, logFunc)
+		})
+		logFunc(fmt.Sprintf("SOCKS5 proxy on 127.0.0.1:%d, connections are made from the bastion", socksPort))
+	}
+
+	go bc.keepAlive()
+
+	<-goCtx.Done()
+	closeListeners()
+	bc.close()
+	return nil
+}
@@ -0,0 +1,572 @@
+// Package server runs capideploy commands as asynchronous jobs behind a local HTTP/JSON API.
+// Jobs use the cloud credentials of the server process, API clients never see them.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/event"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/provider"
+)
+
+const maxRequestBytes int64 = 1024 * 1024
+
+// A subscriber that has this many events waiting is dropped, it can reconnect with Last-Event-ID
+const subscriberBacklog int = 1024
+
+type streamedEvent struct {
+	Idx  int
+	Data []byte
+}
+
+// A job started by this server process. It is the event sink of the job: events go to the events file
+// and to everyone streaming them.
+type jobRun struct {
+	mx          sync.Mutex
+	job         *Job // Guarded by Server.mx
+	goCtx       context.Context
+	cancel      context.CancelFunc
+	eventsFile  *os.File
+	eventCount  int
+	subscribers map[chan streamedEvent]struct{}
+	isClosed    bool
+}
+
+func (run *jobRun) Emit(e *event.Event) {
+	eventBytes, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	run.mx.Lock()
+	defer run.mx.Unlock()
+	if run.isClosed {
+		return
+	}
+	// Nowhere to report a failed write to, the job itself keeps running
+	run.eventsFile.Write(append(eventBytes, '\n'))
+	for ch := range run.subscribers {
+		select {
+		case ch <- streamedEvent{run.eventCount, eventBytes}:
+		default:
+			delete(run.subscribers, ch)
+			close(ch)
+		}
+	}
+	run.eventCount++
+}
+
+func readEvents(path string) ([][]byte, error) {
+	eventsBytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return [][]byte{}, nil
+		}
+		return nil, fmt.Errorf("cannot read events %s: %s", path, err.Error())
+	}
+	events := make([][]byte, 0)
+	for _, line := range bytes.Split(eventsBytes, []byte{'\n'}) {
+		if len(line) > 0 {
+			events = append(events, line)
+		}
+	}
+	return events, nil
+}
+
+// Returns events emitted so far and a channel with the ones to come. The channel is nil if the job
+// has finished already, and it is closed when the job finishes or the subscriber falls behind.
+func (run *jobRun) subscribe(eventsPath string) ([][]byte, chan streamedEvent, error) {
+	run.mx.Lock()
+	defer run.mx.Unlock()
+	past, err := readEvents(eventsPath)
+	if err != nil || run.isClosed {
+		return past, nil, err
+	}
+	ch := make(chan streamedEvent, subscriberBacklog)
+	run.subscribers[ch] = struct{}{}
+	return past, ch, nil
+}
+
+func (run *jobRun) unsubscribe(ch chan streamedEvent) {
+	run.mx.Lock()
+	defer run.mx.Unlock()
+	if _, ok := run.subscribers[ch]; ok {
+		delete(run.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (run *jobRun) close() {
+	run.mx.Lock()
+	defer run.mx.Unlock()
+	run.isClosed = true
+	run.eventsFile.Close()
+	for ch := range run.subscribers {
+		close(ch)
+	}
+	run.subscribers = map[chan streamedEvent]struct{}{}
+}
+
+// What API clients may use of the server host. Jobs run with the cloud credentials of the server,
+// but they must not read or write its files, or see its env variables, unless allowed here.
+type Options struct {
+	DefaultPrjFile string   // Project of jobs that bring none
+	ProjectsDir    string   // project_path of a job is relative to it, empty means project_path is refused
+	AllowedEnv     []string // CAPIDEPLOY_* variables of the server that a project_jsonnet may use
+	Token          string   // Clients send it as a bearer token, empty means no authentication
+	IsVerbose      bool
+}
+
+type Server struct {
+	mx             sync.Mutex
+	store          *Store
+	jobs           map[string]*Job
+	runs           map[string]*jobRun // Jobs that are not finished yet
+	defaultPrjFile string
+	projectsDir    string
+	allowedEnv     map[string]struct{}
+	token          string
+	isVerbose      bool
+	goCtx          context.Context // Cancelling it cancels all jobs
+	wg             sync.WaitGroup
+}
+
+// Jobs left running by a previous server process are marked interrupted: their checkpoints
+// are still there, so a new job with resume continues from where they stopped
+func NewServer(goCtx context.Context, store *Store, opts *Options) (*Server, error) {
+	jobs, err := store.loadAll()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		store:          store,
+		jobs:           map[string]*Job{},
+		runs:           map[string]*jobRun{},
+		defaultPrjFile: opts.DefaultPrjFile,
+		projectsDir:    opts.ProjectsDir,
+		allowedEnv:     map[string]struct{}{},
+		token:          opts.Token,
+		isVerbose:      opts.IsVerbose,
+		goCtx:          goCtx}
+	for _, envVar := range opts.AllowedEnv {
+		s.allowedEnv[envVar] = struct{}{}
+	}
+	for _, job := range jobs {
+		if !job.Status.IsFinished() {
+			now := time.Now()
+			job.Status = JobInterrupted
+			job.FinishedAt = &now
+			job.Error = "server stopped while the job was running"
+			if err := store.save(job); err != nil {
+				return nil, err
+			}
+		}
+		s.jobs[job.Id] = job
+	}
+	return s, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.handleCreateJob)
+	mux.HandleFunc("GET /jobs", s.handleListJobs)
+	mux.HandleFunc("GET /jobs/{id}", s.handleGetJob)
+	mux.HandleFunc("GET /jobs/{id}/results", s.handleGetResults)
+	mux.HandleFunc("GET /jobs/{id}/events", s.handleEvents)
+	mux.HandleFunc("POST /jobs/{id}/cancel", s.handleCancelJob)
+	if s.token == "" {
+		return mux
+	}
+	expectedAuth := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expectedAuth) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong bearer token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Waits for all jobs to finish, cancel goCtx first to make them stop
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// Copy that can be marshaled without holding the lock
+func (s *Server) jobSnapshot(id string) (Job, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Zero values mean capideploy command line defaults
+func (a *JobArgs) execArgs(isVerbose bool) *provider.ExecArgs {
+	numberOfRepetitions := a.NumberOfRepetitions
+	if numberOfRepetitions == 0 {
+		numberOfRepetitions = 50
+	}
+	batchSize := a.BatchSize
+	if batchSize == 0 {
+		batchSize = 1
+	}
+	return &provider.ExecArgs{
+		IgnoreAttachedVolumes: a.IgnoreAttachedVolumes,
+		Verbosity:             isVerbose,
+		NumberOfRepetitions:   numberOfRepetitions,
+		Resume:                a.Resume,
+		BatchSize:             batchSize,
+		ReleaseUrl:            a.ReleaseUrl,
+		Rollback:              a.Rollback}
+}
+
+func envOrOverride(envOverrides map[string]string, name string) string {
+	if v, ok := envOverrides[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+func (s *Server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	if s.goCtx.Err() != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("server is stopping"))
+		return
+	}
+
+	var req JobRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("cannot parse job request: %s", err.Error()))
+		return
+	}
+	if !provider.IsExecCmd(req.Cmd) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("command %s cannot run as a job, only commands that create, change or delete deployment resources can", req.Cmd))
+		return
+	}
+	if req.Cmd == provider.CmdUploadFiles || req.Cmd == provider.CmdDownloadFiles {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("command %s cannot run as a job, it would read or write files of the server", req.Cmd))
+		return
+	}
+	if req.Nicknames == "" && provider.IsCmdRequiresPositionalArg(req.Cmd) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("command %s needs nicknames", req.Cmd))
+		return
+	}
+	if req.ProjectPath != "" && req.ProjectJsonnet != "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("project_path and project_jsonnet cannot be used together"))
+		return
+	}
+	prjPath := s.defaultPrjFile
+	if req.ProjectPath != "" {
+		if s.projectsDir == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("project_path cannot be used, the server has no projects directory"))
+			return
+		}
+		if !filepath.IsLocal(req.ProjectPath) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("project_path %s must be relative to the projects directory and stay in it", req.ProjectPath))
+			return
+		}
+		prjPath = filepath.Join(s.projectsDir, req.ProjectPath)
+	}
+
+	jobId, err := newJobId()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var project *prj.Project
+	if req.ProjectJsonnet != "" {
+		// Kept with the job, so it is clear later what exactly was deployed
+		prjPath = s.store.projectPath(jobId)
+		if err := os.WriteFile(prjPath, []byte(req.ProjectJsonnet), 0600); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("cannot save project of job %s: %s", jobId, err.Error()))
+			return
+		}
+		req.ProjectJsonnet = ""
+		project, err = prj.LoadUntrustedProject(prjPath, req.Env, s.allowedEnv)
+		if err == nil && project.AuditLog != "" {
+			err = fmt.Errorf("project_jsonnet cannot set audit_log, it is a file on the server")
+		}
+	} else {
+		project, err = prj.LoadProjectWithEnv(prjPath, req.Env)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Args.DeploymentTtl != "" {
+		project.DeploymentTtl = req.Args.DeploymentTtl
+	}
+
+	// Env values may be secrets, like the ssh key, they are not stored with the job
+	envOverrides := req.Env
+	req.Env = nil
+
+	eventsFile, err := os.OpenFile(s.store.eventsPath(jobId), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("cannot create events file of job %s: %s", jobId, err.Error()))
+		return
+	}
+
+	job := &Job{
+		Id:             jobId,
+		Request:        &req,
+		DeploymentName: project.DeploymentName,
+		Status:         JobQueued,
+		CreatedAt:      time.Now()}
+	goCtx, cancel := context.WithCancel(s.goCtx)
+	run := &jobRun{
+		job:         job,
+		goCtx:       goCtx,
+		cancel:      cancel,
+		eventsFile:  eventsFile,
+		subscribers: map[chan streamedEvent]struct{}{}}
+
+	s.mx.Lock()
+	if err := s.store.save(job); err != nil {
+		s.mx.Unlock()
+		cancel()
+		eventsFile.Close()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.jobs[jobId] = job
+	s.runs[jobId] = run
+	s.wg.Add(1)
+	jobCopy := *job
+	s.mx.Unlock()
+
+	go s.runJob(run, project, envOverrides)
+
+	writeJson(w, http.StatusAccepted, &jobCopy)
+}
+
+func (s *Server) runJob(run *jobRun, project *prj.Project, envOverrides map[string]string) {
+	defer s.wg.Done()
+
+	s.mx.Lock()
+	startedAt := time.Now()
+	run.job.Status = JobRunning
+	run.job.StartedAt = &startedAt
+	if err := s.store.save(run.job); err != nil {
+		run.Emit(event.NewError(err))
+	}
+	req := run.job.Request
+	s.mx.Unlock()
+
+	var results []*provider.InstanceCmdResult
+	deployProvider, err := provider.DeployProviderFactory(project, run.goCtx,
+		&provider.AssumeRoleConfig{
+			RoleArn:    envOrOverride(envOverrides, "CAPIDEPLOY_AWS_ROLE_TO_ASSUME_ARN"),
+			ExternalId: envOrOverride(envOverrides, "CAPIDEPLOY_AWS_ROLE_TO_ASSUME_EXTERNAL_ID")},
+		s.isVerbose, run)
+	if err == nil {
+		results, err = deployProvider.ExecCmd(req.Cmd, req.Nicknames, req.Args.execArgs(s.isVerbose))
+		if closeErr := deployProvider.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	s.mx.Lock()
+	finishedAt := time.Now()
+	job := run.job
+	job.FinishedAt = &finishedAt
+	job.Results = results
+	if run.goCtx.Err() != nil {
+		if s.goCtx.Err() != nil {
+			job.Status = JobInterrupted
+		} else {
+			job.Status = JobCancelled
+		}
+	} else if err != nil {
+		job.Status = JobFailed
+	} else {
+		job.Status = JobSucceeded
+	}
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if saveErr := s.store.save(job); saveErr != nil {
+		run.Emit(event.NewError(saveErr))
+	}
+	delete(s.runs, job.Id)
+	s.mx.Unlock()
+
+	run.close()
+	run.cancel()
+}
+
+// Newest first, ?deployment=<name> to see one deployment only
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	deploymentName := r.URL.Query().Get("deployment")
+	s.mx.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if deploymentName == "" || job.DeploymentName == deploymentName {
+			jobs = append(jobs, *job)
+		}
+	}
+	s.mx.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id > jobs[j].Id })
+	writeJson(w, http.StatusOK, jobs)
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobSnapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+		return
+	}
+	writeJson(w, http.StatusOK, &job)
+}
+
+// One result per instance and command, empty until the job finishes
+func (s *Server) handleGetResults(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobSnapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+		return
+	}
+	results := job.Results
+	if results == nil {
+		results = []*provider.InstanceCmdResult{}
+	}
+	writeJson(w, http.StatusOK, results)
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	jobId := r.PathValue("id")
+	s.mx.Lock()
+	job, ok := s.jobs[jobId]
+	run := s.runs[jobId]
+	var jobCopy Job
+	if ok {
+		jobCopy = *job
+	}
+	s.mx.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", jobId))
+		return
+	}
+	if run == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is %s, nothing to cancel", jobId, jobCopy.Status))
+		return
+	}
+	run.Emit(event.NewMessage("cancel requested, waiting for running operations to stop"))
+	run.cancel()
+	writeJson(w, http.StatusAccepted, &jobCopy)
+}
+
+// Server-sent events: everything the job has emitted so far, then new events as they come, then an "end" event
+// with the finished job. Clients that reconnect with Last-Event-ID get only the events they have not seen.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	jobId := r.PathValue("id")
+	s.mx.Lock()
+	_, ok := s.jobs[jobId]
+	run := s.runs[jobId]
+	s.mx.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", jobId))
+		return
+	}
+
+	lastEventIdx := -1
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		var err error
+		lastEventIdx, err = strconv.Atoi(lastEventId)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %s", lastEventId))
+			return
+		}
+	}
+
+	var past [][]byte
+	var live chan streamedEvent
+	var err error
+	if run != nil {
+		past, live, err = run.subscribe(s.store.eventsPath(jobId))
+		if live != nil {
+			defer run.unsubscribe(live)
+		}
+	} else {
+		past, err = readEvents(s.store.eventsPath(jobId))
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for eventIdx, data := range past {
+		if eventIdx > lastEventIdx {
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", eventIdx, data)
+		}
+	}
+	flusher.Flush()
+
+	if live != nil {
+	liveLoop:
+		for {
+			select {
+			case e, ok := <-live:
+				if !ok {
+					break liveLoop
+				}
+				if e.Idx > lastEventIdx {
+					fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Idx, e.Data)
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	job, _ := s.jobSnapshot(jobId)
+	if !job.Status.IsFinished() {
+		// Fell behind, the client reconnects and continues from the last event it got
+		return
+	}
+	jobBytes, err := json.Marshal(&job)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: end\ndata: %s\n\n", jobBytes)
+	flusher.Flush()
+}
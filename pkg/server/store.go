@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/provider"
+)
+
+type JobStatus string
+
+const (
+	JobQueued      JobStatus = "queued"
+	JobRunning     JobStatus = "running"
+	JobSucceeded   JobStatus = "succeeded"
+	JobFailed      JobStatus = "failed"
+	JobCancelled   JobStatus = "cancelled"
+	JobInterrupted JobStatus = "interrupted" // The server stopped while the job was running, resume it with a new job
+)
+
+func (s JobStatus) IsFinished() bool {
+	return s != JobQueued && s != JobRunning
+}
+
+// Same knobs as capideploy command line flags
+type JobArgs struct {
+	IgnoreAttachedVolumes bool   `json:"ignore_attached_volumes,omitempty"`
+	NumberOfRepetitions   int    `json:"repetitions,omitempty"`
+	Resume                bool   `json:"resume,omitempty"`
+	BatchSize             int    `json:"batch,omitempty"`
+	ReleaseUrl            string `json:"url,omitempty"`
+	Rollback              bool   `json:"rollback,omitempty"`
+	DeploymentTtl         string `json:"ttl,omitempty"`
+}
+
+type JobRequest struct {
+	Cmd            string            `json:"cmd"`
+	Nicknames      string            `json:"nicknames,omitempty"`       // Or workflow name for run_workflow, purpose for scale
+	ProjectPath    string            `json:"project_path,omitempty"`    // Relative to serve -projects, default: serve -p
+	ProjectJsonnet string            `json:"project_jsonnet,omitempty"` // Project file contents, instead of ProjectPath
+	Env            map[string]string `json:"env,omitempty"`             // CAPIDEPLOY_* values of the project, never stored
+	Args           JobArgs           `json:"args"`
+}
+
+type Job struct {
+	Id             string                        `json:"id"`
+	Request        *JobRequest                   `json:"request"`
+	DeploymentName string                        `json:"deployment_name"`
+	Status         JobStatus                     `json:"status"`
+	CreatedAt      time.Time                     `json:"created_at"`
+	StartedAt      *time.Time                    `json:"started_at,omitempty"`
+	FinishedAt     *time.Time                    `json:"finished_at,omitempty"`
+	Error          string                        `json:"error,omitempty"`
+	Results        []*provider.InstanceCmdResult `json:"results,omitempty"`
+}
+
+// Sortable by creation time
+func newJobId() (string, error) {
+	randBytes := make([]byte, 4)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", fmt.Errorf("cannot generate job id: %s", err.Error())
+	}
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(randBytes)), nil
+}
+
+// A directory with three files per job: <id>.json with status and results, <id>.events.jsonl with everything
+// the job emitted, and <id>.jsonnet if the project came with the request
+type Store struct {
+	dir string
+}
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create job store %s: %s", dir, err.Error())
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (st *Store) jobPath(id string) string {
+	return filepath.Join(st.dir, id+".json")
+}
+
+func (st *Store) eventsPath(id string) string {
+	return filepath.Join(st.dir, id+".events.jsonl")
+}
+
+func (st *Store) projectPath(id string) string {
+	return filepath.Join(st.dir, id+".jsonnet")
+}
+
+// Written to a temp file first, so a crash never leaves a half-written job behind
+func (st *Store) save(job *Job) error {
+	jobBytes, err := json.MarshalIndent(job, "", "    ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal job %s: %s", job.Id, err.Error())
+	}
+	tmpPath := st.jobPath(job.Id) + ".tmp"
+	if err := os.WriteFile(tmpPath, jobBytes, 0600); err != nil {
+		return fmt.Errorf("cannot write job %s: %s", job.Id, err.Error())
+	}
+	if err := os.Rename(tmpPath, st.jobPath(job.Id)); err != nil {
+		return fmt.Errorf("cannot write job %s: %s", job.Id, err.Error())
+	}
+	return nil
+}
+
+func (st *Store) loadAll() ([]*Job, error) {
+	jobPaths, err := filepath.Glob(filepath.Join(st.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list jobs in %s: %s", st.dir, err.Error())
+	}
+	jobs := make([]*Job, 0, len(jobPaths))
+	for _, jobPath := range jobPaths {
+		jobBytes, err := os.ReadFile(jobPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read job %s: %s", jobPath, err.Error())
+		}
+		var job Job
+		if err := json.Unmarshal(jobBytes, &job); err != nil {
+			return nil, fmt.Errorf("cannot parse job %s: %s", jobPath, err.Error())
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}